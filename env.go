@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// envPrefix is prepended to a flag's upper-cased name to form its environment
+// variable, e.g. -new-session-rate is read from RELAY_NEW_SESSION_RATE
+const envPrefix = "RELAY_"
+
+// legacyEnv lists the environment variables flags were read from before every
+// flag had one; they are still honoured after the RELAY_ name
+var legacyEnv = map[string]string{
+	"ports":     "LISTEN_PORTS",
+	"target":    "TARGET_ENDPOINT",
+	"dns-check": "DNS_CHECK_INTERVAL",
+}
+
+// envExempt lists flags that are only read from the command line; a stray
+// RELAY_VERSION or RELAY_TEST_SERVER in the environment must not turn every
+// start into something other than a relay
+var envExempt = map[string]bool{
+	"version":          true,
+	"print-config":     true,
+	"test-server":      true,
+	"loadgen":          true,
+	"loadgen-clients":  true,
+	"loadgen-rate":     true,
+	"loadgen-size":     true,
+	"loadgen-duration": true,
+}
+
+// secretFlags lists flags whose values -print-config redacts. -obfuscate
+// keeps its transform name, e.g. xor:<redacted>.
+var secretFlags = map[string]bool{
+	"client-hash-salt": true,
+	"relay-link-key":   true,
+	"obfuscate":        true,
+}
+
+// redactSecret returns what -print-config shows of the secret flag name's
+// value
+func redactSecret(name, value string) string {
+	if name == "obfuscate" {
+		if transform, _, ok := strings.Cut(value, ":"); ok {
+			return transform + ":<redacted>"
+		}
+	}
+	return "<redacted>"
+}
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// annotateEnvUsage appends each flag's environment variable to its usage text
+func annotateEnvUsage(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if envExempt[f.Name] {
+			return
+		}
+		names := envName(f.Name)
+		if legacy, ok := legacyEnv[f.Name]; ok {
+			names += " or " + legacy
+		}
+		f.Usage += " [env " + names + "]"
+	})
+}
+
+// applyEnv sets every flag not given on the command line from its environment
+// variable, giving the precedence flag > environment > default. Empty
+// variables are ignored. It returns the variable each flag was set from.
+func applyEnv(fs *flag.FlagSet) (map[string]string, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	fromEnv := make(map[string]string)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || envExempt[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		value := os.Getenv(name)
+		if legacy, ok := legacyEnv[f.Name]; ok && value == "" {
+			name, value = legacy, os.Getenv(legacy)
+		}
+		if value == "" {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s=%q: %v", name, value, setErr)
+			return
+		}
+		fromEnv[f.Name] = name
+	})
+	return fromEnv, err
+}
+
+// printConfig writes a table of every setting's effective value and where it
+// came from: the command line, an environment variable (fromEnv, as returned
+// by applyEnv) or the default. Secrets (secretFlags) are redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet, fromEnv map[string]string) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	fs.VisitAll(func(f *flag.Flag) {
+		if envExempt[f.Name] {
+			return
+		}
+		source := "default"
+		if f.Value.String() != f.DefValue {
+			// Filled in from other settings, e.g. -client-idle from -timeout
+			source = "derived"
+		}
+		// Flags set from the environment count as given, so check it first
+		if name, ok := fromEnv[f.Name]; ok {
+			source = "env " + name
+		} else if given[f.Name] {
+			source = "flag"
+			if name := envName(f.Name); os.Getenv(name) != "" {
+				source += " (overrides " + name + ")"
+			}
+		}
+
+		value := f.Value.String()
+		switch {
+		case value == "":
+			value = `""`
+		case secretFlags[f.Name]:
+			value = redactSecret(f.Name, value)
+		case f.Name == "upstream-socks":
+			// Drop the proxy's user:pass@
+			if at := strings.LastIndex(value, "@"); at >= 0 {
+				value = value[at+1:]
+			}
+		}
+		fmt.Fprintf(tw, "-%s\t%s\t%s\n", f.Name, value, source)
+	})
+	tw.Flush()
+}
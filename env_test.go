@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("client-hash-salt", "", "")
+	fs.String("relay-link-key", "", "")
+	fs.String("obfuscate", "", "")
+	fs.String("target", "", "")
+	t.Setenv("RELAY_RELAY_LINK_KEY", "00112233445566778899aabbccddeeff")
+	if err := fs.Parse([]string{"-client-hash-salt", "pepper", "-obfuscate", "xor:c0ffee", "-target", "vpn.example.com:51820"}); err != nil {
+		t.Fatal(err)
+	}
+	fromEnv, err := applyEnv(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	printConfig(&out, fs, fromEnv)
+	for _, secret := range []string{"pepper", "00112233", "c0ffee"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("secret %q printed:\n%s", secret, out.String())
+		}
+	}
+	for _, shown := range []string{"vpn.example.com:51820", "xor:<redacted>"} {
+		if !strings.Contains(out.String(), shown) {
+			t.Errorf("%q missing:\n%s", shown, out.String())
+		}
+	}
+}
@@ -1,334 +1,318 @@
+// Command wg-udp-relay forwards WireGuard UDP traffic to a server with SNAT.
+// It parses flags and the environment into a relay.Config and runs it with
+// relay.Serve until SIGINT or SIGTERM.
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-)
 
-// ClientSession represents an active client connection with SNAT mapping
-type ClientSession struct {
-	clientAddr     *net.UDPAddr  // Original client address
-	toServerConn   *net.UDPConn  // Connection to WireGuard server (has ephemeral port)
-	lastActive     time.Time
-	mu             sync.Mutex
-}
+	"github.com/RemoteToHome-io/wg-udp-relay/relay"
+)
 
-// Relay manages UDP packet forwarding with SNAT
-type Relay struct {
-	listenAddr       string
-	listenPort       int
-	targetAddr       string
-	timeout          time.Duration
-	bufferSize       int
-	dnsCheckInterval time.Duration
-	listenConn       *net.UDPConn      // Main listening connection
-	sessions         map[string]*ClientSession  // Keyed by client address
-	sessionsMu       sync.RWMutex
-	targetConn       *net.UDPAddr
-	targetConnMu     sync.RWMutex
-}
+// Set at build time, e.g.
+// go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
 
 func main() {
-	listenPorts := flag.String("ports", "", "Comma-separated list of ports to listen on (e.g., 51820,51821)")
+	relay.SetVersion(version, commit)
+
+	listenPorts := flag.String("ports", "", "Comma-separated list of ports or host:port addresses to listen on (e.g., 51820,10.0.0.1:51821)")
+	tcpPorts := flag.String("tcp-ports", "", "Comma-separated list of ports or host:port addresses to accept length-prefixed WireGuard packets over TCP on, for clients on UDP-blocked networks")
 	targetAddr := flag.String("target", "", "Target WireGuard server address (required)")
+	configDir := flag.String("config-dir", "", "Directory of *.yaml files defining one relay each (listen, target), started in addition to -ports; files with errors are skipped")
+	targetAllowCIDR := flag.String("target-allow-cidr", "", "Comma-separated CIDRs the target must resolve into; other DNS answers are rejected and the last good address is kept (e.g., 203.0.113.0/24)")
+	targetPort := flag.Int("target-port", 0, "Override the port of the resolved target address (the port in -target becomes optional)")
 	timeout := flag.Duration("timeout", 3*time.Minute, "Connection idle timeout")
-	bufferSize := flag.Int("buffer", 1500, "UDP buffer size in bytes")
+	hibernate := flag.Duration("session-hibernate", 0, "Keep an expired session's server source port this long and reuse it when the client returns, instead of a new port (0 disables)")
+	probeBeforeClose := flag.Duration("probe-before-close", 0, "Before closing an idle session, send -probe-payload to the server and keep the session if it answers within this long (0 disables)")
+	probePayload := flag.String("probe-payload", "", "Hex-encoded payload sent by -probe-before-close (default: an empty datagram)")
+	hardTimeout := flag.Duration("hard-timeout", 0, "Keep sessions idle past -timeout, marked idle, and only close them at this timeout (0 closes at -timeout)")
+	clientIdle := flag.Duration("client-idle", 0, "Idle timeout for client -> server traffic (defaults to -timeout)")
+	serverIdle := flag.Duration("server-idle", 0, "Idle timeout for server -> client traffic (defaults to -timeout)")
+	cleanupInterval := flag.Duration("cleanup-interval", 0, "Expired session sweep interval (default min(30s, timeout/2))")
+	bufferFlag := flag.String("buffer", "1500", "UDP buffer size in bytes, or 'auto' to start small and grow on truncated packets")
+	portRcvbuf := flag.String("port-rcvbuf", "", "Per-port socket receive buffer (SO_RCVBUF) as listen=bytes pairs, set before the listening socket binds (e.g., 51820=8388608)")
+	responseBuffer := flag.Int("response-buffer", 0, "Read buffer size in bytes for server responses, to tune per-session memory separately from -buffer (0 uses -buffer)")
+	portBuffer := flag.String("port-buffer", "", "Per-port -buffer overrides as listen=size pairs, listen as given in -ports (e.g., 51820=9000,10.0.0.1:51821=auto)")
+	leakCheckInterval := flag.Duration("leak-check-interval", time.Minute, "How often the goroutine count is compared with the session count to warn of goroutine leaks (0 disables)")
+	summaryInterval := flag.Duration("summary-interval", 0, "Log each relay's packet and bit rates in both directions and its session count at this interval (0 disables)")
+	readErrorBackoff := flag.Duration("read-error-backoff", time.Second, "Longest pause between reads while the listening socket keeps returning errors; pauses start at 5ms and double")
+	listenWake := flag.Duration("listen-wake", 0, "Wake the listen read loop after this long without packets, via a read deadline, to check for shutdown and do housekeeping (0 blocks until a packet arrives)")
+	startStagger := flag.Duration("start-stagger", 0, "Delay between starting each -ports relay, to spread out their initial DNS lookups and socket setup (0 starts all at once)")
 	dnsCheckInterval := flag.Duration("dns-check", 5*time.Minute, "DNS resolution check interval")
-	
+	dnsVerbose := flag.Bool("dns-verbose", false, "Log every DNS re-check of the target: addresses, latency and the name servers queried (chatty with many ports)")
+	recoverPanics := flag.Bool("recover-panics", true, "Log and count a panic in a packet or session goroutine and close just that session, instead of crashing the process")
+	logSessions := flag.Bool("log-sessions", true, "Log each session's lifecycle (new, closed, migrated...); if false, log aggregate session counts every minute instead")
+	hashClients := flag.Bool("hash-clients", false, "Replace client addresses in logs with a salted hash")
+	clientHashSalt := flag.String("client-hash-salt", "", "Salt used when hashing client addresses (see -hash-clients)")
+	stickyPorts := flag.Bool("sticky-ports", false, "Derive each session's source port from the client address within -server-port-range, so a returning client keeps its port across restarts")
+	fwmark := flag.Int("fwmark", 0, "Set this firewall mark (SO_MARK) on server-facing sockets for policy routing, e.g. to egress a specific WAN (Linux only, needs CAP_NET_ADMIN)")
+	replyPort := flag.Int("reply-port", 0, "Send responses to clients from this local port instead of the listen port, for firewalls that translate ports (requires a single -ports entry)")
+	freebind := flag.Bool("freebind", false, "Set IP_FREEBIND on listening sockets so they can bind an address not yet assigned to this host, e.g. a floating VIP (Linux only)")
+	listenSockopt := flag.String("listen-sockopt", "", "Socket options to set on listening sockets before they bind, as comma-separated NAME=VALUE pairs (e.g., SO_RCVBUF=8388608,IP_TOS=0x10; Linux only)")
+	serverSockopt := flag.String("server-sockopt", "", "Socket options to set on server-facing sockets, as comma-separated NAME=VALUE pairs (e.g., IP_TOS=0x10,SO_MARK=2; Linux only)")
+	transparent := flag.Bool("transparent", false, "Forward to the server from each client's own IP and port (IP_TRANSPARENT) instead of SNAT, so the server sees real client addresses; needs return routing through the relay (Linux only, needs CAP_NET_ADMIN)")
+	serverPortRange := flag.String("server-port-range", "", "Bind server-facing connections to a source port in this range (e.g., 40000-40999)")
+	relayLinkKey := flag.String("relay-link-key", "", "Hex-encoded key (16 bytes or more) authenticating packets on the hop to or from another chained relay; both relays need it (disabled if empty)")
+	duplicateTargets := flag.String("duplicate-targets", "", "ADVANCED: Comma-separated host:port list of extra paths to the WireGuard server; every client packet is also sent to each, multiplying upstream bandwidth, and the first copy of each response is forwarded (disabled if empty)")
+	mirrorTarget := flag.String("mirror-target", "", "Also send a copy of every client packet to this host:port, discarding its responses, e.g. to test a new server before cutover (disabled if empty)")
+	relayLinkSide := flag.String("relay-link-side", "server", "Which hop -relay-link-key covers: server, when the target is another relay, or client, when the clients are another relay")
+	obfuscate := flag.String("obfuscate", "", "Transform payloads between relay and server, e.g. xor:<hexkey>; the server side must apply the inverse (disabled if empty)")
+	reapDeadClients := flag.Int("reap-dead-clients", 0, "Close a session in the cleanup sweep once this many writes in a row to its client have failed, e.g. with no route or ARP entry left (0 disables)")
+	dnsFailureThreshold := flag.Int("dns-failure-threshold", 3, "Consecutive DNS failures before the relay reports not ready, still using the last known IP (0 disables)")
+	firstRetries := flag.Int("first-packet-retries", 0, "Resend a new session's first packet up to this many times while the server has not answered (0 disables)")
+	firstRetryDelay := flag.Duration("first-packet-retry-delay", 200*time.Millisecond, "Wait before each -first-packet-retries resend")
+	clientQueue := flag.Int("client-queue", 0, "Queue up to this many responses per session for a dedicated writer, dropping overflow (0 writes inline)")
+	writeTimeout := flag.Duration("write-timeout", 0, "Deadline for each forwarding write; timed out packets are dropped and counted (0 disables)")
+	wgAware := flag.Bool("wg-aware", false, "Expire sessions after two missed WireGuard keepalives once a client's keepalive interval is observed")
+	dropEmpty := flag.Bool("drop-empty", false, "Drop zero-length datagrams from clients without creating or refreshing a session")
+	packetHistogram := flag.Bool("packet-histogram", false, "Count forwarded packets by size in each direction, shown in /stats, for MTU planning")
+	requireHandshake := flag.Bool("require-handshake-first", false, "Only open a session for a packet that is a WireGuard handshake initiation; drop anything else from unknown clients")
+	inlineForward := flag.Bool("inline-forward", false, "Forward packets for existing sessions directly from the read loop without copying")
+	maxPPS := flag.Int("max-pps-per-session", 0, "Client -> server packets per second allowed per session; more are dropped and counted (0 = unlimited)")
+	maxPPSServer := flag.Int("max-pps-per-session-server", 0, "Server -> client packets per second allowed per session; more are dropped and counted (0 = unlimited)")
+	xdpRate := flag.Int("xdp-rate", 0, "UDP packets per second allowed to each listen port, all clients together; an XDP program on -xdp-iface drops the rest before the network stack, or the relay drops them after reading if XDP is unavailable (0 = unlimited)")
+	xdpIface := flag.String("xdp-iface", "", "Network interface clients reach the relay through, for -xdp-rate (e.g., eth0)")
+	priorityCIDR := flag.String("priority-cidr", "", "Comma-separated cidr=class pairs giving clients a priority class, low, normal or high, for overload: low-priority clients are refused, dropped and evicted first (e.g., 10.0.0.0/24=high,0.0.0.0/0=low)")
+	maxPerIP := flag.Int("max-sessions-per-ip", 0, "Maximum concurrent sessions per client IP across all listen ports; more are refused (0 = unlimited)")
+	newSessionRate := flag.Float64("new-session-rate", 0, "Maximum new sessions per second per listen port (0 = unlimited)")
+	newSessionBurst := flag.Int("new-session-burst", 0, "Burst allowance for -new-session-rate (default: one second's worth)")
+	slowSetup := flag.Duration("slow-setup-threshold", 0, "Log new sessions whose first packet takes longer than this to forward (0 disables)")
+	jitter := flag.Float64("jitter", 0.1, "Random jitter added to DNS check and cleanup intervals, as a fraction of the interval (0 disables)")
+	jitterSeed := flag.Int64("jitter-seed", 0, "Seed for interval jitter (0 seeds from the clock; relays use seed+index)")
+	captureClient := flag.String("capture-client", "", "Capture one client's packets (ip or ip:port) to a pcap file")
+	captureFile := flag.String("capture-file", "capture.pcap", "Output file for -capture-client")
+	captureDir := flag.String("capture-dir", "", "Directory for captures started with the admin server's /capture/start, which are refused if unset")
+	adminAddr := flag.String("admin-addr", "", "Address for the admin/expvar HTTP server (e.g., 127.0.0.1:8080 or unix:/run/wg-udp-relay.sock, disabled if empty)")
+	loopWindow := flag.Duration("loop-detect-window", 0, "Warn when the same packet is forwarded to the server repeatedly within this window, a sign of a forwarding loop (0 disables)")
+	loopSample := flag.Float64("loop-detect-sample", 0.1, "Fraction of packets -loop-detect-window tracks, trading detection speed for CPU")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Export each session as an OpenTelemetry span to this OTLP/HTTP collector (e.g. http://collector:4318; disabled if empty)")
+	geoipDB := flag.String("geoip-db", "", "Comma-separated MaxMind GeoLite2 .mmdb files used to add client country/ASN to new session logs")
+	adminSocketMode := flag.String("admin-socket-mode", "0600", "Permissions of the admin Unix socket (octal)")
+	forwardMode := flag.String("mode", "conn", "Forwarding mode: 'conn' (UDP sockets) or 'raw' (experimental, Linux only: one raw socket with software SNAT, needs CAP_NET_RAW and -server-port-range)")
+	responseReader := flag.String("response-reader", "goroutine", "How server responses are read: 'goroutine' (one per session) or 'epoll' (Linux only: one loop per listen port, serving sessions round-robin)")
+	serverConnMode := flag.String("server-conn-mode", "session", "Server connection model: 'session' (one per client) or 'port' (one shared per listen port, WireGuard only)")
+	upstreamSocks := flag.String("upstream-socks", "", "Reach the target through a SOCKS5 proxy's UDP ASSOCIATE ([user:pass@]host:port)")
+	sessionStateFile := flag.String("session-state-file", "", "Persist sessions to this file on shutdown and restore their source ports on startup")
+	printConfigFlag := flag.Bool("print-config", false, "Print every setting's effective value and its source (flag, env or default) and exit")
+	showVersion := flag.Bool("version", false, "Print version and build information and exit")
+	selftest := flag.Bool("selftest", false, "Push a packet through the relay over loopback, report success or failure, and exit")
+	testServer := flag.String("test-server", "", "Run only a WireGuard-like test responder on this address (e.g. :51820) instead of relays, for checking a relay end to end; not a WireGuard server")
+	loadgen := flag.String("loadgen", "", "Run only a load generator against the relay at this address, whose target must echo packets (e.g. -test-server), print a summary and exit")
+	loadgenClients := flag.Int("loadgen-clients", 100, "Synthetic clients for -loadgen, each with its own source port")
+	loadgenRate := flag.Float64("loadgen-rate", 50, "Packets per second each -loadgen client sends")
+	loadgenSize := flag.Int("loadgen-size", 128, "Size of -loadgen packets in bytes")
+	loadgenDuration := flag.Duration("loadgen-duration", 10*time.Second, "How long -loadgen clients send for")
+
+	annotateEnvUsage(flag.CommandLine)
 	flag.Parse()
 
-	// Check for environment variables if flags not provided
-	if *listenPorts == "" {
-		*listenPorts = os.Getenv("LISTEN_PORTS")
-	}
-	if *targetAddr == "" {
-		*targetAddr = os.Getenv("TARGET_ENDPOINT")
-	}
-	if envInterval := os.Getenv("DNS_CHECK_INTERVAL"); envInterval != "" && *dnsCheckInterval == 5*time.Minute {
-		if parsed, err := time.ParseDuration(envInterval); err == nil {
-			*dnsCheckInterval = parsed
-		} else {
-			log.Printf("Warning: Invalid DNS_CHECK_INTERVAL '%s', using default 5m", envInterval)
-		}
+	if *showVersion {
+		fmt.Println(relay.Version())
+		return
 	}
 
-	if *targetAddr == "" {
-		log.Fatal("Error: -target flag or TARGET_ENDPOINT environment variable is required")
-	}
-
-	if *listenPorts == "" {
-		log.Fatal("Error: -ports flag or LISTEN_PORTS environment variable is required")
-	}
-
-	// Parse listen ports
-	ports := strings.Split(*listenPorts, ",")
-	if len(ports) == 0 {
-		log.Fatal("Error: At least one listen port must be specified")
+	// The test responder is a separate mode and ignores every relay setting
+	if *testServer != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := relay.RunTestServer(ctx, *testServer); err != nil {
+			log.Fatalf("Error: Test server: %v", err)
+		}
+		return
 	}
 
-	// Start a relay for each port
-	var wg sync.WaitGroup
-	for _, port := range ports {
-		port = strings.TrimSpace(port)
-		listenAddr := fmt.Sprintf(":%s", port)
-		
-		relay := &Relay{
-			listenAddr:       listenAddr,
-			targetAddr:       *targetAddr,
-			timeout:          *timeout,
-			bufferSize:       *bufferSize,
-			dnsCheckInterval: *dnsCheckInterval,
-			sessions:         make(map[string]*ClientSession),
+	// So is the load generator, which drives an already running relay
+	if *loadgen != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err := relay.RunLoadgen(ctx, relay.LoadgenConfig{
+			Relay:    *loadgen,
+			Clients:  *loadgenClients,
+			Rate:     *loadgenRate,
+			Size:     *loadgenSize,
+			Duration: *loadgenDuration,
+		})
+		if err != nil {
+			log.Fatalf("Error: Load test: %v", err)
 		}
-
-		wg.Add(1)
-		go func(r *Relay) {
-			defer wg.Done()
-			if err := r.Start(); err != nil {
-				log.Printf("Failed to start relay on %s: %v", r.listenAddr, err)
-			}
-		}(relay)
+		return
 	}
 
-	// Wait for all relays
-	wg.Wait()
-}
-
-// Start begins the relay server
-func (r *Relay) Start() error {
-	// Resolve target address
-	targetAddr, err := net.ResolveUDPAddr("udp", r.targetAddr)
+	// Fill in flags not given on the command line from the environment
+	fromEnv, err := applyEnv(flag.CommandLine)
 	if err != nil {
-		return err
+		log.Fatalf("Error: %v", err)
 	}
-	r.targetConnMu.Lock()
-	r.targetConn = targetAddr
-	r.targetConnMu.Unlock()
 
-	// Create listening socket
-	listenAddr, err := net.ResolveUDPAddr("udp", r.listenAddr)
-	if err != nil {
-		return err
+	// Fill in settings derived from others, so -print-config shows them
+	if *clientIdle <= 0 {
+		*clientIdle = *timeout
 	}
-	
-	listenConn, err := net.ListenUDP("udp", listenAddr)
-	if err != nil {
-		return err
+	if *serverIdle <= 0 {
+		*serverIdle = *timeout
 	}
-	defer listenConn.Close()
-	
-	r.listenConn = listenConn
-	r.listenPort = listenAddr.Port
-
-	log.Printf("UDP relay started: %s -> %s (%s)", r.listenAddr, r.targetAddr, targetAddr.IP.String())
-	log.Printf("Settings: timeout=%s, buffer=%d bytes, DNS check interval=%s", r.timeout, r.bufferSize, r.dnsCheckInterval)
-
-	// Start DNS monitoring goroutine
-	go r.monitorDNS()
-
-	// Start session cleanup goroutine
-	go r.cleanupSessions()
-
-	// Main packet handling loop
-	buffer := make([]byte, r.bufferSize)
-	for {
-		n, clientAddr, err := listenConn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("Error reading from client: %v", err)
-			continue
-		}
-
-		// Make a copy of the packet data for the goroutine
-		dataCopy := make([]byte, n)
-		copy(dataCopy, buffer[:n])
-
-		// Handle packet in goroutine for concurrency
-		go r.handleClientPacket(dataCopy, clientAddr)
+	if *newSessionBurst <= 0 {
+		*newSessionBurst = int(*newSessionRate)
+	}
+	if *jitterSeed == 0 {
+		*jitterSeed = time.Now().UnixNano()
 	}
-}
-
-// handleClientPacket processes a packet from a client with SNAT
-func (r *Relay) handleClientPacket(data []byte, clientAddr *net.UDPAddr) {
-	clientKey := clientAddr.String()
-
-	// Get or create session
-	r.sessionsMu.Lock()
-	session, exists := r.sessions[clientKey]
-	if !exists {
-		// Get current target address
-		r.targetConnMu.RLock()
-		targetConn := r.targetConn
-		r.targetConnMu.RUnlock()
-
-		// Create connection TO server (gets ephemeral source port)
-		toServerConn, err := net.DialUDP("udp", nil, targetConn)
-		if err != nil {
-			log.Printf("Error creating server connection for %s: %v", clientKey, err)
-			r.sessionsMu.Unlock()
-			return
-		}
 
-		session = &ClientSession{
-			clientAddr:   clientAddr,
-			toServerConn: toServerConn,
-			lastActive:   time.Now(),
+	// Decode the values relay.Config takes in a form other than the flag's
+	bufferAuto := strings.TrimSpace(*bufferFlag) == "auto"
+	var bufferSize int
+	if !bufferAuto {
+		bufferSize, err = strconv.Atoi(strings.TrimSpace(*bufferFlag))
+		if err != nil || bufferSize <= 0 {
+			log.Fatalf("Error: Invalid -buffer: %q is not a size in bytes or auto", *bufferFlag)
 		}
-		r.sessions[clientKey] = session
-
-		log.Printf("[%s] New session: %s -> ephemeral:%d -> %s", 
-			r.listenAddr, clientKey, toServerConn.LocalAddr().(*net.UDPAddr).Port, targetConn.String())
-
-		// Start goroutine to handle responses from target
-		go r.handleTargetResponses(session, clientKey)
 	}
-	r.sessionsMu.Unlock()
-
-	// Update last active time
-	session.mu.Lock()
-	session.lastActive = time.Now()
-	session.mu.Unlock()
-
-	// SNAT: Forward packet to server through ephemeral port connection
-	// Server sees: (relay_ip, ephemeral_port) -> (server_ip, server_port)
-	_, err := session.toServerConn.Write(data)
+	probe, err := hex.DecodeString(strings.TrimSpace(*probePayload))
 	if err != nil {
-		log.Printf("Error forwarding to target for %s: %v", clientKey, err)
+		log.Fatalf("Error: -probe-payload must be hex-encoded: %v", err)
 	}
-}
-
-// handleTargetResponses reads responses from target and sends back to client with reverse SNAT
-func (r *Relay) handleTargetResponses(session *ClientSession, clientKey string) {
-	buffer := make([]byte, r.bufferSize)
-
-	for {
-		session.toServerConn.SetReadDeadline(time.Now().Add(r.timeout))
-		n, err := session.toServerConn.Read(buffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("Session timeout: %s", clientKey)
-			} else {
-				log.Printf("Error reading from target for %s: %v", clientKey, err)
-			}
-			r.closeSession(clientKey)
-			return
-		}
-
-		// Update last active time
-		session.mu.Lock()
-		session.lastActive = time.Now()
-		session.mu.Unlock()
-
-		// Reverse SNAT: Send back to client from our listen port using main listener
-		// Client sees: (relay_ip, listen_port) -> (client_ip, client_port)
-		_, err = r.listenConn.WriteToUDP(buffer[:n], session.clientAddr)
-		if err != nil {
-			log.Printf("Error sending to client %s: %v", clientKey, err)
+	var linkKey []byte
+	if *relayLinkKey != "" {
+		linkKey, err = hex.DecodeString(*relayLinkKey)
+		if err != nil || len(linkKey) < 16 {
+			log.Fatal("Error: -relay-link-key must be at least 16 hex-encoded bytes")
 		}
 	}
-}
-
-// closeSession closes and removes a client session
-func (r *Relay) closeSession(clientKey string) {
-	r.sessionsMu.Lock()
-	defer r.sessionsMu.Unlock()
-
-	if session, exists := r.sessions[clientKey]; exists {
-		session.toServerConn.Close()
-		delete(r.sessions, clientKey)
-		log.Printf("Closed session: %s", clientKey)
+	socketMode, err := strconv.ParseUint(*adminSocketMode, 8, 32)
+	if err != nil || socketMode > 0o777 {
+		log.Fatalf("Error: Invalid -admin-socket-mode %q (expected octal permissions such as 0660)", *adminSocketMode)
 	}
-}
 
-// cleanupSessions periodically removes expired sessions
-func (r *Relay) cleanupSessions() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		now := time.Now()
-		r.sessionsMu.Lock()
-		for key, session := range r.sessions {
-			session.mu.Lock()
-			if now.Sub(session.lastActive) > r.timeout {
-				session.toServerConn.Close()
-				delete(r.sessions, key)
-				log.Printf("Cleaned up expired session: %s", key)
-			}
-			session.mu.Unlock()
-		}
-		r.sessionsMu.Unlock()
+	cfg := relay.Config{
+		Relay: relay.RelayConfig{
+			Target:                *targetAddr,
+			TargetPort:            *targetPort,
+			TargetAllowCIDR:       *targetAllowCIDR,
+			Timeout:               *timeout,
+			HardTimeout:           *hardTimeout,
+			SessionHibernate:      *hibernate,
+			ProbeBeforeClose:      *probeBeforeClose,
+			ProbePayload:          probe,
+			ClientIdle:            *clientIdle,
+			ServerIdle:            *serverIdle,
+			CleanupInterval:       *cleanupInterval,
+			SummaryInterval:       *summaryInterval,
+			ReadErrorBackoff:      *readErrorBackoff,
+			ListenWake:            *listenWake,
+			DNSCheckInterval:      *dnsCheckInterval,
+			DNSVerbose:            *dnsVerbose,
+			DNSFailureThreshold:   *dnsFailureThreshold,
+			BufferSize:            bufferSize,
+			BufferAuto:            bufferAuto,
+			ResponseBuffer:        *responseBuffer,
+			WriteTimeout:          *writeTimeout,
+			ClientQueue:           *clientQueue,
+			NewSessionRate:        *newSessionRate,
+			NewSessionBurst:       *newSessionBurst,
+			MaxSessionsPerIP:      *maxPerIP,
+			MaxPPS:                *maxPPS,
+			MaxPPSServer:          *maxPPSServer,
+			PriorityCIDR:          *priorityCIDR,
+			SlowSetupThreshold:    *slowSetup,
+			RequireHandshake:      *requireHandshake,
+			DropEmpty:             *dropEmpty,
+			InlineForward:         *inlineForward,
+			WGAware:               *wgAware,
+			PacketHistogram:       *packetHistogram,
+			FirstPacketRetries:    *firstRetries,
+			FirstPacketRetryDelay: *firstRetryDelay,
+			ReapDeadClients:       *reapDeadClients,
+			Mode:                  *forwardMode,
+			ResponseReader:        *responseReader,
+			ServerConnMode:        *serverConnMode,
+			ServerPortRange:       *serverPortRange,
+			StickyPorts:           *stickyPorts,
+			UpstreamSocks:         *upstreamSocks,
+			Fwmark:                *fwmark,
+			Transparent:           *transparent,
+			Freebind:              *freebind,
+			ListenSockopt:         *listenSockopt,
+			ServerSockopt:         *serverSockopt,
+			ReplyPort:             *replyPort,
+			RelayLinkKey:          linkKey,
+			RelayLinkSide:         *relayLinkSide,
+			Obfuscate:             *obfuscate,
+			MirrorTarget:          *mirrorTarget,
+			DuplicateTargets:      splitList(*duplicateTargets),
+			Jitter:                *jitter,
+			JitterSeed:            *jitterSeed,
+			HashClients:           *hashClients,
+			ClientHashSalt:        *clientHashSalt,
+			QuietSessions:         !*logSessions,
+			CrashOnPanic:          !*recoverPanics,
+		},
+		Listen:            splitList(*listenPorts),
+		ConfigDir:         *configDir,
+		TCPListen:         splitList(*tcpPorts),
+		PortBuffer:        *portBuffer,
+		PortRcvbuf:        *portRcvbuf,
+		StartStagger:      *startStagger,
+		XDPRate:           *xdpRate,
+		XDPIface:          *xdpIface,
+		AdminAddr:         *adminAddr,
+		AdminSocketMode:   os.FileMode(socketMode),
+		CaptureClient:     *captureClient,
+		CaptureFile:       *captureFile,
+		CaptureDir:        *captureDir,
+		GeoIPDB:           *geoipDB,
+		LoopDetectWindow:  *loopWindow,
+		LoopDetectSample:  *loopSample,
+		OTLPEndpoint:      *otlpEndpoint,
+		LeakCheckInterval: *leakCheckInterval,
+		SessionStateFile:  *sessionStateFile,
 	}
-}
 
-// monitorDNS periodically checks for DNS changes and updates target address
-func (r *Relay) monitorDNS() {
-	ticker := time.NewTicker(r.dnsCheckInterval)
-	defer ticker.Stop()
+	if *printConfigFlag {
+		printConfig(os.Stdout, flag.CommandLine, fromEnv)
+		return
+	}
+	log.Printf("Starting %s", relay.Version())
 
-	for range ticker.C {
-		// Resolve target address
-		newAddr, err := net.ResolveUDPAddr("udp", r.targetAddr)
-		if err != nil {
-			log.Printf("[%s] DNS resolution error for %s: %v", r.listenAddr, r.targetAddr, err)
-			continue
+	if *selftest {
+		if !relay.SelfTest(cfg.Relay) {
+			os.Exit(1)
 		}
+		return
+	}
 
-		// Check if IP has changed
-		r.targetConnMu.RLock()
-		currentAddr := r.targetConn
-		r.targetConnMu.RUnlock()
-
-		if !currentAddr.IP.Equal(newAddr.IP) || currentAddr.Port != newAddr.Port {
-			log.Printf("[%s] DNS change detected: %s -> %s", r.listenAddr, currentAddr.IP.String(), newAddr.IP.String())
-			
-			// Update target address
-			r.targetConnMu.Lock()
-			r.targetConn = newAddr
-			r.targetConnMu.Unlock()
+	if *listenPorts == "" && *configDir == "" {
+		log.Fatal("Error: -ports flag or LISTEN_PORTS environment variable is required")
+	}
+	if *listenPorts != "" && *targetAddr == "" {
+		log.Fatal("Error: -target flag or TARGET_ENDPOINT environment variable is required")
+	}
 
-			// Migrate all existing sessions to new target
-			r.migrateSessionsToNewTarget(newAddr)
-		}
+	// Cancel all relays on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := relay.Serve(ctx, cfg); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 }
 
-// migrateSessionsToNewTarget recreates all session connections to point to new target
-func (r *Relay) migrateSessionsToNewTarget(newTarget *net.UDPAddr) {
-	r.sessionsMu.Lock()
-	defer r.sessionsMu.Unlock()
-
-	log.Printf("[%s] Migrating %d sessions to new target %s", r.listenAddr, len(r.sessions), newTarget.IP.String())
-
-	for clientKey, session := range r.sessions {
-		session.mu.Lock()
-
-		// Close old server connection
-		oldConn := session.toServerConn
-		oldConn.Close()
-
-		// Create new connection to new target
-		newConn, err := net.DialUDP("udp", nil, newTarget)
-		if err != nil {
-			log.Printf("[%s] Failed to migrate session %s: %v", r.listenAddr, clientKey, err)
-			// Remove failed session
-			delete(r.sessions, clientKey)
-			session.mu.Unlock()
-			continue
-		}
-
-		// Update session with new connection
-		session.toServerConn = newConn
-		session.mu.Unlock()
-
-		log.Printf("[%s] Migrated session: %s", r.listenAddr, clientKey)
-		
-		// Restart response handler for new connection
-		go r.handleTargetResponses(session, clientKey)
+// splitList splits a comma-separated flag value, returning nil if it is empty
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
+	return strings.Split(s, ",")
 }
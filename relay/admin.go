@@ -0,0 +1,227 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// expvarHandler serves the standard expvar variables, as expvar.Handler
+// does, plus relays and goroutines for relays. Those two are not published
+// to the global registry, which panics on a name published twice, e.g. by a
+// second Serve or by a program embedding the relay; they take the place of
+// any global variables of the same name.
+func expvarHandler(relays []*Relay) http.HandlerFunc {
+	vars := new(expvar.Map)
+	vars.Set("relays", expvar.Func(func() any {
+		return relaysSnapshot(relays)
+	}))
+	vars.Set("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		sep := "{\n"
+		write := func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%s%q: %s", sep, kv.Key, kv.Value)
+			sep = ",\n"
+		}
+		vars.Do(write)
+		expvar.Do(func(kv expvar.KeyValue) {
+			if vars.Get(kv.Key) == nil {
+				write(kv)
+			}
+		})
+		fmt.Fprintf(w, "\n}\n")
+	}
+}
+
+// relaysSnapshot returns each relay's counters keyed by listen address,
+// labelled with the configured target so they can be grouped by server. The
+// target is the -target value as given, not its resolved IP, so the label
+// doesn't change with DNS.
+func relaysSnapshot(relays []*Relay) map[string]any {
+	out := make(map[string]any, len(relays))
+	for _, r := range relays {
+		out[r.listenAddr] = r.Stats()
+	}
+	return out
+}
+
+// runAdminServer serves the admin/observability endpoints on addr until ctx
+// is cancelled
+func runAdminServer(ctx context.Context, addr string, relays []*Relay, registry *sessionRegistry,
+	capture *packetCapture, fds *fdBudget, leaks *leakCheck, build buildInfo, socketMode os.FileMode) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvarHandler(relays))
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(effectiveConfigs(relays))
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registry.snapshot())
+	})
+	mux.HandleFunc("/sessions/ips", func(w http.ResponseWriter, req *http.Request) {
+		label := func(ip string) string { return ip }
+		if len(relays) > 0 {
+			label = relays[0].clientLabel
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registry.ipCounts(label))
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range relays {
+			if !r.isReady() {
+				http.Error(w, "not ready: "+r.listenAddr, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ready\n"))
+	})
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, req *http.Request) {
+		targets := make([]targetStatus, 0, len(relays))
+		for _, r := range relays {
+			targets = append(targets, r.targetStatus())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targets)
+	})
+	mux.HandleFunc("/targets/", func(w http.ResponseWriter, req *http.Request) {
+		// POST /targets/{addr}/drain or /targets/{addr}/undrain
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimPrefix(req.URL.Path, "/targets/")
+		slash := strings.LastIndex(path, "/")
+		if slash < 0 {
+			http.NotFound(w, req)
+			return
+		}
+		addr, action := path[:slash], path[slash+1:]
+		if action != "drain" && action != "undrain" {
+			http.NotFound(w, req)
+			return
+		}
+		matched := false
+		for _, r := range relays {
+			if r.matchesTarget(addr) {
+				r.setDrained(action == "drain")
+				matched = true
+			}
+		}
+		if !matched {
+			http.Error(w, "no relay targets "+addr, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for path, paused := range map[string]bool{"/pause": true, "/resume": false} {
+		paused := paused
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			for _, r := range relays {
+				r.setPaused(paused)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		stats := map[string]any{
+			"build":    build,
+			"open_fds": fds.estimate(),
+			"fd_limit": fds.limit,
+			"relays":   relaysSnapshot(relays),
+		}
+		if leaks != nil {
+			stats["leak_check"] = leaks.snapshot()
+		}
+		json.NewEncoder(w).Encode(stats)
+	})
+	mux.HandleFunc("/capture/start", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		client := req.URL.Query().Get("client")
+		file := req.URL.Query().Get("file")
+		if client == "" || file == "" {
+			http.Error(w, "client and file parameters are required", http.StatusBadRequest)
+			return
+		}
+		if err := capture.startIn(client, file); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/capture/stop", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := capture.stop(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	listener, err := listenAdmin(addr, socketMode)
+	if err != nil {
+		log.Printf("Admin server error: %v", err)
+		return
+	}
+	log.Printf("Admin server listening on %s", addr)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Admin server error: %v", err)
+	}
+}
+
+// listenAdmin listens on a TCP host:port, or on a Unix domain socket given as
+// unix:/path with its permissions set to mode. A stale socket file left by a
+// previous run is replaced.
+func listenAdmin(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,38 @@
+package relay
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestExpvarHandlerTwice builds the /debug/vars handler of two admin servers
+// in a process that already publishes one of its names, as a program
+// embedding the relay might
+func TestExpvarHandlerTwice(t *testing.T) {
+	if expvar.Get("goroutines") == nil {
+		expvar.Publish("goroutines", expvar.Func(func() any { return "host" }))
+	}
+	r := runRelay(t, RelayConfig{Target: echoServer(t, nil).String()})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		expvarHandler([]*Relay{r}).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+		var vars map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("invalid JSON: %v\n%s", err, rec.Body)
+		}
+		var relays map[string]map[string]any
+		if err := json.Unmarshal(vars["relays"], &relays); err != nil || relays[r.listenAddr] == nil {
+			t.Errorf("relays %s missing %s: %v", vars["relays"], r.listenAddr, err)
+		}
+		var goroutines int
+		if err := json.Unmarshal(vars["goroutines"], &goroutines); err != nil || goroutines == 0 {
+			t.Errorf("goroutines %s, want this process's count", vars["goroutines"])
+		}
+		if vars["memstats"] == nil {
+			t.Error("standard variable memstats missing")
+		}
+	}
+}
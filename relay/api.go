@@ -0,0 +1,460 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// RelayConfig configures a relay created with NewRelay. Each field matches
+// the command line flag named in its comment; zero values select the
+// defaults or disable the setting, as documented on each field. Serve runs
+// several relays together with the features they share.
+type RelayConfig struct {
+	Listen                string        // Port or host:port to listen on, as in -ports
+	Target                string        // WireGuard server host:port (or host:port1,port2 to fail over), as in -target
+	TargetPort            int           // Overrides the port of every resolved target address (0 = keep)
+	TargetAllowCIDR       string        // Comma-separated CIDRs the target must resolve into, as in -target-allow-cidr (empty allows any)
+	Timeout               time.Duration // Session idle timeout (default 3m)
+	HardTimeout           time.Duration // Keep sessions idle past Timeout, marked idle, until this timeout (0 = close at Timeout)
+	SessionHibernate      time.Duration // Keep an expired session's source port this long for the returning client (0 = not at all)
+	ProbeBeforeClose      time.Duration // Probe the server before closing an idle session and wait this long for an answer (0 = no probe)
+	ProbePayload          []byte        // Payload of the ProbeBeforeClose probe (default an empty datagram)
+	ClientIdle            time.Duration // Idle timeout for client -> server traffic (default Timeout)
+	ServerIdle            time.Duration // Idle timeout for server -> client traffic (default Timeout)
+	CleanupInterval       time.Duration // How often expired sessions are swept (default from the idle timeouts)
+	SummaryInterval       time.Duration // Log packet and bit rates at this interval (0 = never)
+	ReadErrorBackoff      time.Duration // Longest pause between failing listen socket reads (default 1s)
+	ListenWake            time.Duration // Wake the listen read loop after this long without packets (0 = never)
+	DNSCheckInterval      time.Duration // How often Target is re-resolved (default 5m)
+	DNSVerbose            bool          // Log every DNS re-check of Target
+	DNSFailureThreshold   int           // Consecutive DNS failures before the relay reports not ready (0 = never)
+	BufferSize            int           // Read buffer size in bytes (default 1500)
+	BufferAuto            bool          // Start with small read buffers and grow them on truncated packets, ignoring BufferSize
+	ResponseBuffer        int           // Read buffer size for server responses (0 = BufferSize)
+	ReceiveBuffer         int           // SO_RCVBUF of the listening socket, set before it binds (0 = system default)
+	WriteTimeout          time.Duration // Deadline for each forwarding write (0 = none)
+	ClientQueue           int           // Responses queued per session for a dedicated writer (0 = write inline)
+	NewSessionRate        float64       // Maximum new sessions per second (0 = unlimited)
+	NewSessionBurst       int           // Burst allowance for NewSessionRate (default one second's worth)
+	MaxSessionsPerIP      int           // Concurrent sessions allowed per client IP (0 = unlimited)
+	MaxPPS                int           // Client -> server packets per second per session (0 = unlimited)
+	MaxPPSServer          int           // Server -> client packets per second per session (0 = unlimited)
+	PriorityCIDR          string        // Client priority classes as cidr=class pairs, as in -priority-cidr
+	SlowSetupThreshold    time.Duration // Log new sessions slower than this to forward their first packet (0 = never)
+	RequireHandshake      bool          // Only a WireGuard handshake initiation may open a session
+	DropEmpty             bool          // Drop zero-length datagrams from clients
+	InlineForward         bool          // Forward packets of existing sessions from the read loop without copying
+	WGAware               bool          // Expire sessions after two missed WireGuard keepalives
+	PacketHistogram       bool          // Count forwarded packets by size
+	FirstPacketRetries    int           // Resends of a new session's first packet while the server is silent (0 = none)
+	FirstPacketRetryDelay time.Duration // Wait before each FirstPacketRetries resend (default 200ms)
+	ReapDeadClients       int           // Close a session after this many failed writes in a row to its client (0 = never)
+	Mode                  string        // Forwarding mode, conn or raw, as in -mode (default conn)
+	ResponseReader        string        // How server responses are read, goroutine or epoll, as in -response-reader (default goroutine)
+	ServerConnMode        string        // Server connection model, session or port, as in -server-conn-mode (default session)
+	ServerPortRange       string        // Source ports for server connections, as in -server-port-range (empty lets the system choose)
+	StickyPorts           bool          // Derive each session's source port from the client address within ServerPortRange
+	UpstreamSocks         string        // Reach the target through this SOCKS5 proxy, as in -upstream-socks
+	Fwmark                int           // SO_MARK set on server-facing sockets (0 = none, Linux only)
+	Transparent           bool          // Forward from each client's own address with IP_TRANSPARENT (Linux only)
+	Freebind              bool          // Set IP_FREEBIND on the listening socket (Linux only, ignored elsewhere)
+	ListenSockopt         string        // Socket options for the listening socket as NAME=VALUE pairs, as in -listen-sockopt (Linux only)
+	ServerSockopt         string        // Socket options for server-facing sockets, as in -server-sockopt (Linux only)
+	ReplyPort             int           // Send responses to clients from this port (0 = the listen port)
+	RelayLinkKey          []byte        // Key authenticating the hop to another chained relay, 16 bytes or more (nil = none)
+	RelayLinkSide         string        // Hop RelayLinkKey covers, server or client, as in -relay-link-side (default server)
+	Obfuscate             string        // Payload transform between relay and server, as in -obfuscate (empty = none)
+	MirrorTarget          string        // Also send every client packet to this host:port (empty = none)
+	DuplicateTargets      []string      // Extra host:port paths to the server every client packet is sent over
+	Jitter                float64       // Random jitter of DNS check and cleanup intervals, as a fraction (0 = none)
+	JitterSeed            int64         // Seed for Jitter (0 seeds from the clock)
+	HashClients           bool          // Log HMAC-SHA256 hashes instead of client addresses
+	ClientHashSalt        string        // Key for HashClients; without one, hashes are comparable across deployments
+	QuietSessions         bool          // Don't log each session's lifecycle
+	CrashOnPanic          bool          // Let a panic in a packet or session goroutine crash the process instead of closing the session
+}
+
+// NewRelay validates cfg and returns a relay ready to Run
+func NewRelay(cfg RelayConfig) (*Relay, error) {
+	listen, err := parseListenAddr(cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Listen: %v", err)
+	}
+	if cfg.Target == "" {
+		return nil, errors.New("Target is required")
+	}
+	if cfg.TargetPort < 0 || cfg.TargetPort > 65535 {
+		return nil, fmt.Errorf("invalid TargetPort %d", cfg.TargetPort)
+	}
+	if cfg.ReplyPort < 0 || cfg.ReplyPort > 65535 {
+		return nil, fmt.Errorf("invalid ReplyPort %d", cfg.ReplyPort)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = forwardModeConn
+	}
+	if cfg.ResponseReader == "" {
+		cfg.ResponseReader = responseReaderGoroutine
+	}
+	if cfg.ServerConnMode == "" {
+		cfg.ServerConnMode = serverConnPerSession
+	}
+	targetPorts, err := parseTargetPorts(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	if targetPorts != nil && (cfg.TargetPort != 0 || cfg.ServerConnMode != serverConnPerSession || cfg.Mode != forwardModeConn) {
+		return nil, fmt.Errorf("Target %s lists several ports, which fail over as each refuses packets; this cannot be combined with TargetPort, ServerConnMode port or Mode raw", cfg.Target)
+	}
+	targetAllow, err := parseCIDRList(cfg.TargetAllowCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TargetAllowCIDR: %v", err)
+	}
+	priorities, err := parsePriorityCIDRs(cfg.PriorityCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PriorityCIDR: %v", err)
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 3 * time.Minute
+	}
+	if cfg.ClientIdle == 0 {
+		cfg.ClientIdle = cfg.Timeout
+	}
+	if cfg.ServerIdle == 0 {
+		cfg.ServerIdle = cfg.Timeout
+	}
+	if cfg.DNSCheckInterval == 0 {
+		cfg.DNSCheckInterval = 5 * time.Minute
+	}
+	if cfg.FirstPacketRetryDelay == 0 {
+		cfg.FirstPacketRetryDelay = 200 * time.Millisecond
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"Timeout", cfg.Timeout}, {"HardTimeout", cfg.HardTimeout}, {"SessionHibernate", cfg.SessionHibernate},
+		{"ProbeBeforeClose", cfg.ProbeBeforeClose}, {"ClientIdle", cfg.ClientIdle}, {"ServerIdle", cfg.ServerIdle},
+		{"CleanupInterval", cfg.CleanupInterval}, {"SummaryInterval", cfg.SummaryInterval},
+		{"ReadErrorBackoff", cfg.ReadErrorBackoff}, {"ListenWake", cfg.ListenWake},
+		{"DNSCheckInterval", cfg.DNSCheckInterval}, {"WriteTimeout", cfg.WriteTimeout},
+		{"SlowSetupThreshold", cfg.SlowSetupThreshold}, {"FirstPacketRetryDelay", cfg.FirstPacketRetryDelay},
+	} {
+		if d.value < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %s", d.name, d.value)
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"DNSFailureThreshold", cfg.DNSFailureThreshold}, {"ClientQueue", cfg.ClientQueue},
+		{"MaxSessionsPerIP", cfg.MaxSessionsPerIP}, {"MaxPPS", cfg.MaxPPS}, {"MaxPPSServer", cfg.MaxPPSServer},
+		{"FirstPacketRetries", cfg.FirstPacketRetries}, {"ReapDeadClients", cfg.ReapDeadClients},
+		{"ReceiveBuffer", cfg.ReceiveBuffer},
+	} {
+		if n.value < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %d", n.name, n.value)
+		}
+	}
+	if cfg.NewSessionRate < 0 {
+		return nil, fmt.Errorf("NewSessionRate must not be negative, got %g", cfg.NewSessionRate)
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return nil, fmt.Errorf("Jitter must be between 0 and 1, got %g", cfg.Jitter)
+	}
+
+	// Sessions idle past Timeout are kept, marked idle, until HardTimeout
+	var idleGrace time.Duration
+	if cfg.HardTimeout > 0 {
+		if cfg.HardTimeout < cfg.Timeout {
+			return nil, fmt.Errorf("HardTimeout %s must not be shorter than Timeout %s", cfg.HardTimeout, cfg.Timeout)
+		}
+		idleGrace = cfg.HardTimeout - cfg.Timeout
+	}
+
+	if cfg.BufferAuto {
+		cfg.BufferSize = autoBufferInitial
+	} else if cfg.BufferSize == 0 {
+		cfg.BufferSize = 1500
+	}
+	if cfg.BufferSize < 1 || cfg.BufferSize > maxBufferSize {
+		return nil, fmt.Errorf("BufferSize must be between 1 and %d, got %d", maxBufferSize, cfg.BufferSize)
+	}
+	if cfg.ResponseBuffer < 0 || cfg.ResponseBuffer > maxBufferSize {
+		return nil, fmt.Errorf("ResponseBuffer must be between 1 and %d, or 0 to use BufferSize, got %d", maxBufferSize, cfg.ResponseBuffer)
+	}
+
+	var serverPortMin, serverPortMax int
+	if cfg.ServerPortRange != "" {
+		serverPortMin, serverPortMax, err = parsePortRange(cfg.ServerPortRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerPortRange: %v", err)
+		}
+	}
+
+	if cfg.Fwmark != 0 {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("Fwmark is only supported on Linux")
+		}
+		if cfg.Fwmark < 0 || uint64(cfg.Fwmark) > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid Fwmark %d", cfg.Fwmark)
+		}
+	}
+
+	listenSockopts, err := parseSockopts(cfg.ListenSockopt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ListenSockopt: %v", err)
+	}
+	serverSockopts, err := parseSockopts(cfg.ServerSockopt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ServerSockopt: %v", err)
+	}
+	if len(serverSockopts) > 0 && (cfg.Mode == forwardModeRaw || cfg.UpstreamSocks != "") {
+		return nil, errors.New("ServerSockopt applies to server connections of their own and cannot be combined with Mode raw or UpstreamSocks")
+	}
+
+	// IP_FREEBIND only exists on Linux; Serve warns that it is ignored
+	if runtime.GOOS != "linux" {
+		cfg.Freebind = false
+	}
+
+	if cfg.Transparent {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("Transparent is only supported on Linux")
+		}
+		if cfg.UpstreamSocks != "" || cfg.ServerConnMode != serverConnPerSession || cfg.Mode != forwardModeConn || serverPortMin != 0 {
+			return nil, errors.New("Transparent sends from client addresses and cannot be combined with UpstreamSocks, ServerConnMode port, Mode raw or ServerPortRange")
+		}
+		if err := checkTransparent(); err != nil {
+			return nil, fmt.Errorf("Transparent cannot be applied: %v", err)
+		}
+	}
+
+	if cfg.StickyPorts && (serverPortMin == 0 || cfg.UpstreamSocks != "" || cfg.ServerConnMode != serverConnPerSession) {
+		return nil, errors.New("StickyPorts requires ServerPortRange and cannot be combined with UpstreamSocks or ServerConnMode port")
+	}
+
+	if cfg.ServerConnMode != serverConnPerSession && cfg.ServerConnMode != serverConnPerPort {
+		return nil, fmt.Errorf("invalid ServerConnMode %q (expected %q or %q)", cfg.ServerConnMode, serverConnPerSession, serverConnPerPort)
+	}
+
+	switch cfg.Mode {
+	case forwardModeConn:
+	case forwardModeRaw:
+		if serverPortMin == 0 {
+			return nil, errors.New("Mode raw requires ServerPortRange to choose source ports from")
+		}
+		if cfg.UpstreamSocks != "" || cfg.ServerConnMode != serverConnPerSession || cfg.Obfuscate != "" {
+			return nil, errors.New("Mode raw cannot be combined with UpstreamSocks, ServerConnMode port or Obfuscate")
+		}
+	default:
+		return nil, fmt.Errorf("invalid Mode %q (expected %q or %q)", cfg.Mode, forwardModeConn, forwardModeRaw)
+	}
+
+	switch cfg.ResponseReader {
+	case responseReaderGoroutine:
+	case responseReaderEpoll:
+		if cfg.UpstreamSocks != "" || cfg.Obfuscate != "" || cfg.ServerConnMode != serverConnPerSession || cfg.Mode != forwardModeConn {
+			return nil, errors.New("ResponseReader epoll needs a plain socket per session and cannot be combined with UpstreamSocks, Obfuscate, ServerConnMode port or Mode raw")
+		}
+	default:
+		return nil, fmt.Errorf("invalid ResponseReader %q (expected %q or %q)", cfg.ResponseReader, responseReaderGoroutine, responseReaderEpoll)
+	}
+
+	var transform payloadTransform
+	if cfg.Obfuscate != "" {
+		if transform, err = parseTransform(cfg.Obfuscate); err != nil {
+			return nil, fmt.Errorf("invalid Obfuscate: %v", err)
+		}
+	}
+
+	var link *relayLink
+	if cfg.RelayLinkKey != nil {
+		if len(cfg.RelayLinkKey) < 16 {
+			return nil, errors.New("RelayLinkKey must be at least 16 bytes")
+		}
+		if cfg.RelayLinkSide == "" {
+			cfg.RelayLinkSide = relayLinkServer
+		}
+		switch cfg.RelayLinkSide {
+		case relayLinkServer:
+			if cfg.Mode != forwardModeConn || cfg.ResponseReader != responseReaderGoroutine || cfg.ServerConnMode != serverConnPerSession {
+				return nil, errors.New("RelayLinkSide server needs its own reads from each server socket and cannot be combined with Mode raw, ResponseReader epoll or ServerConnMode port")
+			}
+		case relayLinkClient:
+		default:
+			return nil, fmt.Errorf("invalid RelayLinkSide %q (expected %q or %q)", cfg.RelayLinkSide, relayLinkServer, relayLinkClient)
+		}
+		link = &relayLink{key: cfg.RelayLinkKey, side: cfg.RelayLinkSide}
+	}
+
+	var mirrorAddr *net.UDPAddr
+	if cfg.MirrorTarget != "" {
+		if mirrorAddr, err = net.ResolveUDPAddr("udp", cfg.MirrorTarget); err != nil {
+			return nil, fmt.Errorf("invalid MirrorTarget %q: %v", cfg.MirrorTarget, err)
+		}
+	}
+
+	var duplicateAddrs []*net.UDPAddr
+	if len(cfg.DuplicateTargets) > 0 {
+		if cfg.ServerConnMode != serverConnPerSession || cfg.Mode != forwardModeConn || cfg.Transparent {
+			return nil, errors.New("DuplicateTargets needs a server connection of its own per session and cannot be combined with ServerConnMode port, Mode raw or Transparent")
+		}
+		for _, target := range cfg.DuplicateTargets {
+			addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(target))
+			if err != nil {
+				return nil, fmt.Errorf("invalid DuplicateTargets entry %q: %v", target, err)
+			}
+			duplicateAddrs = append(duplicateAddrs, addr)
+		}
+	}
+
+	if cfg.SessionHibernate > 0 && (cfg.ServerConnMode != serverConnPerSession || cfg.Transparent) {
+		return nil, errors.New("SessionHibernate keeps per-session source ports and cannot be combined with ServerConnMode port or Transparent")
+	}
+
+	var sessionLimiter *tokenBucket
+	if cfg.NewSessionRate > 0 {
+		burst := cfg.NewSessionBurst
+		if burst <= 0 {
+			burst = int(cfg.NewSessionRate)
+		}
+		sessionLimiter = newTokenBucket(cfg.NewSessionRate, burst)
+	}
+	var toServerSizes, toClientSizes *sizeHistogram
+	if cfg.PacketHistogram {
+		toServerSizes, toClientSizes = new(sizeHistogram), new(sizeHistogram)
+	}
+	if cfg.JitterSeed == 0 {
+		cfg.JitterSeed = time.Now().UnixNano()
+	}
+
+	return &Relay{
+		listenAddr:       listen,
+		targetAddr:       cfg.Target,
+		targetPort:       cfg.TargetPort,
+		targetPorts:      targetPorts,
+		targetAllow:      targetAllow,
+		priorities:       priorities,
+		stats:            relayStats{toServerSizes: toServerSizes, toClientSizes: toClientSizes},
+		timeout:          cfg.Timeout,
+		clientIdle:       cfg.ClientIdle,
+		serverIdle:       cfg.ServerIdle,
+		idleGrace:        idleGrace,
+		hibernate:        cfg.SessionHibernate,
+		probeGrace:       cfg.ProbeBeforeClose,
+		readErrorBackoff: cfg.ReadErrorBackoff,
+		listenWake:       cfg.ListenWake,
+		probePayload:     cfg.ProbePayload,
+		cleanupInterval:  cfg.CleanupInterval,
+		summaryInterval:  cfg.SummaryInterval,
+		bufferSize:       cfg.BufferSize,
+		bufferAuto:       cfg.BufferAuto,
+		responseBuffer:   cfg.ResponseBuffer,
+		rcvbuf:           cfg.ReceiveBuffer,
+		dnsCheckInterval: cfg.DNSCheckInterval,
+		hashClients:      cfg.HashClients,
+		quietSessions:    cfg.QuietSessions,
+		clientHashSalt:   []byte(cfg.ClientHashSalt),
+		upstreamSocks:    cfg.UpstreamSocks,
+		serverConnMode:   cfg.ServerConnMode,
+		forwardMode:      cfg.Mode,
+		responseReader:   cfg.ResponseReader,
+		serverPortMin:    serverPortMin,
+		serverPortMax:    serverPortMax,
+		stickyPorts:      cfg.StickyPorts,
+		fwmark:           cfg.Fwmark,
+		transparent:      cfg.Transparent,
+		freebind:         cfg.Freebind,
+		listenSockopts:   listenSockopts,
+		serverSockopts:   serverSockopts,
+		replyPort:        cfg.ReplyPort,
+		inlineForward:    cfg.InlineForward,
+		dropEmpty:        cfg.DropEmpty,
+		requireHandshake: cfg.RequireHandshake,
+		recoverPanics:    !cfg.CrashOnPanic,
+		wgAware:          cfg.WGAware,
+		writeTimeout:     cfg.WriteTimeout,
+		clientQueue:      cfg.ClientQueue,
+		maxPerIP:         cfg.MaxSessionsPerIP,
+		maxPPS:           cfg.MaxPPS,
+		maxPPSServer:     cfg.MaxPPSServer,
+		dnsFailureLimit:  cfg.DNSFailureThreshold,
+		dnsVerbose:       cfg.DNSVerbose,
+		deadClientLimit:  cfg.ReapDeadClients,
+		firstRetries:     cfg.FirstPacketRetries,
+		firstRetryDelay:  cfg.FirstPacketRetryDelay,
+		transform:        transform,
+		link:             link,
+		mirrorAddr:       mirrorAddr,
+		duplicateAddrs:   duplicateAddrs,
+		sessionLimiter:   sessionLimiter,
+		slowSetup:        cfg.SlowSetupThreshold,
+		jitter:           cfg.Jitter,
+		capture:          &packetCapture{},
+		fds:              newFDBudget(),
+		registry:         newSessionRegistry(),
+		rng:              rand.New(rand.NewSource(cfg.JitterSeed)),
+		sessions:         make(map[string]*ClientSession),
+		recentlyClosed:   make(map[string]time.Time),
+		hibernated:       make(map[string]hibernation),
+		opening:          make(map[string]struct{}),
+		ready:            make(chan struct{}),
+	}, nil
+}
+
+// Run forwards traffic until ctx is cancelled or Stop is called, then closes
+// every session. It returns an error if the relay could not start. A relay
+// runs once; create a new one to run again.
+func (r *Relay) Run(ctx context.Context) error {
+	r.runMu.Lock()
+	if r.cancel != nil {
+		r.runMu.Unlock()
+		return errors.New("relay has already been run")
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.runMu.Unlock()
+
+	defer r.markReady()
+	return r.start(ctx)
+}
+
+// Stop makes Run return; it does nothing if the relay isn't running
+func (r *Relay) Stop() {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Ready is closed once Run has finished starting up, successfully or not
+func (r *Relay) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Stats returns the relay's counters keyed by metric name, as served for
+// each listen port at /stats
+func (r *Relay) Stats() map[string]any {
+	stats := r.stats.snapshot()
+	stats["sessions"] = uint64(r.sessionCount())
+	stats["target"] = r.targetAddr
+	stats["paused"] = r.paused.Load()
+	if r.xdp != nil {
+		stats["xdp_dropped"] = r.xdp.dropped(r.listenPort)
+	}
+	return stats
+}
+
+// Sessions returns the number of active sessions
+func (r *Relay) Sessions() int {
+	return r.sessionCount()
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNewRelayRejectsInvalidConfig(t *testing.T) {
+	valid := RelayConfig{Listen: "51820", Target: "127.0.0.1:51820"}
+	for _, tc := range []struct {
+		name   string
+		change func(*RelayConfig)
+		want   string
+	}{
+		{"negative threshold", func(c *RelayConfig) { c.DNSFailureThreshold = -1 }, "DNSFailureThreshold"},
+		{"negative timeout", func(c *RelayConfig) { c.HardTimeout = -1 }, "HardTimeout"},
+		{"short hard timeout", func(c *RelayConfig) { c.Timeout, c.HardTimeout = 2, 1 }, "HardTimeout"},
+		{"bad mode", func(c *RelayConfig) { c.Mode = "tap" }, "Mode"},
+		{"raw without ports", func(c *RelayConfig) { c.Mode = forwardModeRaw }, "ServerPortRange"},
+		{"short link key", func(c *RelayConfig) { c.RelayLinkKey = []byte("short") }, "RelayLinkKey"},
+		{"sticky without ports", func(c *RelayConfig) { c.StickyPorts = true }, "StickyPorts"},
+		{"bad priority", func(c *RelayConfig) { c.PriorityCIDR = "10.0.0.0/8=urgent" }, "PriorityCIDR"},
+		{"port list with port mode", func(c *RelayConfig) {
+			c.Target, c.ServerConnMode = "127.0.0.1:51820,51821", serverConnPerPort
+		}, "several ports"},
+	} {
+		cfg := valid
+		tc.change(&cfg)
+		if _, err := NewRelay(cfg); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v, want one mentioning %s", tc.name, err, tc.want)
+		}
+	}
+	if _, err := NewRelay(valid); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+}
+
+func TestServeRejectsInvalidConfig(t *testing.T) {
+	relayCfg := RelayConfig{Target: "127.0.0.1:51820"}
+	for _, cfg := range []Config{
+		{Relay: relayCfg},
+		{Relay: relayCfg, Listen: []string{"51820", "51820"}},
+		{Relay: relayCfg, Listen: []string{"51820"}, PortBuffer: "51821=9000"},
+		{Relay: RelayConfig{Target: relayCfg.Target, Jitter: 2}, Listen: []string{"51820"}},
+	} {
+		// Serve must fail before listening, or it would block until ctx ends
+		if err := Serve(context.Background(), cfg); err == nil {
+			t.Errorf("Serve(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcap file constants (LINKTYPE_RAW: packets start with an IPv4/IPv6 header)
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	pcapLinkRaw  = 101
+	ipProtoUDP   = 17
+	ipv4HdrLen   = 20
+	ipv6HdrLen   = 40
+	udpHdrLen    = 8
+	captureFlush = time.Second
+)
+
+// packetCapture writes the client-side legs of a single client's traffic to a
+// pcap file, wrapping each datagram in synthetic IP/UDP headers. One capture is
+// shared by all relays; it costs a single atomic load per packet when idle.
+type packetCapture struct {
+	active    atomic.Bool
+	mu        sync.Mutex
+	clientIP  net.IP
+	port      int    // 0 matches any source port of clientIP
+	dir       string // Directory for captures started from the admin server, "" disables them
+	path      string
+	file      *os.File
+	w         *bufio.Writer
+	lastFlush time.Time
+}
+
+// start begins capturing packets for client ("ip" or "ip:port") into path,
+// replacing any file there
+func (c *packetCapture) start(client, path string) error {
+	return c.open(client, path, os.O_TRUNC)
+}
+
+// startIn begins capturing packets for client into a new file name in the
+// -capture-dir directory. Names with path separators or dots only are
+// refused, and so is an existing file.
+func (c *packetCapture) startIn(client, name string) error {
+	if c.dir == "" {
+		return errors.New("captures from the admin server need -capture-dir")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return fmt.Errorf("invalid capture file name %q", name)
+	}
+	return c.open(client, filepath.Join(c.dir, name), os.O_EXCL)
+}
+
+// open begins a capture into path, created with the extra open flag
+func (c *packetCapture) open(client, path string, flag int) error {
+	ip, port, err := parseCaptureClient(client)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		return errors.New("a capture is already running")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
+	c.clientIP, c.port, c.path = ip, port, path
+	c.file, c.w = f, w
+	c.active.Store(true)
+	log.Printf("Packet capture started for %s -> %s", client, path)
+	return nil
+}
+
+// stop ends the running capture and closes the file
+func (c *packetCapture) stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return errors.New("no capture is running")
+	}
+	c.active.Store(false)
+
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	log.Printf("Packet capture stopped: %s", c.path)
+	c.file, c.w = nil, nil
+	return err
+}
+
+// capturing reports whether a capture is running; it is the only cost paid
+// per packet when capture is idle
+func (c *packetCapture) capturing() bool {
+	return c != nil && c.active.Load()
+}
+
+// record writes one datagram if client is the one being captured
+func (c *packetCapture) record(src, dst *net.UDPAddr, client *net.UDPAddr, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil || !c.clientIP.Equal(client.IP) || (c.port != 0 && c.port != client.Port) {
+		return
+	}
+
+	packet := synthesizeUDP(src, dst, payload)
+	now := time.Now()
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(packet)))
+	c.w.Write(rec)
+	c.w.Write(packet)
+
+	// Flush periodically so the file is readable while the capture runs
+	if now.Sub(c.lastFlush) > captureFlush {
+		c.w.Flush()
+		c.lastFlush = now
+	}
+}
+
+// parseCaptureClient accepts either a bare IP or an ip:port address
+func parseCaptureClient(client string) (net.IP, int, error) {
+	if ip := net.ParseIP(client); ip != nil {
+		return ip, 0, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", client)
+	if err != nil || addr.IP == nil {
+		return nil, 0, fmt.Errorf("invalid capture client %q", client)
+	}
+	return addr.IP, addr.Port, nil
+}
+
+// synthesizeUDP wraps payload in an IPv4 or IPv6 + UDP header. The relay's
+// address may be a wildcard, in which case the unspecified address of the
+// client's family is used.
+func synthesizeUDP(src, dst *net.UDPAddr, payload []byte) []byte {
+	srcIP, dstIP := src.IP, dst.IP
+	v4 := isV4OrWildcard(srcIP) && isV4OrWildcard(dstIP)
+
+	udpLen := udpHdrLen + len(payload)
+	var packet []byte
+	if v4 {
+		packet = make([]byte, ipv4HdrLen+udpLen)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[6] = 0x40 // Don't fragment
+		packet[8] = 64   // TTL
+		packet[9] = ipProtoUDP
+		copy(packet[12:16], to4(srcIP))
+		copy(packet[16:20], to4(dstIP))
+		binary.BigEndian.PutUint16(packet[10:], ipv4Checksum(packet[:ipv4HdrLen]))
+	} else {
+		packet = make([]byte, ipv6HdrLen+udpLen)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(udpLen))
+		packet[6] = ipProtoUDP
+		packet[7] = 64 // Hop limit
+		copy(packet[8:24], to16(srcIP))
+		copy(packet[24:40], to16(dstIP))
+	}
+
+	udp := packet[len(packet)-udpLen:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHdrLen:], payload)
+	return packet
+}
+
+func isV4OrWildcard(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified() || ip.To4() != nil
+}
+
+func to4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+func to16(ip net.IP) net.IP {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv6unspecified
+}
+
+// ipv4Checksum computes the header checksum over hdr (checksum field zeroed)
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,239 @@
+package relay
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// effectiveRelayConfig is the fully-resolved configuration a relay is running with,
+// after flags, environment variables and defaults have been applied
+type effectiveRelayConfig struct {
+	Listen           string  `json:"listen"`
+	Target           string  `json:"target"`
+	TargetIP         string  `json:"target_ip,omitempty"`
+	Timeout          string  `json:"timeout"`
+	ClientIdle       string  `json:"client_idle"`
+	ServerIdle       string  `json:"server_idle"`
+	HardTimeout      string  `json:"hard_timeout,omitempty"`
+	SessionHibernate string  `json:"session_hibernate,omitempty"`
+	ProbeBeforeClose string  `json:"probe_before_close,omitempty"`
+	CleanupInterval  string  `json:"cleanup_interval"`
+	BufferSize       int     `json:"buffer"`
+	DNSCheckInterval string  `json:"dns_check_interval"`
+	Jitter           float64 `json:"jitter"`
+	ServerConnMode   string  `json:"server_conn_mode"`
+	Mode             string  `json:"mode"`
+	ResponseReader   string  `json:"response_reader"`
+	RecoverPanics    bool    `json:"recover_panics"`
+
+	// Optional features, omitted when disabled
+	UpstreamSocks   string  `json:"upstream_socks,omitempty"`
+	ServerPortRange string  `json:"server_port_range,omitempty"`
+	StickyPorts     bool    `json:"sticky_ports,omitempty"`
+	Fwmark          int     `json:"fwmark,omitempty"`
+	Transparent     bool    `json:"transparent,omitempty"`
+	Freebind        bool    `json:"freebind,omitempty"`
+	ReplyPort       int     `json:"reply_port,omitempty"`
+	Rcvbuf          int     `json:"rcvbuf,omitempty"`
+	LoopWindow      string  `json:"loop_detect_window,omitempty"`
+	TargetAllow     string  `json:"target_allow_cidr,omitempty"`
+	PriorityCIDR    string  `json:"priority_cidr,omitempty"`
+	ListenSockopt   string  `json:"listen_sockopt,omitempty"`
+	ServerSockopt   string  `json:"server_sockopt,omitempty"`
+	SummaryInterval string  `json:"summary_interval,omitempty"`
+	ListenWake      string  `json:"listen_wake,omitempty"`
+	ResponseBuffer  int     `json:"response_buffer,omitempty"`
+	LoopSample      float64 `json:"loop_detect_sample,omitempty"`
+	NewSessionRate  float64 `json:"new_session_rate,omitempty"`
+	SlowSetup       string  `json:"slow_setup_threshold,omitempty"`
+	WriteTimeout    string  `json:"write_timeout,omitempty"`
+	ProbePayload    string  `json:"probe_payload,omitempty"`
+	ClientQueue     int     `json:"client_queue,omitempty"`
+	MaxPerIP        int     `json:"max_sessions_per_ip,omitempty"`
+	MaxPPS          int     `json:"max_pps_per_session,omitempty"`
+	MaxPPSServer    int     `json:"max_pps_per_session_server,omitempty"`
+	XDPRate         float64 `json:"xdp_rate,omitempty"`
+	FirstRetries    int     `json:"first_packet_retries,omitempty"`
+	ReapDeadClients int     `json:"reap_dead_clients,omitempty"`
+	FirstRetryDelay string  `json:"first_packet_retry_delay,omitempty"`
+	Obfuscated      bool    `json:"obfuscated,omitempty"`
+	RelayLinkSide   string  `json:"relay_link_side,omitempty"`
+	MirrorTarget    string  `json:"mirror_target,omitempty"`
+	DupTargets      string  `json:"duplicate_targets,omitempty"`
+	XDPIface        string  `json:"xdp_iface,omitempty"` // Empty when -xdp-rate fell back to the read loop
+	PacketHistogram bool    `json:"packet_histogram,omitempty"`
+	HandshakeFirst  bool    `json:"require_handshake_first,omitempty"`
+	HashClients     bool    `json:"hash_clients,omitempty"`
+	QuietSessions   bool    `json:"quiet_sessions,omitempty"`
+	InlineForward   bool    `json:"inline_forward,omitempty"`
+	DropEmpty       bool    `json:"drop_empty,omitempty"`
+	BufferAuto      bool    `json:"buffer_auto,omitempty"`
+	WGAware         bool    `json:"wg_aware,omitempty"`
+	Tracing         bool    `json:"tracing,omitempty"`
+	DNSVerbose      bool    `json:"dns_verbose,omitempty"`
+	PersistSessions bool    `json:"persist_sessions,omitempty"`
+}
+
+// effectiveConfig returns the configuration r is running with
+func (r *Relay) effectiveConfig() effectiveRelayConfig {
+	cfg := effectiveRelayConfig{
+		Listen:           r.listenAddr,
+		Target:           r.targetAddr,
+		Timeout:          r.timeout.String(),
+		ClientIdle:       r.clientIdle.String(),
+		ServerIdle:       r.serverIdle.String(),
+		CleanupInterval:  r.cleanupInterval.String(),
+		BufferSize:       r.readBufferSize(),
+		DNSCheckInterval: r.dnsCheckInterval.String(),
+		Jitter:           r.jitter,
+		ServerConnMode:   r.serverConnMode,
+		Mode:             r.forwardMode,
+		ResponseReader:   r.responseReader,
+		RecoverPanics:    r.recoverPanics,
+		HashClients:      r.hashClients,
+		QuietSessions:    r.quietSessions,
+		InlineForward:    r.inlineForward,
+		DropEmpty:        r.dropEmpty,
+		BufferAuto:       r.bufferAuto,
+		WGAware:          r.wgAware,
+		Obfuscated:       r.transform != nil,
+		PacketHistogram:  r.stats.toServerSizes != nil,
+		HandshakeFirst:   r.requireHandshake,
+		ClientQueue:      r.clientQueue,
+		MaxPerIP:         r.maxPerIP,
+		MaxPPS:           r.maxPPS,
+		MaxPPSServer:     r.maxPPSServer,
+		ReapDeadClients:  r.deadClientLimit,
+		PersistSessions:  r.persistSessions,
+		StickyPorts:      r.stickyPorts,
+		Fwmark:           r.fwmark,
+		Transparent:      r.transparent,
+		Freebind:         r.freebind,
+		ReplyPort:        r.replyPort,
+		Tracing:          r.tracer != nil,
+		DNSVerbose:       r.dnsVerbose,
+		Rcvbuf:           r.rcvbuf,
+		ResponseBuffer:   r.responseBuffer,
+	}
+
+	r.targetConnMu.RLock()
+	if r.targetConn != nil {
+		cfg.TargetIP = r.targetConn.String()
+	}
+	r.targetConnMu.RUnlock()
+
+	if r.upstreamSocks != "" {
+		cfg.UpstreamSocks = socks5DisplayAddr(r.upstreamSocks)
+	}
+	if r.serverPortMin > 0 {
+		cfg.ServerPortRange = fmt.Sprintf("%d-%d", r.serverPortMin, r.serverPortMax)
+	}
+	if r.sessionLimiter != nil {
+		cfg.NewSessionRate = r.sessionLimiter.rate
+	}
+	if r.xdp != nil {
+		cfg.XDPRate, cfg.XDPIface = float64(r.xdp.rate), r.xdp.iface
+	} else if r.listenLimiter != nil {
+		cfg.XDPRate = r.listenLimiter.rate
+	}
+	if len(r.listenSockopts) > 0 {
+		cfg.ListenSockopt = formatSockopts(r.listenSockopts)
+	}
+	if len(r.serverSockopts) > 0 {
+		cfg.ServerSockopt = formatSockopts(r.serverSockopts)
+	}
+	if len(r.priorities) > 0 {
+		rules := make([]string, len(r.priorities))
+		for i, rule := range r.priorities {
+			rules[i] = rule.network.String() + "=" + rule.class.String()
+		}
+		cfg.PriorityCIDR = strings.Join(rules, ",")
+	}
+	if len(r.targetAllow) > 0 {
+		networks := make([]string, len(r.targetAllow))
+		for i, network := range r.targetAllow {
+			networks[i] = network.String()
+		}
+		cfg.TargetAllow = strings.Join(networks, ",")
+	}
+	if r.summaryInterval > 0 {
+		cfg.SummaryInterval = r.summaryInterval.String()
+	}
+	if r.listenWake > 0 {
+		cfg.ListenWake = r.listenWake.String()
+	}
+	if r.loops != nil {
+		cfg.LoopWindow = r.loops.window.String()
+		cfg.LoopSample = r.loops.sample
+	}
+	if r.idleGrace > 0 {
+		cfg.HardTimeout = (r.timeout + r.idleGrace).String()
+	}
+	if r.hibernate > 0 {
+		cfg.SessionHibernate = r.hibernate.String()
+	}
+	if r.firstRetries > 0 {
+		cfg.FirstRetries = r.firstRetries
+		cfg.FirstRetryDelay = r.firstRetryDelay.String()
+	}
+	if r.slowSetup > 0 {
+		cfg.SlowSetup = r.slowSetup.String()
+	}
+	if r.writeTimeout > 0 {
+		cfg.WriteTimeout = r.writeTimeout.String()
+	}
+	if r.link != nil {
+		cfg.RelayLinkSide = r.link.side
+	}
+	if r.mirrorAddr != nil {
+		cfg.MirrorTarget = r.mirrorAddr.String()
+	}
+	for i, addr := range r.duplicateAddrs {
+		if i > 0 {
+			cfg.DupTargets += ","
+		}
+		cfg.DupTargets += addr.String()
+	}
+	if r.probeGrace > 0 {
+		cfg.ProbeBeforeClose = r.probeGrace.String()
+		cfg.ProbePayload = hex.EncodeToString(r.probePayload)
+	}
+	return cfg
+}
+
+// effectiveConfigs returns the configuration of every relay that started
+func effectiveConfigs(relays []*Relay) []effectiveRelayConfig {
+	configs := make([]effectiveRelayConfig, 0, len(relays))
+	for _, r := range relays {
+		select {
+		case <-r.ready:
+			if r.running.Load() {
+				configs = append(configs, r.effectiveConfig())
+			}
+		default:
+		}
+	}
+	return configs
+}
+
+// logEffectiveConfig waits for every relay to finish starting, then logs
+// their configuration as a single JSON entry
+func logEffectiveConfig(ctx context.Context, relays []*Relay) {
+	for _, r := range relays {
+		select {
+		case <-r.ready:
+		case <-ctx.Done():
+			return
+		}
+	}
+	data, err := json.Marshal(effectiveConfigs(relays))
+	if err != nil {
+		log.Printf("Error encoding effective configuration: %v", err)
+		return
+	}
+	log.Printf("Effective configuration: %s", data)
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// relaySpec is one relay to start: where it listens and what it forwards to
+type relaySpec struct {
+	listen string
+	target string
+	source string // Where the relay was defined, for messages
+}
+
+// loadConfigDir reads one relay from every *.yaml or *.yml file in dir, in
+// name order. A file that can't be read or parsed is logged and skipped, so
+// one bad file doesn't keep the others from loading. Files without a target
+// use defaultTarget.
+func loadConfigDir(dir, defaultTarget string) ([]relaySpec, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var specs []relaySpec
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var spec relaySpec
+			spec, err = parseRelayFile(data, defaultTarget)
+			spec.source = path
+			if err == nil {
+				specs = append(specs, spec)
+				continue
+			}
+		}
+		log.Printf("Error: Skipping relay config %s: %v", path, err)
+	}
+	return specs, nil
+}
+
+// parseRelayFile parses a relay config file. Only the flat subset of YAML a
+// relay needs is understood: "key: value" lines, optionally quoted, with #
+// comments. The keys are listen (required, as in -ports) and target.
+//
+//	listen: 51820
+//	target: vpn.example.com:51820
+func parseRelayFile(data []byte, defaultTarget string) (relaySpec, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '-' {
+			return relaySpec{}, fmt.Errorf("line %d: only flat key: value lines are supported", lineNo)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return relaySpec{}, fmt.Errorf("line %d: expected key: value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value, err := unquoteYAML(strings.TrimSpace(value))
+		if err != nil {
+			return relaySpec{}, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		switch key {
+		case "listen", "target":
+		default:
+			return relaySpec{}, fmt.Errorf("line %d: unknown key %q", lineNo, key)
+		}
+		if _, dup := values[key]; dup {
+			return relaySpec{}, fmt.Errorf("line %d: %s is set twice", lineNo, key)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return relaySpec{}, err
+	}
+
+	if values["listen"] == "" {
+		return relaySpec{}, errors.New("listen is required")
+	}
+	listen, err := parseListenAddr(values["listen"])
+	if err != nil {
+		return relaySpec{}, fmt.Errorf("invalid listen: %v", err)
+	}
+	target := values["target"]
+	if target == "" {
+		target = defaultTarget
+	}
+	if target == "" {
+		return relaySpec{}, errors.New("target is required when -target isn't set")
+	}
+	if _, err := parseTargetPorts(target); err != nil {
+		return relaySpec{}, err
+	}
+	return relaySpec{listen: listen, target: target}, nil
+}
+
+// stripYAMLComment removes a # comment, which starts a line or follows
+// whitespace, outside quotes, and any trailing whitespace
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			line = line[:i]
+		}
+	}
+	return strings.TrimRight(line, " \t\r")
+}
+
+// unquoteYAML returns a scalar's value, removing double or single quotes
+func unquoteYAML(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// adjustMaxProcs lowers GOMAXPROCS to the container's CPU limit and logs the
+// result. Go before 1.25 sizes GOMAXPROCS from the host's CPU count, so a
+// relay limited to 2 CPUs on a 64-core node would run 64 threads that the
+// CFS quota keeps throttling, adding latency spikes at high packet rates. A
+// GOMAXPROCS environment variable takes precedence, as it does for the
+// runtime.
+func adjustMaxProcs() {
+	limit := cgroupCPULimit()
+	cpus := runtime.NumCPU()
+	switch {
+	case limit <= 0:
+		log.Printf("CPU: GOMAXPROCS=%d, %d CPUs, no container CPU limit", runtime.GOMAXPROCS(0), cpus)
+	case os.Getenv("GOMAXPROCS") != "":
+		log.Printf("CPU: GOMAXPROCS=%d from the environment, container CPU limit %.2f of %d CPUs", runtime.GOMAXPROCS(0), limit, cpus)
+	default:
+		// Round down: a partial CPU's worth of threads would only be throttled
+		procs := int(limit)
+		if procs < 1 {
+			procs = 1
+		}
+		if procs < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+		}
+		log.Printf("CPU: GOMAXPROCS=%d, container CPU limit %.2f of %d CPUs", runtime.GOMAXPROCS(0), limit, cpus)
+	}
+}
+
+// cgroupCPULimit returns the CPU quota of the process's cgroup in CPUs, or 0
+// if there is none or it can't be read (e.g. outside Linux). With cgroup v2
+// the tightest limit on the way up to the root applies; with v1 only the
+// container's own view of the cpu controller is read.
+func cgroupCPULimit() float64 {
+	if group, ok := cgroupV2Path(); ok {
+		limit := 0.0
+		for dir := path.Join(cgroupRoot, group); strings.HasPrefix(dir, cgroupRoot); dir = path.Dir(dir) {
+			if l := readCPUMax(path.Join(dir, "cpu.max")); l > 0 && (limit == 0 || l < limit) {
+				limit = l
+			}
+		}
+		if limit > 0 {
+			return limit
+		}
+	}
+
+	quota, err1 := readCgroupInt(path.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+	period, err2 := readCgroupInt(path.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return float64(quota) / float64(period)
+}
+
+// cgroupV2Path returns the process's cgroup v2 path from /proc/self/cgroup
+func cgroupV2Path() (string, bool) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if group, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return group, true
+		}
+	}
+	return "", false
+}
+
+// readCPUMax parses a cgroup v2 cpu.max file, "<quota> <period>" or
+// "max <period>", returning the limit in CPUs or 0 for none
+func readCPUMax(file string) float64 {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota, err1 := strconv.ParseInt(fields[0], 10, 64)
+	period, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return float64(quota) / float64(period)
+}
+
+// readCgroupInt reads a cgroup file holding a single integer
+func readCgroupInt(file string) (int64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
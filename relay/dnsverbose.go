@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolveTargetVerbose resolves the target like resolveTargetAddrs and logs
+// the attempt for -dns-verbose: the addresses or error, how long it took,
+// which name servers were queried and the address in use. Seeing the servers
+// means using Go's own resolver, even where the system one would be chosen.
+func (r *Relay) resolveTargetVerbose(ctx context.Context) ([]*net.UDPAddr, error) {
+	var mu sync.Mutex
+	var servers []string
+	var dialer net.Dialer
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			if !containsString(servers, address) {
+				servers = append(servers, address)
+			}
+			mu.Unlock()
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	start := time.Now()
+	addrs, err := r.lookupTargetAddrs(ctx, resolver)
+	elapsed := time.Since(start).Round(time.Microsecond)
+
+	mu.Lock()
+	via := "answered locally (hosts file)"
+	if len(servers) > 0 {
+		via = "via " + strings.Join(servers, ", ")
+	}
+	mu.Unlock()
+	if err != nil {
+		log.Printf("[%s] DNS lookup of %s failed after %s %s: %v", r.listenAddr, r.targetAddr, elapsed, via, err)
+		return nil, err
+	}
+
+	ips := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP.String()
+	}
+	inUse := "none yet"
+	r.targetConnMu.RLock()
+	if r.targetConn != nil {
+		inUse = r.targetConn.IP.String()
+	}
+	r.targetConnMu.RUnlock()
+	log.Printf("[%s] DNS lookup of %s: [%s] in %s %s (in use: %s)",
+		r.listenAddr, r.targetAddr, strings.Join(ips, " "), elapsed, via, inUse)
+	return addrs, nil
+}
+
+// containsString reports whether s is one of list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
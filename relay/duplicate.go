@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+)
+
+// dedupWindowSize is how many recent responses a session remembers to
+// suppress copies arriving from -duplicate-targets
+const dedupWindowSize = 64
+
+// dedupWindow remembers hashes of a session's most recent responses. Copies
+// of a WireGuard packet are byte for byte identical, while distinct packets
+// never are (each carries its own counter), so a repeated hash is a copy.
+// Dedup is best-effort: a copy delayed past the window is forwarded again,
+// and WireGuard's replay protection drops it at the client.
+type dedupWindow struct {
+	hashes [dedupWindowSize]uint64
+	next   int
+}
+
+// seen reports whether data was among the recent responses, remembering it
+// if not. The caller must hold the session's mu.
+func (w *dedupWindow) seen(data []byte) bool {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+	for _, hash := range w.hashes {
+		if hash == sum {
+			return true
+		}
+	}
+	w.hashes[w.next] = sum
+	w.next = (w.next + 1) % dedupWindowSize
+	return false
+}
+
+// openDuplicates connects a new session to every -duplicate-targets server
+// and starts reading their responses. A server that can't be dialled is
+// logged and left out; the session still has its primary target.
+func (r *Relay) openDuplicates(ctx context.Context, session *ClientSession, clientKey string) {
+	for _, addr := range r.duplicateAddrs {
+		conn, err := r.dialServer(addr, 0)
+		if err != nil {
+			log.Printf("[%s] Error connecting %s to duplicate target %s: %v", r.listenAddr, r.clientLabel(clientKey), addr, err)
+			continue
+		}
+		r.fds.add(1)
+		session.dupConns = append(session.dupConns, conn)
+		go r.readDuplicate(ctx, session, clientKey, conn)
+	}
+}
+
+// readDuplicate forwards responses from a duplicate target until the session
+// closes its connection. Timeouts are left to the primary target's reader.
+func (r *Relay) readDuplicate(ctx context.Context, session *ClientSession, clientKey string, conn net.Conn) {
+	defer r.recoverPanic("duplicate reader", clientKey, session)
+	buffer := make([]byte, r.responseBufferSize())
+	backoff := readBackoff{relay: r, what: "duplicate target " + conn.RemoteAddr().String()}
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Usually ICMP port unreachable from a server that is down; the
+			// other targets carry the session meanwhile
+			backoff.wait(ctx, err)
+			continue
+		}
+		backoff.reset()
+		if err := r.forwardToClient(session, clientKey, buffer[:n]); err != nil {
+			r.forwardFailed("client", session, clientKey, n, err)
+		}
+	}
+}
+
+// writeDuplicates sends a copy of a client packet to every duplicate target,
+// ignoring failures: any one target reaching the server is enough
+func (r *Relay) writeDuplicates(session *ClientSession, data []byte) {
+	for _, conn := range session.dupConns {
+		if _, err := conn.Write(data); err == nil {
+			r.stats.duplicated.Add(1)
+		}
+	}
+}
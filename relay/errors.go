@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Errors classifying why a packet could not be forwarded or a session could
+// not be opened. Errors from the packet paths wrap one of these alongside the
+// underlying error, so both match with errors.Is.
+var (
+	ErrTargetUnreachable = errors.New("target unreachable")
+	ErrSessionLimit      = errors.New("session limit reached")
+	ErrNotHandshake      = errors.New("not a WireGuard handshake initiation")
+	ErrRateLimited       = errors.New("packet rate limit exceeded")
+	ErrQueueFull         = errors.New("client queue full")
+	ErrSessionClosed     = errors.New("session closed")
+	ErrTimeout           = errors.New("timed out")
+	ErrTruncated         = errors.New("packet truncated")
+	ErrShortWrite        = errors.New("short write")
+	ErrPacketTooBig      = errors.New("packet exceeds the path MTU")
+)
+
+// errorKinds names each class for the admin API, in the order they are
+// matched
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrTargetUnreachable, "target_unreachable"},
+	{ErrSessionLimit, "session_limit"},
+	{ErrNotHandshake, "not_handshake"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrQueueFull, "queue_full"},
+	{ErrSessionClosed, "session_closed"},
+	{ErrTimeout, "timeout"},
+	{ErrTruncated, "truncated"},
+	{ErrShortWrite, "short_write"},
+	{ErrPacketTooBig, "packet_too_big"},
+}
+
+// classifiedError is an error from the network tagged with its class. It
+// reads as the original error.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.class, e.err} }
+
+// classify tags a socket error with its class, if it has one: ErrTimeout
+// for deadlines, ErrTargetUnreachable for ICMP unreachable errors,
+// ErrPacketTooBig for EMSGSIZE. Other errors are returned as they are.
+func classify(err error) error {
+	var class error
+	switch {
+	case err == nil || errorKind(err) != "":
+		return err
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		class = ErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		class = ErrTargetUnreachable
+	case errors.Is(err, syscall.EMSGSIZE):
+		class = ErrPacketTooBig
+	default:
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			class = ErrTimeout
+		} else {
+			return err
+		}
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// errorKind returns the name of err's class, or "" if it has none
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return ""
+}
+
+// redactAddrs drops the addresses a *net.OpError in err carries, keeping its
+// operation, cause and class, so that client addresses reach logs and the
+// admin API only through clientLabel
+func redactAddrs(err error) error {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Source == nil && opErr.Addr == nil {
+		return err
+	}
+	var redacted error = &net.OpError{Op: opErr.Op, Net: opErr.Net, Err: opErr.Err}
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return &classifiedError{class: kind.err, err: redacted}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// ipFamily names the address family of ip, for messages
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// sameFamily reports whether a and b are both IPv4 or both IPv6. IPv4-mapped
+// IPv6 addresses, as seen by a dual-stack listener, count as IPv4.
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// routeTo checks that this host has a route to target by connecting an
+// unbound UDP socket, which looks the route up without sending anything.
+// Through -upstream-socks the proxy does the routing, so nothing is checked.
+func (r *Relay) routeTo(target *net.UDPAddr) error {
+	if r.upstreamSocks != "" {
+		return nil
+	}
+	conn, err := r.dialUDP(nil, target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// reachableTarget returns target if this host can route to it. Otherwise it
+// looks for another allowed address of the target, typically one of the other
+// family on a single-stack host, and logs an error when there is none rather
+// than let every session fail silently.
+func (r *Relay) reachableTarget(ctx context.Context, target *net.UDPAddr) *net.UDPAddr {
+	err := r.routeTo(target)
+	if err == nil {
+		return target
+	}
+	if addrs, rerr := r.resolveTargetAddrs(ctx); rerr == nil {
+		for _, addr := range addrs {
+			if !addr.IP.Equal(target.IP) && r.targetAllowed(addr.IP) && r.routeTo(addr) == nil {
+				log.Printf("[%s] No route to %s address %s of %s (%v); using %s address %s instead",
+					r.listenAddr, ipFamily(target.IP), target.IP, r.targetAddr, err, ipFamily(addr.IP), addr.IP)
+				return addr
+			}
+		}
+	}
+	log.Printf("[%s] Error: No route from this host to %s target %s (%v); new sessions will fail until one appears",
+		r.listenAddr, ipFamily(target.IP), target, err)
+	return target
+}
+
+// familyMismatch counts a -transparent client that can't be relayed because
+// its address family differs from the target's, logging at most once per
+// warnLogInterval
+func (r *Relay) familyMismatch(clientKey string, client, target net.IP) {
+	total := r.stats.familyMismatch.Add(1)
+	if !r.familyLog.allow(time.Now()) {
+		return
+	}
+	log.Printf("[%s] Error: -transparent can't send from %s client %s to %s target %s; dropped (%d total)",
+		r.listenAddr, ipFamily(client), r.clientLabel(clientKey), ipFamily(target), target, total)
+}
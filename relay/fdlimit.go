@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// fdHeadroom is kept free for listeners, the admin server, captures and
+	// state files; new sessions are refused once less than this remains
+	fdHeadroom = 64
+	// fdWarnPercent of the limit in use triggers a warning
+	fdWarnPercent = 80
+)
+
+// fdBudget estimates the process's open file descriptors and refuses new
+// sessions before the RLIMIT_NOFILE ceiling is hit. It is shared by all
+// relays since the limit is per process.
+type fdBudget struct {
+	limit  uint64       // Soft RLIMIT_NOFILE, 0 if unknown
+	base   int64        // Descriptors open at startup
+	open   atomic.Int64 // Sockets opened since startup
+	warned atomic.Bool
+}
+
+// newFDBudget reads the descriptor limit and logs it
+func newFDBudget() *fdBudget {
+	b := &fdBudget{base: countOpenFDs()}
+	limit, ok := fdLimit()
+	if !ok || limit > 1<<31 {
+		log.Printf("File descriptor limit unknown; not capping sessions")
+		return b
+	}
+	b.limit = limit
+	log.Printf("File descriptor limit: %d (about %d concurrent sessions)", limit, b.capacity())
+	return b
+}
+
+// countOpenFDs counts descriptors open now, assuming stdio where /proc is
+// unavailable
+func countOpenFDs() int64 {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 3
+	}
+	// One entry is the directory handle used to list it
+	return int64(len(entries)) - 1
+}
+
+// capacity is how many more descriptors may be opened before refusing
+func (b *fdBudget) capacity() int64 {
+	return int64(b.limit) - fdHeadroom - b.base
+}
+
+// estimate returns the estimated number of open descriptors
+func (b *fdBudget) estimate() int64 {
+	return b.base + b.open.Load()
+}
+
+// admit reports whether another socket may be opened, warning once each time
+// usage crosses fdWarnPercent of the limit
+func (b *fdBudget) admit() bool {
+	return b.admitPriority(priorityNormal)
+}
+
+// admitPriority is admit for a session of class: low-priority sessions are
+// refused with twice fdHeadroom left, high-priority ones may use half of it
+func (b *fdBudget) admitPriority(class priorityClass) bool {
+	if b.limit == 0 {
+		return true
+	}
+	headroom := int64(fdHeadroom)
+	switch class {
+	case priorityLow:
+		headroom *= 2
+	case priorityHigh:
+		headroom /= 2
+	}
+	used := b.estimate()
+	allowed := used+headroom < int64(b.limit)
+	if allowed && uint64(used)*100 < b.limit*fdWarnPercent {
+		b.warned.Store(false)
+		return true
+	}
+	if b.warned.CompareAndSwap(false, true) {
+		log.Printf("Warning: about %d of %d file descriptors in use; new sessions will be refused above %d. Raise the limit with ulimit -n",
+			used, b.limit, int64(b.limit)-fdHeadroom)
+	}
+	return allowed
+}
+
+// add records n sockets opened (or closed, if negative)
+func (b *fdBudget) add(n int64) {
+	b.open.Add(n)
+}
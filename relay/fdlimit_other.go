@@ -0,0 +1,8 @@
+//go:build !unix
+
+package relay
+
+// fdLimit is only available on Unix systems
+func fdLimit() (uint64, bool) {
+	return 0, false
+}
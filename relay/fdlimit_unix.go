@@ -0,0 +1,14 @@
+//go:build unix
+
+package relay
+
+import "syscall"
+
+// fdLimit returns the soft RLIMIT_NOFILE
+func fdLimit() (uint64, bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, false
+	}
+	return uint64(rl.Cur), true
+}
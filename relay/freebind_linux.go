@@ -0,0 +1,18 @@
+//go:build linux
+
+package relay
+
+import "syscall"
+
+// setFreebind sets IP_FREEBIND, letting a socket bind to an address that is
+// not (yet) assigned to any interface, e.g. a floating VIP. Linux honours the
+// option on IPv6 sockets too.
+func setFreebind(c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
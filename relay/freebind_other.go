@@ -0,0 +1,13 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IP_FREEBIND is Linux-specific; -freebind is ignored with a warning elsewhere
+func setFreebind(c syscall.RawConn) error {
+	return errors.New("-freebind is only supported on Linux")
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingConn is a server connection that keeps the last packet written
+type recordingConn struct {
+	net.Conn
+	last []byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.last = append(c.last[:0], b...)
+	return len(b), nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+// FuzzHandleClientPacket feeds arbitrary packets and client addresses
+// through the checks a client packet passes on its way to the server, on a
+// relay that authenticates its link and requires handshakes. Only a tagged
+// handshake initiation may open a session, and it is forwarded unchanged.
+func FuzzHandleClientPacket(f *testing.F) {
+	link := &relayLink{key: []byte("fuzz key"), side: relayLinkClient}
+	initiation := make([]byte, wgInitiationSize)
+	initiation[0] = wgMessageInitiation
+	transport := make([]byte, wgTransportMinLength)
+	transport[0] = wgMessageTransport
+	for _, payload := range [][]byte{initiation, transport, nil, []byte("not wireguard")} {
+		f.Add(append(payload, link.tag(linkToServer, payload)...), []byte(net.IPv4(192, 0, 2, 1).To4()), uint16(51820))
+	}
+	f.Add(initiation, []byte(net.ParseIP("2001:db8::1")), uint16(0))
+
+	f.Fuzz(func(t *testing.T, data, ip []byte, port uint16) {
+		r, err := NewRelay(RelayConfig{Listen: "51820", Target: "127.0.0.1:51820", RequireHandshake: true, QuietSessions: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.link = link
+		r.dropEmpty = true
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+		clientAddr := &net.UDPAddr{IP: ip, Port: int(port)}
+
+		payload, ok := r.acceptClientPacket(data, clientAddr)
+		opened, tagged := link.open(linkToServer, data)
+		if want := tagged && len(opened) > 0; ok != want {
+			t.Fatalf("accepted %v, want %v", ok, want)
+		}
+		if !ok {
+			return
+		}
+		if !bytes.Equal(payload, opened) {
+			t.Fatalf("payload %x, want %x", payload, opened)
+		}
+
+		err = r.admitSession(payload, clientAddr, r.clientPriority(clientAddr.IP), time.Now())
+		msgType, valid := wgMessageType(payload)
+		if handshake := valid && msgType == wgMessageInitiation; handshake != (err == nil) {
+			t.Fatalf("handshake %v, admitted with error %v", handshake, err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrNotHandshake) {
+				t.Fatalf("refused with %v, want ErrNotHandshake", err)
+			}
+			return
+		}
+
+		conn := &recordingConn{}
+		session := &ClientSession{clientAddr: clientAddr, toServerConn: conn}
+		if err := r.forwardToServer(session, clientAddr.String(), payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(conn.last, payload) {
+			t.Fatalf("forwarded %x, want %x", conn.last, payload)
+		}
+	})
+}
+
+// mmdbSeed returns a tiny MaxMind DB: one IPv4 search tree node whose
+// records both mean "not found", and its metadata
+func mmdbSeed() []byte {
+	mmdbString := func(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+	var db []byte
+	db = append(db, 0, 0, 1, 0, 0, 1)      // Node 0, 24-bit records
+	db = append(db, make([]byte, 16)...)   // Data section separator
+	db = append(db, mmdbMetadataMarker...) // Metadata follows
+	db = append(db, 7<<5|3)                // Map of 3 entries
+	db = append(db, mmdbString("node_count")...)
+	db = append(db, 6<<5|4)
+	db = binary.BigEndian.AppendUint32(db, 1)
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, 5<<5|2)
+	db = binary.BigEndian.AppendUint16(db, 24)
+	db = append(db, mmdbString("ip_version")...)
+	db = append(db, 5<<5|2)
+	db = binary.BigEndian.AppendUint16(db, 4)
+	return db
+}
+
+// FuzzParseMMDB checks that no GeoIP database, however malformed, makes
+// opening it or looking addresses up panic or hang
+func FuzzParseMMDB(f *testing.F) {
+	if _, err := parseMMDB(mmdbSeed()); err != nil {
+		f.Fatalf("seed database: %v", err)
+	}
+	f.Add(mmdbSeed())
+	f.Add(mmdbMetadataMarker)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := parseMMDB(data)
+		if err != nil {
+			return
+		}
+		for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")} {
+			db.lookup(ip)
+		}
+	})
+}
+
+// FuzzParseConfig runs the parsers for flag values and -config-dir files on
+// arbitrary input; they must return errors, not panic
+func FuzzParseConfig(f *testing.F) {
+	for _, seed := range []string{
+		"51820", "127.0.0.1:51820", "[::1]:51820",
+		"vpn.example.com:51820,51821", "auto", "1500", "51820=auto,51821=9000",
+		"10.0.0.0/8,2001:db8::/32", "10.0.0.0/8=high,192.0.2.0/24=low", "40000-50000",
+		"SO_RCVBUF=8388608,IP_TOS=0x10", "xor:00ff",
+		"listen: 51820\ntarget: \"vpn.example.com:51820\" # comment\n",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		parseListenAddr(s)
+		parseTargetPorts(s)
+		parseBufferSetting(s)
+		parsePortBuffers(s)
+		parsePortRcvbufs(s)
+		parseCIDRList(s)
+		parsePortRange(s)
+		parseTransform(s)
+		parseRelayFile([]byte(s), "127.0.0.1:51820")
+
+		if rules, err := parsePriorityCIDRs(s); err == nil {
+			for i := 1; i < len(rules); i++ {
+				prev, _ := rules[i-1].network.Mask.Size()
+				size, _ := rules[i].network.Mask.Size()
+				if size > prev {
+					t.Fatalf("rule %d (/%d) sorts after a shorter prefix (/%d)", i, size, prev)
+				}
+			}
+		}
+		if opts, err := parseSockopts(s); err == nil {
+			again, err := parseSockopts(formatSockopts(opts))
+			if err != nil || len(again) != len(opts) {
+				t.Fatalf("%q formatted as %q does not parse back: %v", s, formatSockopts(opts), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// setFwmark sets SO_MARK on a socket so policy routing can pick its route
+func setFwmark(c syscall.RawConn, mark int) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// fwmarkControl returns a net.Dialer Control hook that marks new sockets
+func fwmarkControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setFwmark(c, mark)
+	}
+}
+
+// checkFwmark verifies that sockets can be marked by marking a throwaway
+// one, which fails without CAP_NET_ADMIN
+func checkFwmark(mark int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("setting SO_MARK needs CAP_NET_ADMIN: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Socket marks are only implemented on Linux
+var errFwmarkUnsupported = errors.New("-fwmark is only supported on Linux")
+
+func fwmarkControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errFwmarkUnsupported
+	}
+}
+
+func checkFwmark(mark int) error { return errFwmarkUnsupported }
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// geoIP enriches client addresses from local MaxMind GeoLite2 databases.
+// Country and ASN come from separate GeoLite2 databases, so several can be
+// loaded and their answers merged.
+type geoIP struct {
+	dbs []*mmdbReader
+}
+
+// geoInfo is what is known about a client address
+type geoInfo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint64 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// loadGeoIP opens the comma-separated databases in paths. Databases that
+// can't be read are skipped with a warning; nil is returned if none load.
+func loadGeoIP(paths string) *geoIP {
+	g := &geoIP{}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		db, err := openMMDB(path)
+		if err != nil {
+			log.Printf("Warning: GeoIP database %s unavailable, skipping: %v", path, err)
+			continue
+		}
+		log.Printf("Loaded GeoIP database %s (%s)", path, db.dbType)
+		g.dbs = append(g.dbs, db)
+	}
+	if len(g.dbs) == 0 {
+		return nil
+	}
+	return g
+}
+
+// lookup returns what the databases know about ip. It is safe on a nil
+// geoIP, returning nothing.
+func (g *geoIP) lookup(ip net.IP) geoInfo {
+	var info geoInfo
+	if g == nil {
+		return info
+	}
+	for _, db := range g.dbs {
+		record, err := db.lookup(ip)
+		if err != nil {
+			continue
+		}
+		m, ok := record.(map[string]any)
+		if !ok {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = mmdbCountry(m, "country")
+		}
+		if info.Country == "" {
+			info.Country = mmdbCountry(m, "registered_country")
+		}
+		if n := mmdbUint(m["autonomous_system_number"]); n != 0 && info.ASN == 0 {
+			info.ASN = n
+			info.ASOrg, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+// mmdbCountry returns the ISO code of a GeoLite2 country field
+func mmdbCountry(record map[string]any, field string) string {
+	country, _ := record[field].(map[string]any)
+	code, _ := country["iso_code"].(string)
+	return code
+}
+
+// String formats the info for log lines, e.g. "US, AS15169 Google LLC"
+func (info geoInfo) String() string {
+	var parts []string
+	if info.Country != "" {
+		parts = append(parts, info.Country)
+	}
+	if info.ASN != 0 {
+		as := fmt.Sprintf("AS%d", info.ASN)
+		if info.ASOrg != "" {
+			as += " " + info.ASOrg
+		}
+		parts = append(parts, as)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Target health states
+const (
+	targetProbing   int32 = iota // No response seen yet since start or the last DNS change
+	targetHealthy                // The target has responded
+	targetUnhealthy              // The target refused packets (ICMP port unreachable)
+)
+
+var targetStateNames = [...]string{"probing", "healthy", "unhealthy"}
+
+// targetHealth tracks what the relay has observed about its target. It is
+// updated from the response path, so every field is lock-free.
+type targetHealth struct {
+	state        atomic.Int32
+	lastResponse atomic.Int64 // Unix nanoseconds, 0 if never
+	lastResolved atomic.Int64 // Unix nanoseconds of the last successful DNS resolution
+	dnsFailures  atomic.Int32 // Consecutive failed DNS resolutions
+	drained      atomic.Bool  // Drained for maintenance: no new sessions until undrained
+}
+
+// targetStatus is the admin API view of a relay's target
+type targetStatus struct {
+	Listen       string     `json:"listen"`
+	Target       string     `json:"target"`
+	TargetIP     string     `json:"target_ip,omitempty"`
+	State        string     `json:"state"`
+	LastResponse *time.Time `json:"last_response,omitempty"`
+	LastResolved *time.Time `json:"last_resolved,omitempty"`
+	DNSFailures  int32      `json:"dns_failures"`
+	Ready        bool       `json:"ready"`
+	Drained      bool       `json:"drained,omitempty"`
+	Sessions     int        `json:"sessions"`
+}
+
+// markTargetDown flags the target as unhealthy, logging the transition
+func (r *Relay) markTargetDown() {
+	if r.health.state.Swap(targetUnhealthy) != targetUnhealthy {
+		log.Printf("[%s] Target %s marked unhealthy (port unreachable)", r.listenAddr, r.targetAddr)
+	}
+}
+
+// markTargetUp records a response from the target at now
+func (r *Relay) markTargetUp(now time.Time) {
+	r.health.lastResponse.Store(now.UnixNano())
+	if r.health.state.Load() != targetHealthy && r.health.state.Swap(targetHealthy) == targetUnhealthy {
+		log.Printf("[%s] Target %s is responding again", r.listenAddr, r.targetAddr)
+	}
+}
+
+// markTargetProbing returns a healthy target to probing when it has gone
+// quiet towards a client that is still sending
+func (r *Relay) markTargetProbing() {
+	r.health.state.CompareAndSwap(targetHealthy, targetProbing)
+}
+
+// markTargetResolved records a successful DNS resolution of the target
+func (r *Relay) markTargetResolved() {
+	r.health.lastResolved.Store(time.Now().UnixNano())
+	if failures := r.health.dnsFailures.Swap(0); r.dnsFailureLimit > 0 && failures >= int32(r.dnsFailureLimit) {
+		log.Printf("[%s] DNS resolution of %s recovered after %d failures; relay is ready again", r.listenAddr, r.targetAddr, failures)
+	}
+}
+
+// dnsFailed records a failed DNS resolution. Traffic keeps flowing to the
+// last known IP, but once -dns-failure-threshold failures in a row are
+// reached the relay reports itself not ready.
+func (r *Relay) dnsFailed() {
+	failures := r.health.dnsFailures.Add(1)
+	if r.dnsFailureLimit > 0 && failures == int32(r.dnsFailureLimit) {
+		log.Printf("[%s] WARNING: %d consecutive DNS failures for %s; relay marked not ready, still forwarding to last known IP",
+			r.listenAddr, failures, r.targetAddr)
+	}
+}
+
+// isReady reports whether the relay is listening, its target's DNS is
+// resolving and the target is not drained
+func (r *Relay) isReady() bool {
+	if !r.running.Load() || r.health.drained.Load() {
+		return false
+	}
+	return r.dnsFailureLimit == 0 || r.health.dnsFailures.Load() < int32(r.dnsFailureLimit)
+}
+
+// setDrained drains or undrains the relay's target, logging changes. While
+// drained the relay refuses new sessions and reports not ready, so a load
+// balancer sends new clients elsewhere; existing sessions keep forwarding
+// until they end, as there is no other target to migrate them to.
+func (r *Relay) setDrained(drained bool) {
+	if r.health.drained.Swap(drained) == drained {
+		return
+	}
+	if drained {
+		log.Printf("[%s] Target %s drained: refusing new sessions, %d active sessions continue", r.listenAddr, r.targetAddr, r.sessionCount())
+	} else {
+		log.Printf("[%s] Target %s undrained: accepting new sessions", r.listenAddr, r.targetAddr)
+	}
+}
+
+// matchesTarget reports whether addr names the relay's target, as configured
+// or as its resolved IP with or without the port
+func (r *Relay) matchesTarget(addr string) bool {
+	if addr == r.targetAddr {
+		return true
+	}
+	r.targetConnMu.RLock()
+	defer r.targetConnMu.RUnlock()
+	if r.targetConn == nil {
+		return false
+	}
+	return addr == r.targetConn.String() || addr == r.targetConn.IP.String()
+}
+
+// targetStatus reports the relay's target health for the admin API
+func (r *Relay) targetStatus() targetStatus {
+	status := targetStatus{
+		Listen:       r.listenAddr,
+		Target:       r.targetAddr,
+		State:        targetStateNames[r.health.state.Load()],
+		LastResponse: unixNanoTime(r.health.lastResponse.Load()),
+		LastResolved: unixNanoTime(r.health.lastResolved.Load()),
+		DNSFailures:  r.health.dnsFailures.Load(),
+		Ready:        r.isReady(),
+		Drained:      r.health.drained.Load(),
+		Sessions:     r.sessionCount(),
+	}
+	r.targetConnMu.RLock()
+	if r.targetConn != nil {
+		status.TargetIP = r.targetConn.String()
+	}
+	r.targetConnMu.RUnlock()
+	return status
+}
+
+// unixNanoTime converts a stored timestamp, returning nil if unset
+func unixNanoTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns)
+	return &t
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"net"
+	"time"
+)
+
+// hibernateMaxTracked bounds how many hibernated sessions a relay remembers;
+// beyond it expired sessions simply close
+const hibernateMaxTracked = 65536
+
+// hibernation is what -session-hibernate keeps of an expired session: its
+// server-facing source port, so the client's next packet can reopen the
+// session from the same port and the server still finds the peer at the
+// endpoint it last saw
+type hibernation struct {
+	port int
+	at   time.Time
+}
+
+// hibernateLocked remembers an expiring session's source port. The caller
+// must hold sessionsMu.
+func (r *Relay) hibernateLocked(clientKey string, session *ClientSession) {
+	if r.hibernate <= 0 || r.sharedServerSocket() || len(r.hibernated) >= hibernateMaxTracked {
+		return
+	}
+	session.mu.Lock()
+	local, ok := session.toServerConn.LocalAddr().(*net.UDPAddr)
+	session.mu.Unlock()
+	if !ok || local.Port == 0 {
+		return
+	}
+	r.hibernated[clientKey] = hibernation{port: local.Port, at: time.Now()}
+	r.logSession("[%s] Session hibernated: %s (source port %d kept for %s)",
+		r.listenAddr, r.clientLabel(clientKey), local.Port, r.hibernate)
+}
+
+// wakePortLocked returns and forgets the source port a hibernated session of
+// clientKey used, or 0 if there is none. The caller must hold sessionsMu.
+func (r *Relay) wakePortLocked(clientKey string) int {
+	h, ok := r.hibernated[clientKey]
+	if !ok {
+		return 0
+	}
+	delete(r.hibernated, clientKey)
+	if time.Since(h.at) > r.hibernate {
+		return 0
+	}
+	return h.port
+}
+
+// pruneHibernatedLocked forgets hibernated sessions older than -session-hibernate.
+// The caller must hold sessionsMu.
+func (r *Relay) pruneHibernatedLocked(now time.Time) {
+	for key, h := range r.hibernated {
+		if now.Sub(h.at) > r.hibernate {
+			delete(r.hibernated, key)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A leak is reported once the goroutine count has stayed more than
+// leakSlack (or leakSlackFraction of the expected count, if larger) above
+// what the sessions explain for leakSamples samples in a row. The slack
+// absorbs the short-lived goroutines of packets in flight and TCP clients.
+const (
+	leakSamples       = 3
+	leakSlack         = 100
+	leakSlackFraction = 0.25
+)
+
+// leakCheck samples the goroutine count against the sessions of every relay.
+// Goroutines are process-wide, so one check covers all listen ports.
+type leakCheck struct {
+	relays []*Relay
+
+	mu         sync.Mutex
+	goroutines int
+	sessions   int
+	expected   int // Goroutines the sessions explain, plus the fixed overhead
+	baseline   int // Fixed overhead: the fewest goroutines seen beyond the sessions' own
+	over       int // Consecutive samples above expected plus slack
+}
+
+// goroutinesPerSession is how many long-lived goroutines each of r's
+// sessions runs
+func (r *Relay) goroutinesPerSession() int {
+	n := len(r.duplicateAddrs)
+	if r.responseReader == responseReaderGoroutine && !r.sharedServerSocket() {
+		n++
+	}
+	if r.clientQueue > 0 {
+		n++
+	}
+	return n
+}
+
+// newLeakCheck returns a check of relays' sessions with no samples yet
+func newLeakCheck(relays []*Relay) *leakCheck {
+	return &leakCheck{relays: relays, baseline: -1}
+}
+
+// run samples every interval until ctx is cancelled
+func (c *leakCheck) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.sample()
+	}
+}
+
+// sample takes one sample, warning when a leak is suspected
+func (c *leakCheck) sample() {
+	goroutines := runtime.NumGoroutine()
+	var sessions, sessionGoroutines int
+	for _, r := range c.relays {
+		n := r.sessionCount()
+		sessions += n
+		sessionGoroutines += n * r.goroutinesPerSession()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if overhead := goroutines - sessionGoroutines; c.baseline < 0 || overhead < c.baseline {
+		c.baseline = overhead
+	}
+	c.goroutines, c.sessions = goroutines, sessions
+	c.expected = c.baseline + sessionGoroutines
+	slack := int(float64(c.expected) * leakSlackFraction)
+	if slack < leakSlack {
+		slack = leakSlack
+	}
+	if goroutines <= c.expected+slack {
+		c.over = 0
+		return
+	}
+	// Warn once per episode, after it has lasted leakSamples samples
+	if c.over++; c.over == leakSamples {
+		log.Printf("Warning: possible goroutine leak: %d goroutines for %d sessions, about %d expected (%d over for %d samples in a row)",
+			goroutines, sessions, c.expected, goroutines-c.expected, c.over)
+	}
+}
+
+// snapshot returns the latest sample for /stats
+func (c *leakCheck) snapshot() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	perSession := 0.0
+	if c.sessions > 0 {
+		perSession = float64(c.goroutines) / float64(c.sessions)
+	}
+	return map[string]any{
+		"goroutines":             c.goroutines,
+		"goroutines_expected":    c.expected,
+		"goroutines_per_session": perSession,
+		"sessions":               c.sessions,
+		"leak_suspected":         c.over >= leakSamples,
+	}
+}
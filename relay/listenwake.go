@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// listenWaker bounds how long a read on the listen socket blocks with a read
+// deadline (-listen-wake), so the read loop wakes to check for shutdown and
+// do housekeeping even when no packets arrive
+type listenWaker struct {
+	conn     *net.UDPConn
+	interval time.Duration // 0 disables the deadline
+	armedAt  time.Time
+}
+
+// arm moves the read deadline to interval after now. Under load it is only
+// moved once half the interval has passed, sparing a syscall per packet, so
+// an idle loop wakes between interval/2 and interval after its last packet.
+func (w *listenWaker) arm(now time.Time) {
+	if w.interval <= 0 || now.Sub(w.armedAt) < w.interval/2 {
+		return
+	}
+	w.conn.SetReadDeadline(now.Add(w.interval))
+	w.armedAt = now
+}
+
+// woke reports whether err from a read is the deadline expiring rather than
+// a failure
+func (w *listenWaker) woke(err error) bool {
+	return w.interval > 0 && errors.Is(err, os.ErrDeadlineExceeded)
+}
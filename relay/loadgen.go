@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	loadgenHeaderSize = 16              // Magic, client index and send time at the start of each packet
+	loadgenMagic      = 0x4c4f4144      // "LOAD"; never a WireGuard message type, so the test responder echoes it
+	loadgenDrain      = 2 * time.Second // How long replies are awaited after the last send
+)
+
+// LoadgenConfig describes a synthetic load run (-loadgen)
+type LoadgenConfig struct {
+	Relay    string        // Relay listen address the clients send to
+	Clients  int           // Concurrent synthetic clients, each with its own socket
+	Rate     float64       // Packets per second per client, at most 1e9
+	Size     int           // Packet size in bytes
+	Duration time.Duration // How long clients send for
+}
+
+// loadgenClient is one synthetic client's results. Only its own goroutines
+// touch it until the run ends.
+type loadgenClient struct {
+	sent      uint64
+	received  uint64
+	foreign   uint64          // Replies that didn't carry this client's header
+	latencies []time.Duration // Round-trip time of every reply
+}
+
+// RunLoadgen drives synthetic clients through a relay whose target echoes
+// packets back, such as -test-server, and logs a summary of what came back.
+// It uses real sockets end to end, so it measures the relay as deployed:
+// socket buffers, session setup and all. It returns an error if the relay
+// can't be reached or nothing came back.
+func RunLoadgen(ctx context.Context, cfg LoadgenConfig) error {
+	if cfg.Clients <= 0 || cfg.Rate <= 0 || cfg.Duration <= 0 {
+		return errors.New("Clients, Rate and Duration must be positive")
+	}
+	if cfg.Rate > 1e9 {
+		return fmt.Errorf("Rate must be at most 1e9 packets per second, got %g", cfg.Rate)
+	}
+	if cfg.Size < loadgenHeaderSize || cfg.Size > 65507 {
+		return fmt.Errorf("Size must be between %d and 65507, got %d", loadgenHeaderSize, cfg.Size)
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", cfg.Relay)
+	if err != nil {
+		return err
+	}
+
+	conns := make([]*net.UDPConn, cfg.Clients)
+	for i := range conns {
+		conn, err := net.DialUDP("udp", nil, relayAddr)
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return fmt.Errorf("client %d: %w", i, err)
+		}
+		conns[i] = conn
+	}
+
+	log.Printf("Load test: %d clients x %g packets/s x %s to %s, %d-byte packets (%s offered)",
+		cfg.Clients, cfg.Rate, cfg.Duration, relayAddr, cfg.Size,
+		formatBitRate(float64(cfg.Clients)*cfg.Rate*float64(cfg.Size)*8))
+
+	sendCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	results := make([]loadgenClient, cfg.Clients)
+	var senders, receivers sync.WaitGroup
+	start := time.Now()
+	for i, conn := range conns {
+		senders.Add(1)
+		receivers.Add(1)
+		go func(i int, conn *net.UDPConn) {
+			defer senders.Done()
+			results[i].sent = loadgenSend(sendCtx, conn, uint32(i), cfg)
+		}(i, conn)
+		go func(i int, conn *net.UDPConn) {
+			defer receivers.Done()
+			loadgenReceive(conn, uint32(i), &results[i])
+		}(i, conn)
+	}
+	senders.Wait()
+	elapsed := time.Since(start)
+
+	// Give replies still in flight a chance, unless interrupted
+	select {
+	case <-ctx.Done():
+	case <-time.After(loadgenDrain):
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	receivers.Wait()
+
+	return loadgenReport(results, elapsed, cfg.Size)
+}
+
+// loadgenSend sends packets at the configured rate until ctx is done and
+// returns how many were sent. Clients start at random offsets so they don't
+// all send in lockstep.
+func loadgenSend(ctx context.Context, conn *net.UDPConn, index uint32, cfg LoadgenConfig) uint64 {
+	interval := time.Duration(float64(time.Second) / cfg.Rate)
+	if interval <= 0 {
+		interval = 1
+	}
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	}
+
+	packet := make([]byte, cfg.Size)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var sent uint64
+	for {
+		binary.BigEndian.PutUint32(packet[0:4], loadgenMagic)
+		binary.BigEndian.PutUint32(packet[4:8], index)
+		binary.BigEndian.PutUint64(packet[8:16], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(packet); err == nil {
+			sent++
+		}
+		select {
+		case <-ctx.Done():
+			return sent
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadgenReceive records replies on conn until it is closed
+func loadgenReceive(conn *net.UDPConn, index uint32, result *loadgenClient) {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// ICMP errors while the relay is down surface here; keep reading
+			continue
+		}
+		now := time.Now()
+		reply := buffer[:n]
+		if n < loadgenHeaderSize || binary.BigEndian.Uint32(reply[0:4]) != loadgenMagic ||
+			binary.BigEndian.Uint32(reply[4:8]) != index {
+			result.foreign++
+			continue
+		}
+		result.received++
+		sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(reply[8:16])))
+		result.latencies = append(result.latencies, now.Sub(sentAt))
+	}
+}
+
+// loadgenReport logs the combined results of a run
+func loadgenReport(results []loadgenClient, elapsed time.Duration, size int) error {
+	var sent, received, foreign uint64
+	var latencies []time.Duration
+	for _, r := range results {
+		sent += r.sent
+		received += r.received
+		foreign += r.foreign
+		latencies = append(latencies, r.latencies...)
+	}
+
+	lost := int64(sent) - int64(received)
+	var lossPct float64
+	if sent > 0 {
+		lossPct = float64(lost) / float64(sent) * 100
+	}
+	seconds := elapsed.Seconds()
+	log.Printf("Load test summary: sent %d, received %d, lost %d (%.2f%%) in %s; delivered %.0f packets/s, %s",
+		sent, received, lost, lossPct, elapsed.Round(time.Millisecond),
+		float64(received)/seconds, formatBitRate(float64(received)*float64(size)*8/seconds))
+	if foreign > 0 {
+		log.Printf("Load test: %d replies didn't match the client they arrived at; is the target echoing packets unchanged?", foreign)
+	}
+
+	if len(latencies) == 0 {
+		return errors.New("no replies received; check that the relay is running and its target echoes packets (e.g. -test-server)")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	log.Printf("Load test round-trip latency: min %s, p50 %s, p90 %s, p99 %s, max %s",
+		percentile(0), percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	return nil
+}
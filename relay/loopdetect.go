@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	loopRepeats    = 3     // Times one packet must be forwarded within the window to count as a loop
+	loopMaxTracked = 65536 // Sampled packets remembered at once
+)
+
+// loopDetector spots forwarding loops (-loop-detect-window), e.g. a -target
+// pointing back at this or another relay, where every packet is forwarded
+// again and again. It remembers a sample of the packets sent to servers by
+// payload hash and reports a packet seen loopRepeats times within the window.
+// Sampling is by hash, so a looping packet is either always or never
+// sampled, and a loop's stream of distinct packets is caught either way.
+// WireGuard never sends the same datagram twice, so repeats are not expected
+// from real clients. One detector is shared by all relays, catching loops
+// that pass through several listen ports.
+type loopDetector struct {
+	window time.Duration
+	sample float64 // Fraction of packets tracked
+	cutoff uint64  // Payload hashes above this are not sampled
+	mu     sync.Mutex
+	seen   map[uint64]loopSighting
+}
+
+// loopSighting tracks one sampled packet within the window
+type loopSighting struct {
+	first time.Time
+	count int
+}
+
+// newLoopDetector creates a detector sampling the given fraction of packets
+func newLoopDetector(window time.Duration, sample float64) *loopDetector {
+	cutoff := uint64(math.MaxUint64)
+	if sample < 1 {
+		cutoff = uint64(sample * math.MaxUint64)
+	}
+	return &loopDetector{
+		window: window,
+		sample: sample,
+		cutoff: cutoff,
+		seen:   make(map[uint64]loopSighting),
+	}
+}
+
+// observe records a packet forwarded to a server and reports whether it has
+// just been seen often enough to indicate a loop. It reports each looping
+// packet once per window.
+func (d *loopDetector) observe(data []byte, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+	if sum > d.cutoff {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sighting, ok := d.seen[sum]
+	if !ok || now.Sub(sighting.first) > d.window {
+		if len(d.seen) >= loopMaxTracked {
+			d.prune(now)
+		}
+		d.seen[sum] = loopSighting{first: now, count: 1}
+		return false
+	}
+	sighting.count++
+	d.seen[sum] = sighting
+	return sighting.count == loopRepeats
+}
+
+// prune forgets sightings older than the window, or everything if the
+// window still holds too many. The caller must hold mu.
+func (d *loopDetector) prune(now time.Time) {
+	for sum, sighting := range d.seen {
+		if now.Sub(sighting.first) > d.window {
+			delete(d.seen, sum)
+		}
+	}
+	if len(d.seen) >= loopMaxTracked {
+		d.seen = make(map[uint64]loopSighting)
+	}
+}
+
+// loopDetected counts a suspected forwarding loop and logs it, at most every
+// warnLogInterval
+func (r *Relay) loopDetected(clientKey string, size int) {
+	total := r.stats.loopsDetected.Add(1)
+	if !r.loopLog.allow(time.Now()) {
+		return
+	}
+	log.Printf("[%s] Warning: Possible forwarding loop: a %d-byte packet from %s was forwarded %d times within %s (%d suspected total); check that -target does not point back at a relay",
+		r.listenAddr, size, r.clientLabel(clientKey), loopRepeats, r.loops.window, total)
+}
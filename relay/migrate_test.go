@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitGoroutines fails the test unless the goroutine count falls back to
+// at most want within a few seconds
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines, want at most %d:\n%s", n, want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMigrationFlapsLeakNoGoroutines(t *testing.T) {
+	targets := []*net.UDPAddr{echoServer(t, nil), echoServer(t, net.IPv4(127, 0, 0, 2))}
+	r := runRelay(t, RelayConfig{Target: targets[0].String()})
+	baseline := runtime.NumGoroutine()
+
+	clients := make([]*net.UDPConn, 5)
+	for i := range clients {
+		clients[i] = relayClient(t, r, nil, net.IPv4(127, 0, 0, 1))
+		roundTrip(t, clients[i], "open")
+	}
+
+	// Flap between the two addresses as a DNS record might
+	for i := 0; i < 10; i++ {
+		r.migrateSessionsToNewTarget(context.Background(), targets[(i+1)%2])
+	}
+	for _, client := range clients {
+		if got := roundTrip(t, client, "after"); got != "after" {
+			t.Errorf("reply %q after migrating, want %q", got, "after")
+		}
+	}
+	if n := r.Sessions(); n != len(clients) {
+		t.Errorf("%d sessions after migrating, want %d", n, len(clients))
+	}
+
+	r.closeAllSessions()
+	waitGoroutines(t, baseline)
+}
+
+// TestConcurrentMigrateForwardCleanup migrates, forwards and removes
+// sessions all at once; run it with -race
+func TestConcurrentMigrateForwardCleanup(t *testing.T) {
+	targets := []*net.UDPAddr{echoServer(t, nil), echoServer(t, net.IPv4(127, 0, 0, 2))}
+	r := runRelay(t, RelayConfig{Target: targets[0].String()})
+	clients := make([]*net.UDPConn, 8)
+	for i := range clients {
+		clients[i] = relayClient(t, r, nil, net.IPv4(127, 0, 0, 1))
+	}
+
+	end := time.Now().Add(500 * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *net.UDPConn) {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for time.Now().Before(end) {
+				client.Write([]byte("ping"))
+				client.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+				client.Read(buf)
+			}
+		}(client)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; time.Now().Before(end); i++ {
+			r.migrateSessionsToNewTarget(context.Background(), targets[i%2])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(end) {
+			r.sessionsMu.RLock()
+			sessions := make(map[string]*ClientSession, len(r.sessions))
+			for key, session := range r.sessions {
+				sessions[key] = session
+			}
+			r.sessionsMu.RUnlock()
+			for key, session := range sessions {
+				r.closeSession(key, session)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	if n := r.stats.panics.Load(); n != 0 {
+		t.Errorf("%d panics recovered", n)
+	}
+	// Every client still gets through once replies in flight are drained
+	buf := make([]byte, 64)
+	for _, client := range clients {
+		for {
+			client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := client.Read(buf); err != nil {
+				break
+			}
+		}
+		if got := roundTrip(t, client, "after"); got != "after" {
+			t.Errorf("reply %q, want %q", got, "after")
+		}
+	}
+}
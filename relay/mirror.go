@@ -0,0 +1,29 @@
+package relay
+
+import (
+	"log"
+	"net"
+)
+
+// openMirror connects a session's -mirror-target socket. A mirror that can't
+// be reached only costs the session its copies, so failures are logged and
+// the session carries on without one.
+func (r *Relay) openMirror(clientKey string) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, r.mirrorAddr)
+	if err != nil {
+		log.Printf("[%s] Error opening -mirror-target socket for %s: %v", r.listenAddr, r.clientLabel(clientKey), err)
+		return nil
+	}
+	r.fds.add(1)
+	return conn
+}
+
+// mirrorPacket sends a copy of a client packet to -mirror-target. Nothing
+// reads the mirror's responses, which the kernel drops once the socket's
+// receive buffer is full, and write errors are ignored so the mirror can
+// never disturb the real session.
+func (r *Relay) mirrorPacket(session *ClientSession, data []byte) {
+	if _, err := session.mirrorConn.Write(data); err == nil {
+		r.stats.mirrored.Add(1)
+	}
+}
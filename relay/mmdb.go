@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader is a minimal reader for the MaxMind DB format used by GeoLite2
+// (https://maxmind.github.io/MaxMind-DB/), enough to look up records
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // Data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint // Node for ::/96, where IPv4 lives in IPv6 trees
+}
+
+// openMMDB loads a MaxMind DB file into memory
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(buf)
+}
+
+// parseMMDB reads the metadata and locates the sections of a MaxMind DB held
+// in buf
+func parseMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta, _, err := decodeMMDB(buf[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %v", err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount = uint(mmdbUint(m["node_count"]))
+	r.recordSize = uint(mmdbUint(m["record_size"]))
+	r.ipVersion = uint(mmdbUint(m["ip_version"]))
+	r.dbType, _ = m["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	// Compare node counts rather than sizes, which a bogus count could overflow
+	if r.nodeCount > uint(i)/(r.recordSize/4) {
+		return nil, errors.New("search tree exceeds file size")
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("search tree exceeds file size")
+	}
+	r.data = buf[treeSize+16 : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if there is none
+func (r *mmdbReader) lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	addr := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("invalid data pointer in search tree")
+	}
+	value, _, err := decodeMMDB(r.data, offset)
+	return value, err
+}
+
+// Limits on decoding one record, so a corrupt or hostile database whose
+// pointers form cycles, or fan out to the same values over and over, fails
+// instead of overflowing the stack or spinning
+const (
+	mmdbMaxDepth  = 32    // Values and pointers nested within each other
+	mmdbMaxValues = 10000 // Values decoded in total
+)
+
+// decodeMMDB decodes the data section value at offset, returning it and the
+// offset just past it
+func decodeMMDB(data []byte, offset uint) (any, uint, error) {
+	budget := mmdbMaxValues
+	return decodeMMDBValue(data, offset, 0, &budget)
+}
+
+func decodeMMDBValue(data []byte, offset uint, depth int, budget *int) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("values nested too deeply")
+	}
+	if *budget--; *budget < 0 {
+		return nil, 0, errors.New("record has too many values")
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	ctrl := data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	// Pointers encode their size differently and resolve elsewhere
+	if typ == 1 {
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if offset+ss+1 > uint(len(data)) {
+			return nil, 0, errors.New("truncated pointer")
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(data[offset])
+		case 1:
+			ptr = (vvv<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		value, _, err := decodeMMDBValue(data, ptr, depth+1, budget)
+		return value, offset + ss + 1, err
+	}
+
+	if typ == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("truncated extended type")
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("truncated size")
+		}
+		extra := uint(0)
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	// Every entry takes at least a byte, so a size larger than what is left
+	// is corrupt and must not be trusted for allocation
+	if (typ == 7 || typ == 11) && size > uint(len(data))-offset {
+		return nil, 0, errors.New("container larger than the data")
+	}
+
+	switch typ {
+	case 7: // Map
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMMDBValue(data, offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := decodeMMDBValue(data, next, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, _ := key.(string)
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // Array
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decodeMMDBValue(data, offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // Boolean, stored in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("truncated value")
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9, 10: // Unsigned integers (uint128 truncated to 64 bits)
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 4: // Bytes
+		return b, offset, nil
+	default: // Data cache container / end marker carry no value
+		return nil, offset, nil
+	}
+}
+
+// mmdbUint returns a decoded unsigned integer, or 0
+func mmdbUint(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// payloadTransform rewrites payloads on the server-facing side of the relay,
+// e.g. to obscure WireGuard from DPI between relay and server. The peer in
+// front of the server must apply the inverse.
+type payloadTransform interface {
+	encode(b []byte) // Towards the server, in place
+	decode(b []byte) // From the server, in place
+}
+
+// parseTransform parses an -obfuscate spec such as "xor:<hexkey>"
+func parseTransform(spec string) (payloadTransform, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "xor":
+		key, err := hex.DecodeString(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xor key: %v", err)
+		}
+		if len(key) == 0 {
+			return nil, errors.New("xor key must not be empty")
+		}
+		return xorTransform(key), nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q (expected xor:<hexkey>)", kind)
+	}
+}
+
+// xorTransform XORs each packet with a repeating key from its first byte.
+// It is its own inverse, so the server side runs the same transform.
+type xorTransform []byte
+
+func (t xorTransform) encode(b []byte) {
+	for i := range b {
+		b[i] ^= t[i%len(t)]
+	}
+}
+
+func (t xorTransform) decode(b []byte) {
+	t.encode(b)
+}
+
+// transformConn applies a payloadTransform to everything written to and read
+// from a server connection
+type transformConn struct {
+	net.Conn
+	transform payloadTransform
+}
+
+// Write encodes b for the wire and restores it afterwards, so callers keep
+// their plaintext (e.g. for captures)
+func (c *transformConn) Write(b []byte) (int, error) {
+	c.transform.encode(b)
+	n, err := c.Conn.Write(b)
+	c.transform.decode(b)
+	return n, err
+}
+
+func (c *transformConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.transform.decode(b[:n])
+	return n, err
+}
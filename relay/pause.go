@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"log"
+	"time"
+)
+
+// setPaused pauses or resumes forwarding, logging changes. While paused the
+// relay drops packets in both directions but keeps every session and its
+// server port, and sessions don't expire, so clients carry on without a new
+// handshake once forwarding resumes.
+func (r *Relay) setPaused(paused bool) {
+	if r.paused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		log.Printf("[%s] Forwarding paused: dropping packets, %d sessions kept", r.listenAddr, r.sessionCount())
+		return
+	}
+
+	// Time spent paused doesn't count towards the idle timeouts
+	now := time.Now()
+	r.sessionsMu.RLock()
+	for _, session := range r.sessions {
+		session.mu.Lock()
+		session.lastClient = now
+		session.lastServer = now
+		session.mu.Unlock()
+	}
+	r.sessionsMu.RUnlock()
+	log.Printf("[%s] Forwarding resumed (%d packets dropped while paused in total)", r.listenAddr, r.stats.pausedDrops.Load())
+}
+
+// droppedPaused reports whether forwarding is paused, counting the packet
+// being dropped if so
+func (r *Relay) droppedPaused() bool {
+	if !r.paused.Load() {
+		return false
+	}
+	r.stats.pausedDrops.Add(1)
+	return true
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package relay
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// pktinfoOOBSize is the control message space needed for IP_PKTINFO or
+// IPV6_PKTINFO, whichever is larger
+var pktinfoOOBSize = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePktinfo asks the kernel to report the destination address of every
+// datagram read from conn. Dual-stack sockets need both options: IPv4
+// datagrams only carry IP_PKTINFO, IPv6 ones only IPV6_PKTINFO.
+func enablePktinfo(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	if err := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	}); err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// parsePktinfo extracts the destination address of a datagram from the
+// control messages of a ReadMsgUDP call. The result does not alias oob.
+func parsePktinfo(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return net.IP(append([]byte(nil), info.Addr[:]...))
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return net.IP(append([]byte(nil), info.Addr[:]...))
+		}
+	}
+	return nil
+}
+
+// pktinfoOOB builds the control message that makes a WriteMsgUDP send from
+// source address ip
+func pktinfoOOB(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		hdr := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		hdr.Level = syscall.IPPROTO_IP
+		hdr.Type = syscall.IP_PKTINFO
+		hdr.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		copy(info.Spec_dst[:], ip4)
+		return oob
+	}
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	hdr := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = syscall.IPPROTO_IPV6
+	hdr.Type = syscall.IPV6_PKTINFO
+	hdr.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+	info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	copy(info.Addr[:], ip.To16())
+	return oob
+}
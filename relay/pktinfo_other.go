@@ -0,0 +1,26 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// pktinfoOOBSize is zero where IP_PKTINFO is not used
+var pktinfoOOBSize = 0
+
+// enablePktinfo is only supported on Linux
+func enablePktinfo(conn *net.UDPConn) error {
+	return errors.New("IP_PKTINFO is only supported on Linux")
+}
+
+// parsePktinfo never finds a destination address off Linux
+func parsePktinfo(oob []byte) net.IP {
+	return nil
+}
+
+// pktinfoOOB is never called off Linux, where enablePktinfo fails
+func pktinfoOOB(ip net.IP) []byte {
+	return nil
+}
@@ -0,0 +1,209 @@
+//go:build linux
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	pollMaxEvents  = 256  // Ready sockets taken per epoll_wait
+	pollMaxPasses  = 16   // Datagrams read from each ready socket per round
+	pollWaitMillis = 1000 // epoll_wait timeout, bounds how long shutdown takes to notice
+)
+
+// responsePoller implements -response-reader epoll: one goroutine per relay
+// waits on every session's server socket with epoll and reads them
+// round-robin, one datagram per ready socket per pass, so a session
+// saturating the relay can't starve quiet ones and no goroutine is needed
+// per session. Sockets are read through syscall.RawConn, which keeps a
+// descriptor from being closed and reused while it is being read.
+type responsePoller struct {
+	relay   *Relay
+	epfd    int
+	mu      sync.Mutex
+	entries map[int32]*pollEntry // Keyed by the token registered with epoll
+	next    int32
+	closed  bool
+}
+
+// pollEntry is one session's registered server connection
+type pollEntry struct {
+	raw       syscall.RawConn
+	session   *ClientSession
+	clientKey string
+}
+
+// newResponsePoller creates the epoll instance and starts its reader
+func newResponsePoller(ctx context.Context, r *Relay) (*responsePoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("creating epoll instance: %v", err)
+	}
+	p := &responsePoller{
+		relay:   r,
+		epfd:    epfd,
+		entries: make(map[int32]*pollEntry),
+	}
+	go p.run(ctx)
+	return p, nil
+}
+
+// add registers a session's server connection and returns its token
+func (p *responsePoller) add(session *ClientSession, clientKey string, conn net.Conn) (int32, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%T does not expose its socket", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, errors.New("poller stopped")
+	}
+	token := p.next + 1
+	for token <= 0 || p.entries[token] != nil {
+		token++
+	}
+	p.next = token
+
+	var ctlErr error
+	err = raw.Control(func(fd uintptr) {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: token}
+		ctlErr = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, int(fd), &event)
+	})
+	if err == nil {
+		err = ctlErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.entries[token] = &pollEntry{raw: raw, session: session, clientKey: clientKey}
+	return token, nil
+}
+
+// remove unregisters a connection before it is closed. A read already in
+// progress may still deliver one last response.
+func (p *responsePoller) remove(token int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := p.entries[token]
+	if entry == nil {
+		return
+	}
+	delete(p.entries, token)
+	if !p.closed {
+		entry.raw.Control(func(fd uintptr) {
+			syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+		})
+	}
+}
+
+// run waits for readable sockets and services them until ctx is cancelled
+func (p *responsePoller) run(ctx context.Context) {
+	defer func() {
+		p.mu.Lock()
+		p.closed = true
+		syscall.Close(p.epfd)
+		p.mu.Unlock()
+	}()
+
+	events := make([]syscall.EpollEvent, pollMaxEvents)
+	ready := make([]*pollEntry, 0, pollMaxEvents)
+	buffer := make([]byte, p.relay.responseBufferSize())
+	for ctx.Err() == nil {
+		n, err := syscall.EpollWait(p.epfd, events, pollWaitMillis)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			log.Printf("[%s] Response poller stopped: %v", p.relay.listenAddr, err)
+			return
+		}
+
+		ready = ready[:0]
+		p.mu.Lock()
+		for _, event := range events[:n] {
+			if entry := p.entries[event.Fd]; entry != nil {
+				ready = append(ready, entry)
+			}
+		}
+		p.mu.Unlock()
+
+		// Each pass reads one datagram from every socket that still has
+		// data; the rest waits for the next round, which level-triggered
+		// epoll reports again
+		for pass := 0; pass < pollMaxPasses && len(ready) > 0; pass++ {
+			pending := ready[:0]
+			for _, entry := range ready {
+				more, grown := p.readOne(entry, buffer)
+				if grown > len(buffer) {
+					buffer = make([]byte, grown)
+				}
+				if more {
+					pending = append(pending, entry)
+				}
+			}
+			ready = pending
+		}
+	}
+}
+
+// readOne reads and forwards one datagram from entry's socket without
+// blocking. It reports whether the socket may have more to read, and the
+// buffer size to use from now on when -buffer auto grew it.
+func (p *responsePoller) readOne(entry *pollEntry, buffer []byte) (more bool, grown int) {
+	r := p.relay
+	defer r.recoverPanic("server reader", entry.clientKey, entry.session)
+	var n int
+	var readErr error
+	err := entry.raw.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), buffer)
+		return true
+	})
+	if err != nil {
+		// Closed by a concurrent removal or migration
+		return false, 0
+	}
+	if readErr != nil {
+		if errors.Is(readErr, syscall.EAGAIN) {
+			return false, 0
+		}
+		if errors.Is(readErr, syscall.EINTR) {
+			return true, 0
+		}
+		if errors.Is(readErr, syscall.ECONNREFUSED) {
+			r.stats.connRefused.Add(1)
+			r.markTargetDown()
+			entry.session.mu.Lock()
+			refused := entry.session.toServerConn.RemoteAddr()
+			entry.session.mu.Unlock()
+			r.targetRefused(refused)
+			log.Printf("[%s] Target refused packets for %s, closing session", r.listenAddr, r.clientLabel(entry.clientKey))
+		} else {
+			log.Printf("Error reading from target for %s: %v", r.clientLabel(entry.clientKey), readErr)
+		}
+		entry.session.recordError("reading from server", classify(readErr))
+		r.closeSession(entry.clientKey, entry.session)
+		return false, 0
+	}
+
+	if err := r.forwardToClient(entry.session, entry.clientKey, buffer[:n]); err != nil {
+		r.forwardFailed("client", entry.session, entry.clientKey, n, err)
+	}
+	if n == len(buffer) {
+		entry.session.recordError("reading from server", truncatedError(n))
+		grown = r.bufferFilled("server", n)
+	}
+	return true, grown
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// responsePoller is only implemented on Linux
+type responsePoller struct{}
+
+func newResponsePoller(ctx context.Context, r *Relay) (*responsePoller, error) {
+	return nil, errors.New("-response-reader epoll is only supported on Linux")
+}
+
+func (p *responsePoller) add(session *ClientSession, clientKey string, conn net.Conn) (int32, error) {
+	return 0, errors.New("-response-reader epoll is only supported on Linux")
+}
+
+func (p *responsePoller) remove(token int32) {}
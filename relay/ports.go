@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// portExhaustedBackoff is how long new sessions are refused after the relay
+// runs out of source ports, so a flood of new clients can't keep the ports
+// that free up from going to sessions that already exist or are retrying
+const portExhaustedBackoff = time.Second
+
+// errNoSourcePort is returned when every port in -server-port-range is taken
+var errNoSourcePort = errors.New("no free source port")
+
+// portExhausted reports whether err, from opening a server connection, means
+// the relay ran out of source ports, in -server-port-range or in the kernel's
+// ephemeral port range
+func portExhausted(err error) bool {
+	return errors.Is(err, errNoSourcePort) || errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAGAIN)
+}
+
+// portsExhausted counts a session that couldn't get a source port and
+// refuses new sessions for portExhaustedBackoff, logging at most once per
+// warnLogInterval
+func (r *Relay) portsExhausted(clientKey string, err error) {
+	total := r.stats.portsExhausted.Add(1)
+	now := time.Now()
+	r.portsRefuseUntil.Store(now.Add(portExhaustedBackoff).UnixNano())
+	if !r.portsLog.allow(now) {
+		return
+	}
+	log.Printf("[%s] Error: Out of source ports opening a session for %s: %v; refusing new sessions for %s (%d failures in total). Widen -server-port-range or net.ipv4.ip_local_port_range",
+		r.listenAddr, r.clientLabel(clientKey), err, portExhaustedBackoff, total)
+}
+
+// refusingForPorts reports whether new sessions are being refused after
+// running out of source ports
+func (r *Relay) refusingForPorts(now time.Time) bool {
+	return now.UnixNano() < r.portsRefuseUntil.Load()
+}
@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// priorityClass orders clients for -priority-cidr when the relay is
+// overloaded: low-priority clients are refused, dropped and evicted first,
+// high-priority ones last
+type priorityClass int
+
+const (
+	priorityLow priorityClass = iota - 1
+	priorityNormal
+	priorityHigh
+)
+
+func (c priorityClass) String() string {
+	switch c {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// priorityRule assigns class to clients in network
+type priorityRule struct {
+	network *net.IPNet
+	class   priorityClass
+}
+
+// parsePriorityCIDRs parses -priority-cidr, comma-separated cidr=class pairs
+// with class low, normal or high, into rules ordered longest prefix first so
+// the most specific match wins
+func parsePriorityCIDRs(s string) ([]priorityRule, error) {
+	var rules []priorityRule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not cidr=class", entry)
+		}
+		networks, err := parseCIDRList(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if len(networks) != 1 {
+			return nil, fmt.Errorf("%q is not cidr=class", entry)
+		}
+		var class priorityClass
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "low":
+			class = priorityLow
+		case "normal":
+			class = priorityNormal
+		case "high":
+			class = priorityHigh
+		default:
+			return nil, fmt.Errorf("unknown priority class %q in %q (want low, normal or high)", name, entry)
+		}
+		rules = append(rules, priorityRule{network: networks[0], class: class})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, _ := rules[i].network.Mask.Size()
+		b, _ := rules[j].network.Mask.Size()
+		return a > b
+	})
+	return rules, nil
+}
+
+// clientPriority returns the class of a client at ip, priorityNormal unless
+// a -priority-cidr rule matches
+func (r *Relay) clientPriority(ip net.IP) priorityClass {
+	for _, rule := range r.priorities {
+		if rule.network.Contains(ip) {
+			return rule.class
+		}
+	}
+	return priorityNormal
+}
+
+// evictForLocked makes room for a new session of class by closing the
+// session of the lowest class below it, the longest idle first. It reports
+// whether one was evicted. The caller must hold sessionsMu.
+func (r *Relay) evictForLocked(class priorityClass) bool {
+	var victimKey string
+	var victim *ClientSession
+	var victimClass priorityClass
+	var victimActive time.Time
+	for key, session := range r.sessions {
+		if session.priority >= class {
+			continue
+		}
+		session.mu.Lock()
+		active := session.lastClient
+		if session.lastServer.After(active) {
+			active = session.lastServer
+		}
+		session.mu.Unlock()
+		if victim == nil || session.priority < victimClass ||
+			session.priority == victimClass && active.Before(victimActive) {
+			victimKey, victim, victimClass, victimActive = key, session, session.priority, active
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	r.removeSessionLocked(victimKey, victim)
+	r.stats.sessionsEvicted.Add(1)
+	log.Printf("[%s] Evicted %s-priority session %s (idle %s) to admit a %s-priority client",
+		r.listenAddr, victimClass, r.clientLabel(victimKey), time.Since(victimActive).Round(time.Second), class)
+	return true
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// holdForProbe reports whether an expired session should be kept a little
+// longer because -probe-before-close is probing the server for it. The first
+// time a session expires, the probe payload is sent to the server from the
+// session's socket; any answer within the probe grace period counts as
+// server traffic and keeps the session alive, while silence closes it once
+// the grace period is over. A probe that was answered is forgotten, so the
+// next expiry probes again.
+func (r *Relay) holdForProbe(session *ClientSession, clientKey string, now time.Time) bool {
+	if r.probeGrace <= 0 {
+		return false
+	}
+	session.mu.Lock()
+	send := session.probedAt.IsZero() || session.lastServer.After(session.probedAt)
+	if send {
+		session.probedAt = now
+	}
+	pending := now.Sub(session.probedAt) <= r.probeGrace
+	conn := session.toServerConn
+	session.mu.Unlock()
+
+	if send {
+		r.stats.idleProbes.Add(1)
+		r.logSession("[%s] Session %s is idle, probing server before closing it", r.listenAddr, r.clientLabel(clientKey))
+		// Callers may hold sessionsMu, which a slow write must not stall
+		go r.sendProbe(session, clientKey, conn)
+	}
+	return pending
+}
+
+// sendProbe writes the -probe-payload to the server over conn
+func (r *Relay) sendProbe(session *ClientSession, clientKey string, conn net.Conn) {
+	if r.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+	}
+	if _, err := conn.Write(r.probePayload); err != nil && !errors.Is(err, net.ErrClosed) {
+		session.recordError("probing server", classify(err))
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// overPPSLocked counts a packet against count, one of the session's
+// per-second packet counters, and reports whether that makes more than limit
+// this second. Counting in whole-second windows is enough to stop a flood
+// and costs nothing to track. The caller must hold s.mu.
+func (s *ClientSession) overPPSLocked(now time.Time, count *int, limit int) bool {
+	if second := now.Unix(); second != s.ppsSecond {
+		s.ppsSecond = second
+		s.ppsToServer, s.ppsToClient = 0, 0
+	}
+	*count++
+	return *count > limit
+}
+
+// ppsLimited counts a packet dropped by -max-pps-per-session, logging at
+// most once per warnLogInterval
+func (r *Relay) ppsLimited(direction, clientKey string, limit int) {
+	r.stats.dropped.Add(1)
+	total := r.stats.ppsLimited.Add(1)
+	if !r.ppsLog.allow(time.Now()) {
+		return
+	}
+	log.Printf("[%s] Session %s exceeded %d packets/s to %s; dropping the excess (%d dropped total)",
+		r.listenAddr, r.clientLabel(clientKey), limit, direction, total)
+}
+
+// tokenBucket is a simple thread-safe token bucket rate limiter
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket refilling at rate tokens per second
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	return b.allowAbove(0)
+}
+
+// allowPriority is allow for a client of class: a low-priority client only
+// gets a token while at least half the burst remains, and a high-priority
+// one may overdraw the bucket by half the burst, slowing everyone else down
+// until it refills
+func (b *tokenBucket) allowPriority(class priorityClass) bool {
+	reserve := math.Floor(b.burst / 2)
+	switch class {
+	case priorityLow:
+		return b.allowAbove(reserve)
+	case priorityHigh:
+		return b.allowAbove(-reserve)
+	default:
+		return b.allowAbove(0)
+	}
+}
+
+// allowAbove takes a token if at least floor tokens are left afterwards
+func (b *tokenBucket) allowAbove(floor float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens-1 < floor {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,219 @@
+//go:build linux
+
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpHeaderSize is the length of a UDP header
+const udpHeaderSize = 8
+
+// rawForwarder implements the experimental -mode raw: instead of a socket per
+// session, a single raw IPv4 socket sends UDP packets whose source port is
+// picked per session from -server-port-range (software SNAT), and demuxes
+// server responses by destination port. Needs CAP_NET_RAW. The kernel has no
+// socket for those ports, so it may answer server replies with ICMP port
+// unreachable; WireGuard ignores these, but they can be filtered.
+type rawForwarder struct {
+	relay  *Relay
+	conn   *net.IPConn
+	mu     sync.RWMutex
+	target *net.UDPAddr
+	ports  map[int]string // Local port -> client key
+	next   int            // Rotating offset into the port range
+}
+
+// newRawForwarder opens the raw socket for target and starts its reader
+func newRawForwarder(ctx context.Context, r *Relay, target *net.UDPAddr) (*rawForwarder, error) {
+	if target.IP.To4() == nil {
+		return nil, errors.New("raw mode only supports IPv4 targets")
+	}
+	conn, err := net.ListenIP("ip4:udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening raw socket (needs CAP_NET_RAW): %v", err)
+	}
+	if r.fwmark != 0 {
+		raw, err := conn.SyscallConn()
+		if err == nil {
+			err = setFwmark(raw, r.fwmark)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("setting -fwmark on raw socket: %v", err)
+		}
+	}
+	f := &rawForwarder{
+		relay:  r,
+		conn:   conn,
+		target: target,
+		ports:  make(map[int]string),
+	}
+	go f.run(ctx)
+	return f, nil
+}
+
+// attach reserves a source port for a session, preferring localPort if set
+func (f *rawForwarder) attach(clientKey string, localPort int) (net.Conn, error) {
+	r := f.relay
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if localPort > 0 {
+		if _, used := f.ports[localPort]; used {
+			return nil, fmt.Errorf("source port %d already in use", localPort)
+		}
+		f.ports[localPort] = clientKey
+		return &rawConn{forwarder: f, port: localPort}, nil
+	}
+
+	size := r.serverPortMax - r.serverPortMin + 1
+	for i := 0; i < size; i++ {
+		port := r.serverPortMin + (f.next+i)%size
+		if _, used := f.ports[port]; !used {
+			f.next = (f.next + i + 1) % size
+			f.ports[port] = clientKey
+			return &rawConn{forwarder: f, port: port}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w in range %d-%d", errNoSourcePort, r.serverPortMin, r.serverPortMax)
+}
+
+// release frees a session's source port
+func (f *rawForwarder) release(port int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.ports, port)
+}
+
+// retarget points every session at a new target address
+func (f *rawForwarder) retarget(target *net.UDPAddr) error {
+	if target.IP.To4() == nil {
+		return errors.New("raw mode only supports IPv4 targets")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.target = target
+	return nil
+}
+
+// currentTarget returns the address sessions are forwarded to
+func (f *rawForwarder) currentTarget() *net.UDPAddr {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.target
+}
+
+// send writes payload to the target from the given source port
+func (f *rawForwarder) send(port int, payload []byte) (int, error) {
+	target := f.currentTarget()
+
+	packet := make([]byte, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(packet[0:2], uint16(port))
+	binary.BigEndian.PutUint16(packet[2:4], uint16(target.Port))
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)))
+	// A zero checksum means "none" for UDP over IPv4
+	copy(packet[udpHeaderSize:], payload)
+
+	if _, err := f.conn.WriteToIP(packet, &net.IPAddr{IP: target.IP}); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// run reads UDP packets from the raw socket and delivers those from the
+// target to the session owning their destination port
+func (f *rawForwarder) run(ctx context.Context) {
+	r := f.relay
+	buffer := make([]byte, r.responseBufferSize()+udpHeaderSize)
+
+	for {
+		n, addr, err := f.conn.ReadFromIP(buffer)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[%s] Error reading from raw socket: %v", r.listenAddr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if n < udpHeaderSize {
+			continue
+		}
+		srcPort := int(binary.BigEndian.Uint16(buffer[0:2]))
+		dstPort := int(binary.BigEndian.Uint16(buffer[2:4]))
+		length := int(binary.BigEndian.Uint16(buffer[4:6]))
+		if length >= udpHeaderSize && length < n {
+			n = length
+		}
+
+		// The raw socket sees every UDP packet for this host
+		f.mu.RLock()
+		fromTarget := srcPort == f.target.Port && addr.IP.Equal(f.target.IP)
+		clientKey, ok := f.ports[dstPort]
+		f.mu.RUnlock()
+		if !fromTarget || !ok {
+			continue
+		}
+
+		session := r.lookupSession(clientKey)
+		if session == nil {
+			r.stats.unroutable.Add(1)
+			continue
+		}
+		func() {
+			defer r.recoverPanic("server packet", clientKey, session)
+			if err := r.forwardToClient(session, clientKey, buffer[udpHeaderSize:n]); err != nil {
+				r.forwardFailed("client", session, clientKey, n-udpHeaderSize, err)
+			}
+		}()
+		if n == len(buffer) {
+			if size := r.bufferFilled("server", n-udpHeaderSize); size > n-udpHeaderSize {
+				buffer = make([]byte, size+udpHeaderSize)
+			}
+		}
+	}
+}
+
+// close shuts down the raw socket
+func (f *rawForwarder) close() {
+	f.conn.Close()
+}
+
+// rawConn is a session's source port on the raw forwarder
+type rawConn struct {
+	forwarder *rawForwarder
+	port      int
+	closeOnce sync.Once
+}
+
+func (c *rawConn) Write(b []byte) (int, error) {
+	return c.forwarder.send(c.port, b)
+}
+
+// Read is never used: the forwarder's reader delivers responses
+func (c *rawConn) Read(b []byte) (int, error) {
+	return 0, errors.New("read on raw mode server connection")
+}
+
+func (c *rawConn) Close() error {
+	c.closeOnce.Do(func() { c.forwarder.release(c.port) })
+	return nil
+}
+
+func (c *rawConn) LocalAddr() net.Addr  { return &net.UDPAddr{Port: c.port} }
+func (c *rawConn) RemoteAddr() net.Addr { return c.forwarder.currentTarget() }
+
+func (c *rawConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rawConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rawConn) SetWriteDeadline(t time.Time) error { return c.forwarder.conn.SetWriteDeadline(t) }
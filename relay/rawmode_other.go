@@ -0,0 +1,23 @@
+//go:build !linux
+
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// rawForwarder is only implemented on Linux
+type rawForwarder struct{}
+
+func newRawForwarder(ctx context.Context, r *Relay, target *net.UDPAddr) (*rawForwarder, error) {
+	return nil, errors.New("raw mode is only supported on Linux")
+}
+
+func (f *rawForwarder) attach(clientKey string, localPort int) (net.Conn, error) {
+	return nil, errors.New("raw mode is only supported on Linux")
+}
+
+func (f *rawForwarder) retarget(target *net.UDPAddr) error { return nil }
+func (f *rawForwarder) close()                             {}
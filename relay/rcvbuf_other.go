@@ -0,0 +1,17 @@
+//go:build !unix
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Setting the receive buffer at bind time is only implemented on Unix
+func setRcvbuf(c syscall.RawConn, size int) error {
+	return errors.New("-port-rcvbuf is only supported on Unix")
+}
+
+func grantedRcvbuf(c syscall.RawConn) (int, error) {
+	return 0, errors.New("-port-rcvbuf is only supported on Unix")
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package relay
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// setRcvbuf requests a socket receive buffer of size bytes
+func setRcvbuf(c syscall.RawConn, size int) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// grantedRcvbuf returns the receive buffer the kernel actually gave a socket,
+// comparable to the size requested
+func grantedRcvbuf(c syscall.RawConn) (int, error) {
+	var size int
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		return 0, err
+	}
+	if runtime.GOOS == "linux" {
+		// Linux doubles the requested size to leave room for bookkeeping
+		size /= 2
+	}
+	return size, sockErr
+}
@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Pauses after a failed read on a listening socket. Each consecutive error
+// doubles the pause, from readErrorBackoffMin up to -read-error-backoff, so
+// a persistent error such as ENOBUFS can't spin the CPU.
+const (
+	readErrorBackoffMin     = 5 * time.Millisecond
+	readErrorBackoffDefault = time.Second
+)
+
+// readBackoff paces a read loop through transient errors and keeps them from
+// flooding the log: an error is logged at most once per kernelDropLogInterval,
+// with how many were left out since.
+type readBackoff struct {
+	relay      *Relay
+	what       string // Socket being read, for log lines
+	delay      time.Duration
+	suppressed int
+	lastLog    time.Time
+}
+
+// wait logs err and sleeps for the current backoff, returning early if ctx
+// is cancelled
+func (b *readBackoff) wait(ctx context.Context, err error) {
+	r := b.relay
+	if time.Since(b.lastLog) >= kernelDropLogInterval {
+		if b.suppressed > 0 {
+			log.Printf("[%s] Error reading from %s: %v (%d more errors since the last report)", r.listenAddr, b.what, err, b.suppressed)
+		} else {
+			log.Printf("[%s] Error reading from %s: %v", r.listenAddr, b.what, err)
+		}
+		b.suppressed = 0
+		b.lastLog = time.Now()
+	} else {
+		b.suppressed++
+	}
+
+	limit := r.readErrorBackoff
+	if limit <= 0 {
+		limit = readErrorBackoffDefault
+	}
+	if b.delay < readErrorBackoffMin {
+		b.delay = readErrorBackoffMin
+	} else if b.delay *= 2; b.delay > limit {
+		b.delay = limit
+	}
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// reset ends the backoff after a successful read
+func (b *readBackoff) reset() {
+	if b.delay != 0 {
+		b.delay = 0
+	}
+}
@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// recoverPanic is deferred at the top of packet and session goroutines. With
+// -recover-panics it stops a panic there from crashing the process: the panic
+// is counted and logged with its stack, and session, if given, is closed so
+// the client starts over with a fresh one while every other session carries
+// on. Locks held across code that may panic are released with defer, so they
+// are free again by the time the panic reaches here.
+func (r *Relay) recoverPanic(where, clientKey string, session *ClientSession) {
+	if !r.recoverPanics {
+		return
+	}
+	p := recover()
+	if p == nil {
+		return
+	}
+	total := r.stats.panics.Add(1)
+	log.Printf("[%s] Recovered panic in %s for %s (%d total): %v\n%s",
+		r.listenAddr, where, r.clientLabel(clientKey), total, p, debug.Stack())
+	if session != nil {
+		r.closeSession(clientKey, session)
+	}
+}
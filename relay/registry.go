@@ -0,0 +1,163 @@
+package relay
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionKey identifies a session across all relays
+type sessionKey struct {
+	listen string // Relay listen address
+	client string // Client address
+}
+
+// registeredSession is one entry of the process-wide session registry
+type registeredSession struct {
+	relay   *Relay
+	session *ClientSession
+}
+
+// sessionRegistry is a process-wide index of every relay's sessions, used
+// for views that span relays. Relays keep their own session maps and locks
+// for the packet path and only touch the registry when sessions come and go.
+// Lock order: Relay.sessionsMu, then sessionRegistry.mu, then ClientSession.mu.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[sessionKey]registeredSession
+	perIP    map[string]int // Sessions per client IP, for -max-sessions-per-ip
+}
+
+// newSessionRegistry returns an empty registry
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[sessionKey]registeredSession),
+		perIP:    make(map[string]int),
+	}
+}
+
+// tryRegister records a new session of r on listen, its listen address or
+// that of its TCP bridge, unless the client IP already has perIP sessions
+// across all relays (0 = unlimited). Checking and counting under one lock
+// keeps relays on different ports from both admitting the last session an
+// IP is allowed.
+func (g *sessionRegistry) tryRegister(r *Relay, listen, clientKey string, session *ClientSession, perIP int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := sessionKey{listen, clientKey}
+	ip := session.clientAddr.IP.String()
+	if _, replaced := g.sessions[key]; !replaced {
+		if perIP > 0 && g.perIP[ip] >= perIP {
+			return false
+		}
+		g.perIP[ip]++
+	}
+	g.sessions[key] = registeredSession{relay: r, session: session}
+	return true
+}
+
+// remove forgets a session registered on listen, unless it has been
+// replaced by a newer one
+func (g *sessionRegistry) remove(listen, clientKey string, session *ClientSession) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := sessionKey{listen, clientKey}
+	if g.sessions[key].session == session {
+		delete(g.sessions, key)
+		ip := session.clientAddr.IP.String()
+		if g.perIP[ip]--; g.perIP[ip] <= 0 {
+			delete(g.perIP, ip)
+		}
+	}
+}
+
+// ipSessions returns how many sessions the client IP has across all relays
+func (g *sessionRegistry) ipSessions(ip string) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.perIP[ip]
+}
+
+// ipCounts returns the session count of every client IP with a session,
+// labelled by label
+func (g *sessionRegistry) ipCounts(label func(string) string) map[string]int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	counts := make(map[string]int, len(g.perIP))
+	for ip, n := range g.perIP {
+		counts[label(ip)] = n
+	}
+	return counts
+}
+
+// sessionInfo is the admin API view of a session
+type sessionInfo struct {
+	Listen     string        `json:"listen"`
+	Client     string        `json:"client"`
+	LocalPort  int           `json:"local_port"`
+	CreatedAt  time.Time     `json:"created_at"`
+	AgeSeconds int64         `json:"age_seconds"`
+	LastClient time.Time     `json:"last_client"`
+	LastServer time.Time     `json:"last_server"`
+	Idle       bool          `json:"idle,omitempty"`
+	Priority   string        `json:"priority,omitempty"` // -priority-cidr class, unless normal
+	LastError  *sessionError `json:"last_error,omitempty"`
+	geoInfo
+}
+
+// sessionError is the most recent forwarding error of a session
+type sessionError struct {
+	Message string    `json:"message"`
+	Kind    string    `json:"kind,omitempty"` // Class of the error, e.g. "timeout", if known
+	At      time.Time `json:"at"`
+}
+
+// snapshot describes every registered session, ordered by listen address
+// and client. Client addresses are hashed when the relay hashes them in logs.
+func (g *sessionRegistry) snapshot() []sessionInfo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	infos := make([]sessionInfo, 0, len(g.sessions))
+	for key, entry := range g.sessions {
+		session := entry.session
+		session.mu.Lock()
+		info := sessionInfo{
+			Listen:     key.listen,
+			Client:     entry.relay.clientLabel(key.client),
+			CreatedAt:  session.createdAt,
+			AgeSeconds: int64(time.Since(session.createdAt).Seconds()),
+			LastClient: session.lastClient,
+			LastServer: session.lastServer,
+			Idle:       session.idle,
+			geoInfo:    session.geo,
+		}
+		if session.priority != priorityNormal {
+			info.Priority = session.priority.String()
+		}
+		if session.lastError != nil {
+			info.LastError = &sessionError{
+				Message: session.lastErrorOp + ": " + session.lastError.Error(),
+				Kind:    errorKind(session.lastError),
+				At:      session.lastErrorAt,
+			}
+		}
+		if addr, ok := session.toServerConn.LocalAddr().(*net.UDPAddr); ok {
+			info.LocalPort = addr.Port
+		}
+		session.mu.Unlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Listen != infos[j].Listen {
+			return infos[i].Listen < infos[j].Listen
+		}
+		return infos[i].Client < infos[j].Client
+	})
+	return infos
+}
@@ -0,0 +1,2143 @@
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ClientSession represents an active client connection with SNAT mapping.
+// Lock order is Relay.sessionsMu before ClientSession.mu; mu guards every
+// field below that changes after the session is created.
+type ClientSession struct {
+	clientAddr   *net.UDPAddr  // Original client address
+	createdAt    time.Time     // When the session was opened
+	priority     priorityClass // Class of the client under -priority-cidr, fixed at creation
+	toServerConn net.Conn      // Connection to WireGuard server (has ephemeral port)
+	lastClient   time.Time     // Last packet received from the client
+	lastServer   time.Time     // Last packet received from the server
+	readerStop   chan struct{} // Closed to tell the current response handler to exit, nil when polled
+	readerDone   chan struct{} // Closed by the current response handler when it exits, nil when polled
+	pollToken    int32         // Registration with the relay's responsePoller, 0 if none
+	closed       bool          // Set once the session has been removed
+	idle         bool          // Past its idle timeout but kept until -hard-timeout
+	geo          geoInfo       // Client country/ASN from -geoip-db, set at creation
+	outbound     chan []byte   // Responses queued for the client writer (-client-queue), nil if unused
+	writerQuit   chan struct{} // Closed when the session is removed to stop the client writer
+	firstPacket  []byte        // First client packet, resent by -first-packet-retries until the server answers
+	replyOOB     []byte        // IP_PKTINFO control message sending replies from the address the client used, nil if unneeded
+	span         *sessionSpan  // OpenTelemetry span from creation to close, nil unless -otlp-endpoint
+	mirrorConn   *net.UDPConn  // Copies of client packets go here with -mirror-target, nil if none
+	lastError    error         // Most recent forwarding error in either direction, for the admin API
+	lastErrorOp  string        // What failed with lastError, e.g. "sending to client"
+	lastErrorAt  time.Time
+	probedAt     time.Time // When -probe-before-close last probed the server for this session
+
+	// Consecutive failed writes to the client, for -reap-dead-clients
+	clientFailures atomic.Int32
+
+	// Packets in the current second, for -max-pps-per-session
+	ppsSecond   int64 // Unix second being counted
+	ppsToServer int
+	ppsToClient int
+
+	// Extra server connections for -duplicate-targets, and the responses
+	// seen recently across all of them; nil unless the flag is set
+	dupConns []net.Conn
+	recent   *dedupWindow
+
+	// WireGuard keepalive tracking for -wg-aware
+	lastKeepalive     time.Time     // When the client last sent a keepalive
+	lastWasKeepalive  bool          // Whether the client's previous packet was a keepalive
+	keepaliveInterval time.Duration // Observed persistent keepalive interval, 0 if unknown
+	mu                sync.Mutex
+}
+
+// kernelDropLogInterval limits how often kernel receive drops are logged
+const kernelDropLogInterval = 10 * time.Second
+
+// Read buffer sizes. With -buffer auto, buffers start at the common WireGuard
+// packet size and double on truncation up to the largest UDP payload.
+const (
+	autoBufferInitial = 1500
+	maxBufferSize     = 65535
+)
+
+// sessionSummaryInterval is how often -log-sessions=false logs aggregate
+// session counts in place of individual session events
+const sessionSummaryInterval = time.Minute
+
+// sessionRecreateWindow is how soon after a session closes a new session for
+// the same client is logged as recreated
+const sessionRecreateWindow = time.Minute
+
+// Server response readers
+const (
+	responseReaderGoroutine = "goroutine" // A reader goroutine per session
+	responseReaderEpoll     = "epoll"     // One epoll loop per relay, reading sessions round-robin (Linux only)
+)
+
+// Forwarding modes
+const (
+	forwardModeConn = "conn" // A UDP socket per session (or per port, see -server-conn-mode)
+	forwardModeRaw  = "raw"  // Experimental: one raw socket with software SNAT (Linux only)
+)
+
+// Relay manages UDP packet forwarding with SNAT
+type Relay struct {
+	listenAddr       string
+	listenPort       int
+	replyPort        int // Local port responses to clients are sent from (0 = the listen port)
+	targetAddr       string
+	targetPort       int // Overrides the port of every resolved target address when non-zero
+	timeout          time.Duration
+	clientIdle       time.Duration // Idle timeout for the client -> server direction
+	serverIdle       time.Duration // Idle timeout for the server -> client direction
+	idleGrace        time.Duration // How long past the idle timeouts sessions are kept, marked idle (-hard-timeout)
+	hibernate        time.Duration // How long expired sessions' source ports are kept for reuse (-session-hibernate, 0 = not at all)
+	probeGrace       time.Duration // How long an expired session waits for the server to answer a probe (-probe-before-close, 0 = no probe)
+	readErrorBackoff time.Duration // Longest pause after repeated listen socket read errors (0 = readErrorBackoffDefault)
+	listenWake       time.Duration // Longest a listen socket read blocks before the loop wakes for housekeeping (0 = until a packet arrives)
+	probePayload     []byte        // Sent to the server by -probe-before-close
+	cleanupInterval  time.Duration // How often expired sessions are swept
+	summaryInterval  time.Duration // How often throughput is logged (0 = never)
+	bufferSize       int
+	bufferAuto       bool         // Grow read buffers on truncation (-buffer auto)
+	autoBufferSize   atomic.Int64 // Current read buffer size with -buffer auto, 0 until grown
+	responseBuffer   int          // Fixed read buffer for server responses (-response-buffer), 0 follows -buffer
+	dnsCheckInterval time.Duration
+	hashClients      bool          // Replace client addresses in logs with a salted hash
+	quietSessions    bool          // Log periodic session summaries instead of each session event
+	clientHashSalt   []byte        // HMAC key used when hashing client addresses
+	serverConnMode   string        // serverConnPerSession or serverConnPerPort
+	pool             *serverPool   // Shared server connection in per-port mode
+	forwardMode      string        // forwardModeConn or forwardModeRaw
+	raw              *rawForwarder // Raw socket forwarder in raw mode
+	upstreamSocks    string        // Optional SOCKS5 proxy used to reach the target
+	targetAllow      []*net.IPNet  // Resolved target IPs must be in one of these (-target-allow-cidr), nil allows any
+	targetPorts      []int         // Ports of a host:port1,port2 target, failed over in turn; nil for one port
+	targetPortIdx    atomic.Int32  // Index of the port new sessions use in targetPorts
+	serverPortMin    int           // Inclusive source port range for server connections (0 = ephemeral)
+	serverPortMax    int
+	serverPortNext   atomic.Uint32 // Rotating offset into the server port range
+	stickyPorts      bool          // Derive each session's source port from its client address
+	fwmark           int           // SO_MARK set on server-facing sockets (0 = none)
+	transparent      bool          // Send to the server from each client's own address instead of SNAT (-transparent)
+	rcvbuf           int           // SO_RCVBUF set on the listening socket before it binds (0 = OS default)
+	freebind         bool          // Set IP_FREEBIND on the listening socket, to bind addresses not assigned yet
+	listenSockopts   []sockopt     // -listen-sockopt options set on the listening socket before it binds
+	serverSockopts   []sockopt     // -server-sockopt options set on server-facing sockets
+	sharedPort       bool          // Another -ports entry binds the same port on a different address (SO_REUSEADDR)
+	recoverPanics    bool          // Log and count panics in packet and session goroutines instead of crashing
+	inlineForward    bool          // Forward packets for existing sessions from the read loop
+	dropEmpty        bool          // Drop zero-length datagrams instead of forwarding them
+	requireHandshake bool          // Only a WireGuard handshake initiation may open a session
+	wgAware          bool          // Expire sessions from their observed WireGuard keepalive interval
+	writeTimeout     time.Duration // Deadline for each forwarding write (0 = none)
+	clientQueue      int           // Per-session outbound queue depth (0 = write inline)
+	maxPerIP         int           // Sessions allowed per client IP across all listen ports (0 = unlimited)
+	dnsFailureLimit  int           // Consecutive DNS failures before the relay reports not ready (0 = never)
+	dnsVerbose       bool          // Log every DNS re-check of the target with its timing
+	deadClientLimit  int           // Consecutive failed writes to a client before the sweep reaps its session (0 = never)
+	firstRetries     int           // Times to resend a new session's first packet while unanswered (0 = never)
+	firstRetryDelay  time.Duration // Wait before each first packet resend
+	timeoutLog       logThrottle   // Throttles write timeout warnings
+	shortLog         logThrottle   // Throttles short write warnings
+	linkLog          logThrottle   // Throttles -relay-link-key rejection warnings
+	ppsLog           logThrottle   // Throttles -max-pps-per-session drop warnings
+	familyLog        logThrottle   // Throttles -transparent family mismatch warnings
+	paused           atomic.Bool   // Set by POST /pause: drop packets but keep sessions
+	portsLog         logThrottle   // Throttles source port exhaustion warnings
+	portsRefuseUntil atomic.Int64  // Unix nanoseconds until which new sessions are refused after running out of source ports
+	maxPPS           int           // Client -> server packets per second allowed per session (0 = unlimited)
+	maxPPSServer     int           // Server -> client packets per second allowed per session (0 = unlimited)
+	loopLog          logThrottle   // Throttles suspected loop warnings
+	truncationWarned atomic.Bool   // Set once a buffer-filling packet has been reported
+	sessionLimiter   *tokenBucket  // Caps the new session rate when set
+	listenLimiter    *tokenBucket  // Caps packets read from the listen port when -xdp-rate can't use XDP
+	xdp              *xdpLimiter   // Drops packets past -xdp-rate in the kernel, nil if unused; shared by all relays
+	slowSetup        time.Duration // Log new sessions whose first forward takes longer than this
+	jitter           float64       // Max fraction of an interval added to periodic timers
+	rng              *rand.Rand    // Jitter source, seeded per relay
+	rngMu            sync.Mutex
+	transform        payloadTransform          // Applied to server-facing payloads, nil for none
+	link             *relayLink                // Authenticates the link to a chained relay (-relay-link-key), nil for none
+	mirrorAddr       *net.UDPAddr              // Where -mirror-target copies client packets, nil for none
+	duplicateAddrs   []*net.UDPAddr            // Extra targets every client packet is also sent to (-duplicate-targets)
+	priorities       []priorityRule            // -priority-cidr classes, most specific first; nil treats every client alike
+	responseReader   string                    // responseReaderGoroutine or responseReaderEpoll
+	poller           *responsePoller           // Reads every session's server socket with -response-reader epoll
+	listenConn       *net.UDPConn              // Main listening connection
+	replyConn        *net.UDPConn              // Where responses to clients are sent from: listenConn, or the -reply-port socket
+	sessions         map[string]*ClientSession // Keyed by client address
+	recentlyClosed   map[string]time.Time      // When sessions closed, kept for sessionRecreateWindow; guarded by sessionsMu
+	hibernated       map[string]hibernation    // Expired sessions' source ports, kept for -session-hibernate; guarded by sessionsMu
+	opening          map[string]struct{}       // Clients whose server connection is being dialed; guarded by sessionsMu
+	sessionsMu       sync.RWMutex
+	targetConn       *net.UDPAddr
+	targetConnMu     sync.RWMutex
+	migrateMu        sync.Mutex     // Serializes migrations when DNS flaps
+	capture          *packetCapture // Shared single-client packet capture, may be nil
+	ready            chan struct{}  // Closed once Start is listening or has failed
+	readyOnce        sync.Once
+	running          atomic.Bool      // Whether Start is listening
+	fds              *fdBudget        // Process-wide descriptor accounting, shared by all relays
+	registry         *sessionRegistry // Process-wide session index, shared by all relays
+	geo              *geoIP           // Client enrichment from -geoip-db, nil if disabled
+	tracer           *otlpTracer      // Session span exporter for -otlp-endpoint, nil if disabled
+	loops            *loopDetector    // Process-wide forwarding loop detection, nil if disabled
+	persistSessions  bool             // Snapshot sessions into savedSessions on shutdown
+	restoreSessions  []savedSession   // Sessions to re-create on startup
+	savedSessions    []savedSession
+	health           targetHealth // Observed target state for the admin API
+	stats            relayStats
+
+	runMu  sync.Mutex
+	cancel context.CancelFunc // Stops Run, nil when not running
+}
+
+// start runs the relay until ctx is cancelled
+func (r *Relay) start(ctx context.Context) error {
+	// Background work ends with the relay, even when it fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Resolve target address
+	targetAddr, err := r.resolveTarget()
+	if err != nil {
+		return err
+	}
+	if !r.targetAllowed(targetAddr.IP) {
+		return fmt.Errorf("%s resolved to %s, outside -target-allow-cidr", r.targetAddr, targetAddr.IP)
+	}
+	targetAddr = r.reachableTarget(ctx, targetAddr)
+	r.targetConnMu.Lock()
+	r.targetConn = targetAddr
+	r.targetConnMu.Unlock()
+	r.markTargetResolved()
+
+	// Create listening socket
+	listenAddr, err := net.ResolveUDPAddr("udp", r.listenAddr)
+	if err != nil {
+		return err
+	}
+	if r.transparent && listenAddr.IP != nil && !listenAddr.IP.IsUnspecified() && !sameFamily(listenAddr.IP, targetAddr.IP) {
+		return fmt.Errorf("-transparent can't relay %s clients to %s target %s", ipFamily(listenAddr.IP), ipFamily(targetAddr.IP), targetAddr)
+	}
+
+	listenConn, err := r.listenUDP(listenAddr)
+	if err != nil {
+		return err
+	}
+	defer listenConn.Close()
+
+	r.listenConn = listenConn
+	r.listenPort = listenAddr.Port
+	r.fds.add(1)
+	defer r.fds.add(-1)
+
+	// Responses leave from the listen port unless -reply-port moves them
+	r.replyConn = listenConn
+	if r.replyPort != 0 && r.replyPort != listenAddr.Port {
+		replyConn, err := r.openReplyConn(listenAddr)
+		if err != nil {
+			return fmt.Errorf("opening -reply-port %d: %w", r.replyPort, err)
+		}
+		defer replyConn.Close()
+		r.fds.add(1)
+		defer r.fds.add(-1)
+		r.replyConn = replyConn
+		log.Printf("[%s] Sending responses to clients from port %d", r.listenAddr, r.replyPort)
+	}
+
+	if r.cleanupInterval <= 0 {
+		r.cleanupInterval = defaultCleanupInterval(r.clientIdle, r.serverIdle)
+	}
+
+	if r.serverConnMode == serverConnPerPort {
+		pool, err := newServerPool(ctx, r, targetAddr)
+		if err != nil {
+			return err
+		}
+		defer pool.close()
+		r.fds.add(1)
+		defer r.fds.add(-1)
+		r.pool = pool
+		log.Printf("[%s] Sharing one server connection from %s across sessions", r.listenAddr, pool.current().LocalAddr())
+	}
+
+	if r.forwardMode == forwardModeRaw {
+		raw, err := newRawForwarder(ctx, r, targetAddr)
+		if err != nil {
+			return err
+		}
+		defer raw.close()
+		r.fds.add(1)
+		defer r.fds.add(-1)
+		r.raw = raw
+		log.Printf("[%s] EXPERIMENTAL raw mode: forwarding from ports %d-%d over one raw socket; the kernel may answer server replies with ICMP port unreachable",
+			r.listenAddr, r.serverPortMin, r.serverPortMax)
+	}
+
+	if r.responseReader == responseReaderEpoll {
+		poller, err := newResponsePoller(ctx, r)
+		if err != nil {
+			return err
+		}
+		r.fds.add(1)
+		defer r.fds.add(-1)
+		r.poller = poller
+	}
+
+	log.Printf("UDP relay started: %s -> %s (%s)", r.listenAddr, r.targetAddr, targetAddr.IP.String())
+	if r.upstreamSocks != "" {
+		log.Printf("[%s] Forwarding via SOCKS5 proxy %s", r.listenAddr, socks5DisplayAddr(r.upstreamSocks))
+	}
+
+	// Start DNS monitoring goroutine; a literal IP target never changes
+	if !r.targetIsIP() {
+		go r.monitorDNS(ctx)
+	}
+
+	// Start session cleanup goroutine
+	go r.cleanupSessions(ctx)
+	if r.quietSessions {
+		go r.summarizeSessions(ctx)
+	}
+	if r.summaryInterval > 0 {
+		go r.summarizeThroughput(ctx)
+	}
+
+	r.running.Store(true)
+	r.markReady()
+
+	// Unblock the read loop on shutdown
+	go func() {
+		<-ctx.Done()
+		listenConn.Close()
+		r.replyConn.Close()
+	}()
+	if r.replyConn != listenConn {
+		go r.serveReplyPort(ctx)
+	}
+
+	// Re-create sessions saved by a previous run
+	if len(r.restoreSessions) > 0 {
+		r.restore(ctx, targetAddr)
+	}
+
+	// Track kernel receive queue drops where supported
+	oobSize := 0
+	if err := enableRxqOverflow(listenConn); err == nil {
+		oobSize += rxqOverflowOOBSize
+	} else {
+		log.Printf("[%s] Kernel drop counter unavailable: %v", r.listenAddr, err)
+	}
+
+	// A wildcard listener's replies would leave from whichever address the
+	// kernel picks, which on multi-address hosts or behind a hairpinning NAT
+	// may not be the one the client sent to; learn that address per packet
+	// so sessions can reply from it
+	pktinfo := false
+	if listenAddr.IP == nil || listenAddr.IP.IsUnspecified() {
+		if err := enablePktinfo(listenConn); err == nil {
+			pktinfo = true
+			oobSize += pktinfoOOBSize
+		} else {
+			log.Printf("[%s] Replies will use the kernel's choice of source address: %v", r.listenAddr, err)
+		}
+	}
+	oob := make([]byte, oobSize)
+	var lastOverflow, unloggedDrops uint32
+	var lastDropLog time.Time
+	logDrops := func() {
+		log.Printf("[%s] Kernel dropped %d packets before they were read (total %d); consider raising net.core.rmem_max/rmem_default",
+			r.listenAddr, unloggedDrops, lastOverflow)
+		unloggedDrops = 0
+		lastDropLog = time.Now()
+	}
+
+	// Main packet handling loop
+	buffer := make([]byte, r.readBufferSize())
+	backoff := readBackoff{relay: r, what: "clients"}
+	wake := listenWaker{conn: listenConn, interval: r.listenWake}
+	for {
+		wake.arm(time.Now())
+		n, oobn, _, clientAddr, err := listenConn.ReadMsgUDP(buffer, oob)
+		if err != nil {
+			if ctx.Err() != nil {
+				r.stopServing()
+				return nil
+			}
+			if wake.woke(err) {
+				// Quiet for a while: pick up a buffer grown by a server
+				// reader, and report drops held back by the aggregation
+				if size := r.readBufferSize(); size > len(buffer) {
+					buffer = make([]byte, size)
+				}
+				if unloggedDrops > 0 && time.Since(lastDropLog) >= kernelDropLogInterval {
+					logDrops()
+				}
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// Closed under the relay rather than for shutdown; no
+				// further read can succeed, so let the caller decide
+				r.stopServing()
+				return fmt.Errorf("listen socket closed: %w", err)
+			}
+			backoff.wait(ctx, err)
+			continue
+		}
+		backoff.reset()
+
+		if oobn > 0 {
+			if overflow, ok := parseRxqOverflow(oob[:oobn]); ok && overflow != lastOverflow {
+				delta := overflow - lastOverflow
+				lastOverflow = overflow
+				unloggedDrops += delta
+				r.stats.kernelDropped.Add(uint64(delta))
+
+				// Aggregate drop logs so sustained overload doesn't flood the log
+				if time.Since(lastDropLog) >= kernelDropLogInterval {
+					logDrops()
+				}
+			}
+		}
+
+		// A grown buffer is used from the next read on; packet stays valid
+		packet := buffer[:n]
+		if n == len(buffer) {
+			if size := r.bufferFilled("client", n); size > n {
+				buffer = make([]byte, size)
+			}
+		}
+
+		packet, ok := r.acceptClientPacket(packet, clientAddr)
+		if !ok {
+			continue
+		}
+		n = len(packet)
+
+		// Fast path: forward straight from the shared buffer when the session
+		// already exists, since the write completes before the next read
+		if r.inlineForward {
+			clientKey := clientAddr.String()
+			if session := r.lookupSession(clientKey); session != nil {
+				if r.droppedPaused() {
+					continue
+				}
+				if err := r.forwardToServer(session, clientKey, packet); err != nil {
+					r.forwardFailed("server", session, clientKey, len(packet), err)
+				}
+				continue
+			}
+		}
+
+		// Make a copy of the packet data for the goroutine
+		dataCopy := make([]byte, n)
+		copy(dataCopy, packet)
+		var localIP net.IP
+		if pktinfo && oobn > 0 {
+			localIP = parsePktinfo(oob[:oobn])
+		}
+
+		// Handle packet in goroutine for concurrency
+		go r.handleClientPacket(ctx, dataCopy, clientAddr, localIP, time.Now())
+	}
+}
+
+// acceptClientPacket makes the checks every client packet passes before it
+// reaches a session: the -xdp-rate fallback limit, the relay link tag and
+// -drop-empty. It returns the payload to forward, or false if the packet was
+// dropped and counted. It does no I/O.
+func (r *Relay) acceptClientPacket(packet []byte, clientAddr *net.UDPAddr) ([]byte, bool) {
+	if r.listenLimiter != nil && !r.listenLimiter.allowPriority(r.clientPriority(clientAddr.IP)) {
+		r.stats.listenRateDropped.Add(1)
+		return nil, false
+	}
+
+	// Packets from a relay in front of this one carry a link tag
+	if r.link != nil && r.link.side == relayLinkClient {
+		payload, ok := r.link.open(linkToServer, packet)
+		if !ok {
+			r.linkRejected(r.clientLabel(clientAddr.String()))
+			return nil, false
+		}
+		packet = payload
+	}
+
+	// Zero-length datagrams are forwarded like any other packet, refreshing
+	// the session as keepalives, unless -drop-empty asks to discard them
+	if len(packet) == 0 && r.dropEmpty {
+		r.stats.emptyDropped.Add(1)
+		return nil, false
+	}
+	return packet, true
+}
+
+// markReady signals that Start has finished starting up, successfully or not
+func (r *Relay) markReady() {
+	r.readyOnce.Do(func() { close(r.ready) })
+}
+
+// handleClientPacket processes a packet from a client with SNAT
+// localIP is the address the client sent to, if known, and receivedAt is
+// when the packet was read, used to time new session setup.
+func (r *Relay) handleClientPacket(ctx context.Context, data []byte, clientAddr *net.UDPAddr, localIP net.IP, receivedAt time.Time) {
+	clientKey := clientAddr.String()
+	defer r.recoverPanic("client packet", clientKey, nil)
+	if r.droppedPaused() {
+		return
+	}
+
+	// Look up a new client's location before taking the session lock
+	var geo geoInfo
+	if r.geo != nil {
+		r.sessionsMu.RLock()
+		_, known := r.sessions[clientKey]
+		r.sessionsMu.RUnlock()
+		if !known {
+			geo = r.geo.lookup(clientAddr.IP)
+		}
+	}
+
+	// Get or create session
+	session, exists := r.clientSession(ctx, data, clientAddr, localIP, geo, receivedAt)
+	if session == nil {
+		return
+	}
+
+	if err := r.forwardToServer(session, clientKey, data); err != nil {
+		r.forwardFailed("server", session, clientKey, len(data), err)
+	}
+	if !exists && r.firstRetries > 0 {
+		go r.resendFirstPacket(ctx, session, clientKey)
+	}
+
+	// Only new sessions pay for the timing; the steady-state path skips it
+	if !exists {
+		setup := time.Since(receivedAt)
+		r.stats.sessionSetup.observe(setup)
+		if r.slowSetup > 0 && setup > r.slowSetup {
+			log.Printf("[%s] Slow session setup for %s: first packet forwarded after %s",
+				r.listenAddr, r.clientLabel(clientKey), setup)
+		}
+	}
+}
+
+// clientSession returns the session of clientAddr, opening one if the client
+// is new and may have one, and whether it already existed. It returns nil if
+// the packet is to be dropped. The server connection is dialed without
+// sessionsMu, since a -upstream-socks handshake can take seconds; the client
+// is reserved in r.opening meanwhile, and its packets dropped.
+func (r *Relay) clientSession(ctx context.Context, data []byte, clientAddr *net.UDPAddr, localIP net.IP,
+	geo geoInfo, receivedAt time.Time) (*ClientSession, bool) {
+	clientKey := clientAddr.String()
+	session, exists, targetConn, localPort := r.reserveSession(ctx, data, clientAddr, receivedAt)
+	if targetConn == nil {
+		return session, exists
+	}
+
+	// Create connection TO server (gets ephemeral source port), or
+	// reopen a hibernated session from its old port if still free
+	toServerConn, err := r.openServerConn(clientKey, targetConn, localPort)
+	if err != nil && localPort != 0 {
+		r.logSession("[%s] Source port %d of hibernated session %s is taken, using another: %v",
+			r.listenAddr, localPort, r.clientLabel(clientKey), err)
+		toServerConn, err = r.openServerConn(clientKey, targetConn, 0)
+	}
+
+	// sessionsMu is released with defer so that a panic recovered by the
+	// caller cannot leave it held
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	delete(r.opening, clientKey)
+	if err != nil {
+		if portExhausted(err) {
+			r.portsExhausted(clientKey, err)
+		} else {
+			log.Printf("Error creating server connection for %s: %v", r.clientLabel(clientKey), err)
+		}
+		r.stats.dropped.Add(1)
+		return nil, false
+	}
+	// Shutdown may have closed every session while the dial was running
+	if ctx.Err() != nil {
+		toServerConn.Close()
+		return nil, false
+	}
+
+	session, err = r.addSession(ctx, clientKey, clientAddr, localIP, geo, toServerConn, targetConn)
+	if err != nil {
+		toServerConn.Close()
+		r.stats.dropped.Add(1)
+		return nil, false
+	}
+	if r.firstRetries > 0 {
+		session.mu.Lock()
+		session.firstPacket = append([]byte(nil), data...)
+		session.mu.Unlock()
+	}
+	return session, false
+}
+
+// reserveSession returns the existing session of clientAddr, or decides
+// under sessionsMu whether the client may open one. If it may, the client is
+// added to r.opening and reserveSession returns the target to dial and the
+// hibernated source port to reuse (0 for any); otherwise the target is nil.
+func (r *Relay) reserveSession(ctx context.Context, data []byte, clientAddr *net.UDPAddr,
+	receivedAt time.Time) (session *ClientSession, exists bool, target *net.UDPAddr, localPort int) {
+	clientKey := clientAddr.String()
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	if session, exists := r.sessions[clientKey]; exists {
+		return session, true, nil, 0
+	}
+
+	// Don't open new sessions once shutdown has begun, nor a second one
+	// while the client's first is being dialed
+	if ctx.Err() != nil {
+		return nil, false, nil, 0
+	}
+	if _, opening := r.opening[clientKey]; opening {
+		r.stats.dropped.Add(1)
+		return nil, false, nil, 0
+	}
+
+	if r.admitSession(data, clientAddr, r.clientPriority(clientAddr.IP), receivedAt) != nil {
+		return nil, false, nil, 0
+	}
+
+	// Get current target address
+	r.targetConnMu.RLock()
+	targetConn := r.targetConn
+	r.targetConnMu.RUnlock()
+
+	// -transparent sends from the client's own address, which can't
+	// reach a target of the other family
+	if r.transparent && !sameFamily(clientAddr.IP, targetConn.IP) {
+		r.familyMismatch(clientKey, clientAddr.IP, targetConn.IP)
+		r.stats.dropped.Add(1)
+		return nil, false, nil, 0
+	}
+
+	r.opening[clientKey] = struct{}{}
+	return nil, false, targetConn, r.wakePortLocked(clientKey)
+}
+
+// admitSession decides whether a packet from clientAddr, of priority class,
+// may open a session, counting and returning the reason when it may not:
+// ErrNotHandshake, or ErrSessionLimit for the limits on new sessions. The
+// caller must hold sessionsMu.
+func (r *Relay) admitSession(data []byte, clientAddr *net.UDPAddr, class priorityClass, now time.Time) error {
+	// Scanners and stray traffic get no server connection; a WireGuard
+	// client always opens with a handshake initiation
+	if r.requireHandshake {
+		if msgType, ok := wgMessageType(data); !ok || msgType != wgMessageInitiation {
+			r.stats.notHandshake.Add(1)
+			return ErrNotHandshake
+		}
+	}
+
+	// A target drained for maintenance takes no new clients
+	if r.health.drained.Load() {
+		r.stats.sessionsDrained.Add(1)
+		return fmt.Errorf("%w: target drained", ErrSessionLimit)
+	}
+
+	// Stop one IP from fanning out over many source ports. This is only an
+	// early check to skip dialing; addSession enforces the limit.
+	if r.maxPerIP > 0 && r.registry.ipSessions(clientAddr.IP.String()) >= r.maxPerIP {
+		r.stats.sessionsIPLimited.Add(1)
+		return fmt.Errorf("%w: %d sessions per IP", ErrSessionLimit, r.maxPerIP)
+	}
+
+	// Refuse new sessions beyond the configured rate; existing sessions
+	// never reach this point and keep forwarding at full speed
+	if r.sessionLimiter != nil && !r.sessionLimiter.allowPriority(class) {
+		r.stats.sessionsLimited.Add(1)
+		return fmt.Errorf("%w: new session rate", ErrSessionLimit)
+	}
+
+	// Refuse cleanly near the descriptor limit rather than failing to dial;
+	// a client can take the place of a session of a lower priority class
+	if !r.sharedServerSocket() && !r.fds.admitPriority(class) {
+		if !r.evictForLocked(class) || !r.fds.admitPriority(class) {
+			r.stats.sessionsFDLimited.Add(1)
+			return fmt.Errorf("%w: file descriptors", ErrSessionLimit)
+		}
+	}
+
+	// Back off for a moment after running out of source ports; high-priority
+	// clients still try
+	if class < priorityHigh && r.refusingForPorts(now) {
+		r.stats.sessionsNoPort.Add(1)
+		return fmt.Errorf("%w: out of source ports", ErrSessionLimit)
+	}
+	return nil
+}
+
+// addSession registers a session using toServerConn and starts its response
+// handler. Replies are sent from localIP when it is set; geo is the client's
+// -geoip-db location. It returns ErrSessionLimit, leaving toServerConn to the
+// caller, if the client IP has reached -max-sessions-per-ip. The caller must
+// hold sessionsMu.
+func (r *Relay) addSession(ctx context.Context, clientKey string, clientAddr *net.UDPAddr, localIP net.IP,
+	geo geoInfo, toServerConn net.Conn, target *net.UDPAddr) (*ClientSession, error) {
+	now := time.Now()
+	session := &ClientSession{
+		clientAddr:   clientAddr,
+		createdAt:    now,
+		geo:          geo,
+		priority:     r.clientPriority(clientAddr.IP),
+		toServerConn: toServerConn,
+		lastClient:   now,
+		lastServer:   now,
+	}
+	if !r.registry.tryRegister(r, r.listenAddr, clientKey, session, r.maxPerIP) {
+		r.stats.sessionsIPLimited.Add(1)
+		return nil, fmt.Errorf("%w: %d sessions per IP", ErrSessionLimit, r.maxPerIP)
+	}
+	if localIP != nil {
+		session.replyOOB = pktinfoOOB(localIP)
+	}
+	if r.mirrorAddr != nil {
+		session.mirrorConn = r.openMirror(clientKey)
+	}
+	if len(r.duplicateAddrs) > 0 {
+		session.recent = new(dedupWindow)
+		r.openDuplicates(ctx, session, clientKey)
+	}
+	if r.clientQueue > 0 {
+		session.outbound = make(chan []byte, r.clientQueue)
+		session.writerQuit = make(chan struct{})
+		go r.runClientWriter(session, clientKey)
+	}
+	r.sessions[clientKey] = session
+	r.countSessionFD(1)
+	r.stats.sessionsCreated.Add(1)
+
+	var location string
+	if s := geo.String(); s != "" {
+		location = " (" + s + ")"
+	}
+	localPort := toServerConn.LocalAddr().(*net.UDPAddr).Port
+	r.logSession("[%s] New session: %s%s -> ephemeral:%d -> %s",
+		r.listenAddr, r.clientLabel(clientKey), location, localPort, target.String())
+	session.span = r.tracer.startSpan(
+		stringAttr("relay.listen", r.listenAddr),
+		stringAttr("client.address", r.clientLabel(clientKey)),
+		stringAttr("server.address", target.String()),
+		intAttr("relay.source_port", int64(localPort)))
+
+	// A client coming straight back usually means its session was reaped or
+	// failed while it was still active, e.g. a too-short timeout
+	if closedAt, ok := r.recentlyClosed[clientKey]; ok {
+		delete(r.recentlyClosed, clientKey)
+		r.stats.sessionsRecreated.Add(1)
+		r.logSession("[%s] Session for %s recreated %s after the previous one closed",
+			r.listenAddr, r.clientLabel(clientKey), now.Sub(closedAt).Round(time.Millisecond))
+	}
+
+	// Start goroutine to handle responses from target; in per-port and raw
+	// modes the shared socket's reader delivers responses instead
+	if !r.sharedServerSocket() {
+		r.startReader(ctx, session, clientKey)
+	}
+	return session, nil
+}
+
+// startReader launches the response handler for the session's current server
+// connection. Only one handler runs per session; migration stops the old one
+// via readerStop and waits on readerDone before calling this again. With
+// -response-reader epoll the connection is registered with the relay's poller
+// instead, falling back to a goroutine if that fails. The caller must hold
+// session.mu or own the session exclusively.
+func (r *Relay) startReader(ctx context.Context, session *ClientSession, clientKey string) {
+	if r.poller != nil {
+		token, err := r.poller.add(session, clientKey, session.toServerConn)
+		if err == nil {
+			session.pollToken = token
+			session.readerStop, session.readerDone = nil, nil
+			return
+		}
+		log.Printf("[%s] Could not poll server connection for %s, using a reader goroutine: %v", r.listenAddr, r.clientLabel(clientKey), err)
+	}
+	session.pollToken = 0
+	session.readerStop = make(chan struct{})
+	session.readerDone = make(chan struct{})
+	go r.handleTargetResponses(ctx, session, clientKey, session.toServerConn, session.readerStop, session.readerDone)
+}
+
+// lookupSession returns the existing session for clientKey, or nil
+func (r *Relay) lookupSession(clientKey string) *ClientSession {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+
+	return r.sessions[clientKey]
+}
+
+// forwardToServer sends a client packet to the server over the session's
+// ephemeral connection, returning why it wasn't sent for forwardFailed. data
+// is not retained after it returns. Framing, such as a SOCKS5 header or a
+// -relay-link-key tag, is added by the connection, which sends it alongside
+// data with writeDatagram.
+func (r *Relay) forwardToServer(session *ClientSession, clientKey string, data []byte) error {
+	// Update client-side activity time and take the current connection;
+	// migration may swap it, and a removed session must not be written to
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		return ErrSessionClosed
+	}
+	now := time.Now()
+	if r.maxPPS > 0 && session.overPPSLocked(now, &session.ppsToServer, r.maxPPS) {
+		session.mu.Unlock()
+		return ErrRateLimited
+	}
+	session.lastClient = now
+	if r.wgAware {
+		observeKeepalive(session, data, now)
+	}
+	conn := session.toServerConn
+	session.mu.Unlock()
+
+	if r.loops != nil && r.loops.observe(data, now) {
+		r.loopDetected(clientKey, len(data))
+	}
+
+	if r.capture.capturing() {
+		r.capture.record(session.clientAddr, r.listenConn.LocalAddr().(*net.UDPAddr), session.clientAddr, data)
+	}
+
+	// SNAT: Forward packet to server through ephemeral port connection
+	// Server sees: (relay_ip, ephemeral_port) -> (server_ip, server_port)
+	if r.writeTimeout > 0 {
+		conn.SetWriteDeadline(now.Add(r.writeTimeout))
+	}
+	n, err := conn.Write(data)
+	// Copied after the real write so the mirror never delays it
+	if session.mirrorConn != nil {
+		r.mirrorPacket(session, data)
+	}
+	if session.dupConns != nil {
+		r.writeDuplicates(session, data)
+	}
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			// Closed by a concurrent migration or removal
+			return &classifiedError{class: ErrSessionClosed, err: err}
+		}
+		return classify(err)
+	}
+	if n != len(data) {
+		return shortWriteError(n, len(data))
+	}
+	r.stats.packetsToServer.Add(1)
+	r.stats.bytesToServer.Add(uint64(n))
+	r.stats.toServerSizes.observe(n)
+	session.span.countToServer(n)
+	return nil
+}
+
+// forwardFailed accounts for a packet that forwardToServer or forwardToClient
+// couldn't send to direction: it counts the drop under err's class, keeps err
+// as the session's last error and logs what needs attention. size is the
+// packet's length.
+func (r *Relay) forwardFailed(direction string, session *ClientSession, clientKey string, size int, err error) {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		limit := r.maxPPS
+		if direction == "client" {
+			limit = r.maxPPSServer
+		}
+		r.ppsLimited(direction, clientKey, limit)
+		return
+	case errors.Is(err, ErrShortWrite):
+		// The receiver got a truncated packet rather than none
+		r.shortWrite(direction, session, clientKey, err)
+		return
+	}
+	r.stats.dropped.Add(1)
+	switch {
+	case errors.Is(err, ErrSessionClosed):
+		return
+	case errors.Is(err, ErrQueueFull):
+		r.stats.queueDropped.Add(1)
+		return
+	}
+
+	op := "sending to client"
+	if direction == "server" {
+		op = "forwarding to server"
+	}
+	session.recordError(op, err)
+	if errors.Is(err, ErrTimeout) {
+		r.writeTimedOut(direction, clientKey)
+		return
+	}
+	if direction == "client" {
+		// A saturated send buffer says nothing about the client; other
+		// errors in a row mean it can no longer be reached
+		session.clientFailures.Add(1)
+		log.Printf("Error sending to client %s: %v", r.clientLabel(clientKey), redactAddrs(err))
+		return
+	}
+	if errors.Is(err, ErrPacketTooBig) {
+		// The packet exceeds the path MTU towards the server and was dropped
+		log.Printf("[%s] MTU problem forwarding %d-byte packet for %s: %v (consider lowering the WireGuard MTU)",
+			r.listenAddr, size, r.clientLabel(clientKey), err)
+		return
+	}
+	log.Printf("Error forwarding to target for %s: %v", r.clientLabel(clientKey), err)
+}
+
+// resendFirstPacket resends a new session's first packet every
+// firstRetryDelay, up to firstRetries times, until the server answers. A cold
+// server path (routing, ARP) can lose the first packet, which is usually a
+// WireGuard handshake initiation the client would otherwise only retry after
+// 5 seconds. Resending stops early once the client sends anything else, so an
+// older packet never overtakes a newer one.
+func (r *Relay) resendFirstPacket(ctx context.Context, session *ClientSession, clientKey string) {
+	defer r.recoverPanic("first packet resend", clientKey, session)
+	session.mu.Lock()
+	sentAt := session.lastClient
+	session.mu.Unlock()
+
+	timer := time.NewTimer(r.firstRetryDelay)
+	defer timer.Stop()
+	for attempt := 1; attempt <= r.firstRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		session.mu.Lock()
+		data := session.firstPacket
+		if session.closed || data == nil || !session.lastClient.Equal(sentAt) {
+			session.firstPacket = nil
+			session.mu.Unlock()
+			return
+		}
+		conn := session.toServerConn
+		session.mu.Unlock()
+
+		if r.writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+		}
+		n, err := conn.Write(data)
+		if err != nil {
+			r.stats.dropped.Add(1)
+			return
+		}
+		if n != len(data) {
+			r.shortWrite("server", session, clientKey, shortWriteError(n, len(data)))
+			return
+		}
+		r.stats.firstResends.Add(1)
+		r.stats.packetsToServer.Add(1)
+		r.stats.bytesToServer.Add(uint64(n))
+		r.stats.toServerSizes.observe(n)
+		r.logSession("[%s] No response yet for %s, resent first packet (%d/%d)",
+			r.listenAddr, r.clientLabel(clientKey), attempt, r.firstRetries)
+		timer.Reset(r.firstRetryDelay)
+	}
+
+	session.mu.Lock()
+	session.firstPacket = nil
+	session.mu.Unlock()
+}
+
+// listenUDP binds the relay's listening socket. With -port-rcvbuf the
+// receive buffer is set in the Control hook, before bind, so it already
+// covers the first handshakes to arrive; the size the kernel granted is
+// logged, as it may cap the request. Ports shared with another relay get
+// SO_REUSEADDR there too.
+func (r *Relay) listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if r.rcvbuf <= 0 && !r.freebind && !r.sharedPort && len(r.listenSockopts) == 0 {
+		return net.ListenUDP("udp", addr)
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if r.sharedPort {
+			if err := setReuseAddr(c); err != nil {
+				return err
+			}
+		}
+		if r.freebind {
+			if err := setFreebind(c); err != nil {
+				return fmt.Errorf("-freebind: %v", err)
+			}
+		}
+		if r.rcvbuf > 0 {
+			if err := setRcvbuf(c, r.rcvbuf); err != nil {
+				return fmt.Errorf("-port-rcvbuf %d: %v", r.rcvbuf, err)
+			}
+		}
+		// Last, so an option given here wins over the dedicated flags
+		if len(r.listenSockopts) > 0 {
+			if err := setSockopts(c, network, r.listenSockopts); err != nil {
+				return fmt.Errorf("-listen-sockopt: %v", err)
+			}
+		}
+		return nil
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if r.rcvbuf <= 0 {
+		return conn, nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err == nil {
+		var granted int
+		if granted, err = grantedRcvbuf(raw); err == nil {
+			if granted < r.rcvbuf {
+				log.Printf("[%s] Warning: Receive buffer capped at %d bytes, %d requested (raise net.core.rmem_max)", r.listenAddr, granted, r.rcvbuf)
+			} else {
+				log.Printf("[%s] Receive buffer set to %d bytes", r.listenAddr, granted)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("[%s] Could not read back the receive buffer size: %v", r.listenAddr, err)
+	}
+	return conn, nil
+}
+
+// readBufferSize returns the size to allocate read buffers with
+func (r *Relay) readBufferSize() int {
+	if n := r.autoBufferSize.Load(); r.bufferAuto && n > 0 {
+		return int(n)
+	}
+	return r.bufferSize
+}
+
+// responseBufferSize returns the size to allocate server response read
+// buffers with: -response-buffer if set, otherwise the same as client reads
+func (r *Relay) responseBufferSize() int {
+	if r.responseBuffer > 0 {
+		return r.responseBuffer
+	}
+	return r.readBufferSize()
+}
+
+// bufferFilled counts a packet that filled the whole size-byte read buffer
+// and returns the size to read the next packet with. UDP drops whatever
+// doesn't fit, so such packets were most likely truncated. With -buffer auto
+// the buffer grows; otherwise the first truncation is reported loudly since
+// a too-small -buffer fails silently.
+func (r *Relay) bufferFilled(from string, size int) int {
+	r.stats.bufferTruncations.Add(1)
+	auto, option := r.bufferAuto, "-buffer"
+	if from == "server" && r.responseBuffer > 0 {
+		auto, option = false, "-response-buffer"
+	}
+	if auto && size < maxBufferSize {
+		return r.growBuffer(from, size)
+	}
+	if r.truncationWarned.CompareAndSwap(false, true) {
+		log.Printf("[%s] WARNING: a packet from the %s filled the entire %d-byte buffer and was probably truncated. "+
+			"Truncated WireGuard packets are discarded by the peer, so the tunnel will not work; "+
+			"raise %s above the largest packet (WireGuard MTU + 32 bytes, e.g. 1500). Further truncations are counted as buffer_truncations",
+			r.listenAddr, from, size, option)
+	}
+	return size
+}
+
+// growBuffer doubles the -buffer auto size past size, up to maxBufferSize,
+// and returns the new size. Readers that hit the same limit concurrently
+// grow it only once; each reallocates its own buffer for its next read.
+func (r *Relay) growBuffer(from string, size int) int {
+	grown := int64(size) * 2
+	if grown > maxBufferSize {
+		grown = maxBufferSize
+	}
+	for {
+		stored := r.autoBufferSize.Load()
+		current := stored
+		if current == 0 {
+			current = int64(r.bufferSize)
+		}
+		if current >= grown {
+			return int(current)
+		}
+		if r.autoBufferSize.CompareAndSwap(stored, grown) {
+			log.Printf("[%s] Truncated packet from the %s: grew read buffers from %d to %d bytes (-buffer auto)",
+				r.listenAddr, from, current, grown)
+			return int(grown)
+		}
+	}
+}
+
+// writeTimedOut counts a forwarding write that hit -write-timeout, logging at
+// most once per warnLogInterval since timeouts come in bursts when a
+// send buffer is saturated
+func (r *Relay) writeTimedOut(direction, clientKey string) {
+	total := r.stats.writeTimeouts.Add(1)
+	if !r.timeoutLog.allow(time.Now()) {
+		return
+	}
+	log.Printf("[%s] Write to %s for %s timed out after %s (%d timeouts total); the send buffer may be saturated",
+		r.listenAddr, direction, r.clientLabel(clientKey), r.writeTimeout, total)
+}
+
+// truncatedError describes a packet that filled the whole size-byte read
+// buffer
+func truncatedError(size int) error {
+	return fmt.Errorf("%w: filled the %d-byte buffer", ErrTruncated, size)
+}
+
+// shortWriteError describes a write that sent written of size bytes
+func shortWriteError(written, size int) error {
+	return fmt.Errorf("%w: %d of %d bytes", ErrShortWrite, written, size)
+}
+
+// shortWrite counts a write that sent fewer bytes than the packet held, as
+// described by err from shortWriteError. UDP sends whole datagrams or fails,
+// so this points at a broken socket or wrapper; the receiver got a truncated
+// packet. It is logged at most once per warnLogInterval.
+func (r *Relay) shortWrite(direction string, session *ClientSession, clientKey string, err error) {
+	total := r.stats.shortWrites.Add(1)
+	if session != nil {
+		session.recordError("sending to "+direction, err)
+	}
+	if !r.shortLog.allow(time.Now()) {
+		return
+	}
+	log.Printf("[%s] Warning: Write to %s for %s: %v (%d short writes total)",
+		r.listenAddr, direction, r.clientLabel(clientKey), err, total)
+}
+
+// openServerConn returns the server-facing connection for a new session:
+// its own ephemeral connection, or a view of the relay's shared connection
+// in per-port mode
+func (r *Relay) openServerConn(clientKey string, target *net.UDPAddr, localPort int) (net.Conn, error) {
+	if r.pool != nil {
+		return r.pool.attach(clientKey), nil
+	}
+	if localPort == 0 && r.stickyPorts {
+		// A port taken by another client whose address hashes the same
+		// falls back to the rotating choice below
+		if conn, err := r.openServerConn(clientKey, target, r.stickyPort(clientKey)); err == nil {
+			return conn, nil
+		}
+		r.stats.stickyCollisions.Add(1)
+	}
+	if r.raw != nil {
+		return r.raw.attach(clientKey, localPort)
+	}
+	if r.transparent {
+		return r.dialTransparent(clientKey, target)
+	}
+	return r.dialServer(target, localPort)
+}
+
+// dialTransparent opens a -transparent server connection bound to the
+// client's own address, so the server sees the client rather than the relay.
+// Its responses are addressed to the client, and reach this socket only if
+// routing delivers them to the relay host and then locally.
+func (r *Relay) dialTransparent(clientKey string, target *net.UDPAddr) (net.Conn, error) {
+	client, err := net.ResolveUDPAddr("udp", clientKey)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{LocalAddr: client, Control: r.withServerSockopts(transparentControl(r.fwmark))}
+	conn, err := dialer.Dial("udp", target.String())
+	if err != nil {
+		return nil, err
+	}
+	return r.wrapServerConn(conn), nil
+}
+
+// stickyPort returns the source port -sticky-ports assigns to clientKey. It
+// depends only on the client address and the port range, so a client that
+// returns after a restart reaches the server from the same port it used
+// before, matching the endpoint the server still has cached for its peer.
+func (r *Relay) stickyPort(clientKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(clientKey))
+	size := uint32(r.serverPortMax - r.serverPortMin + 1)
+	return r.serverPortMin + int(h.Sum32()%size)
+}
+
+// dialServer opens a new server-facing connection to target. The connection
+// is direct unless an upstream SOCKS5 proxy is configured. A non-zero
+// localPort requests a specific source port, e.g. when restoring sessions.
+// Payloads are transformed when -obfuscate is set.
+func (r *Relay) dialServer(target *net.UDPAddr, localPort int) (net.Conn, error) {
+	conn, err := r.dialServerConn(target, localPort)
+	if err != nil {
+		return nil, err
+	}
+	return r.wrapServerConn(conn), nil
+}
+
+// wrapServerConn applies -obfuscate and, on the server side of a
+// -relay-link-key link, authentication to a new server connection. Packets
+// are tagged before they are obfuscated.
+func (r *Relay) wrapServerConn(conn net.Conn) net.Conn {
+	if r.transform != nil {
+		conn = &transformConn{Conn: conn, transform: r.transform}
+	}
+	if r.link != nil && r.link.side == relayLinkServer {
+		conn = &linkConn{Conn: conn, relay: r}
+	}
+	return conn
+}
+
+// dialServerConn opens the underlying connection for dialServer
+func (r *Relay) dialServerConn(target *net.UDPAddr, localPort int) (net.Conn, error) {
+	if r.upstreamSocks != "" {
+		return dialSocks5UDP(r.upstreamSocks, target)
+	}
+	if localPort > 0 {
+		return r.dialUDP(&net.UDPAddr{Port: localPort}, target)
+	}
+	if r.serverPortMin > 0 {
+		return r.dialServerInRange(target)
+	}
+	return r.dialUDP(nil, target)
+}
+
+// dialUDP opens a direct UDP connection to target from local (nil for an
+// ephemeral port), marked with -fwmark and set up with -server-sockopt if set
+func (r *Relay) dialUDP(local, target *net.UDPAddr) (net.Conn, error) {
+	if r.fwmark == 0 && len(r.serverSockopts) == 0 {
+		return net.DialUDP("udp", local, target)
+	}
+	var mark func(network, address string, c syscall.RawConn) error
+	if r.fwmark != 0 {
+		mark = fwmarkControl(r.fwmark)
+	}
+	dialer := net.Dialer{Control: r.withServerSockopts(mark)}
+	if local != nil {
+		dialer.LocalAddr = local
+	}
+	return dialer.Dial("udp", target.String())
+}
+
+// dialServerInRange binds the server connection to the first free source port
+// in the configured range, starting from a rotating offset so ports are
+// reused evenly. It fails once every port in the range is taken.
+func (r *Relay) dialServerInRange(target *net.UDPAddr) (net.Conn, error) {
+	size := r.serverPortMax - r.serverPortMin + 1
+	start := int(r.serverPortNext.Add(1)) % size
+
+	for i := 0; i < size; i++ {
+		port := r.serverPortMin + (start+i)%size
+		conn, err := r.dialUDP(&net.UDPAddr{Port: port}, target)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w in range %d-%d", errNoSourcePort, r.serverPortMin, r.serverPortMax)
+}
+
+// handleTargetResponses reads responses from target and sends back to client with reverse SNAT
+// It reads only from conn, the connection it was started for, and exits when
+// the session times out, conn fails, stop is closed, or ctx is cancelled.
+// done is closed on exit.
+func (r *Relay) handleTargetResponses(ctx context.Context, session *ClientSession, clientKey string,
+	conn net.Conn, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer r.recoverPanic("server reader", clientKey, session)
+	buffer := make([]byte, r.responseBufferSize())
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(r.serverIdle))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			// Shutdown and migration close the connection, which unblocks the read
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// The session was removed (e.g. reaped as expired)
+				return
+			}
+			if err = classify(err); errors.Is(err, ErrTimeout) {
+				// The server side is quiet, but the client may still be active
+				now := time.Now()
+				if !r.sessionExpired(session, now, r.idleGrace) {
+					r.markTargetProbing()
+					continue
+				}
+				if r.holdForProbe(session, clientKey, now) {
+					continue
+				}
+				r.logSession("Session timeout: %s", r.clientLabel(clientKey))
+				session.span.event("timeout")
+				r.expireSession(clientKey, session)
+				return
+			} else if errors.Is(err, syscall.ECONNREFUSED) {
+				// ICMP port unreachable: nothing is listening on the target,
+				// so fail fast rather than waiting for the idle timeout
+				r.stats.connRefused.Add(1)
+				r.markTargetDown()
+				r.targetRefused(conn.RemoteAddr())
+				log.Printf("[%s] Target refused packets for %s, closing session", r.listenAddr, r.clientLabel(clientKey))
+				session.recordError("reading from server", err)
+			} else {
+				log.Printf("Error reading from target for %s: %v", r.clientLabel(clientKey), err)
+				session.recordError("reading from server", err)
+			}
+			r.closeSession(clientKey, session)
+			return
+		}
+
+		if err := r.forwardToClient(session, clientKey, buffer[:n]); err != nil {
+			r.forwardFailed("client", session, clientKey, n, err)
+		}
+		if n == len(buffer) {
+			session.recordError("reading from server", truncatedError(n))
+			if size := r.bufferFilled("server", n); size > n {
+				buffer = make([]byte, size)
+			}
+		}
+	}
+}
+
+// forwardToClient sends a server response back to the session's client
+func (r *Relay) forwardToClient(session *ClientSession, clientKey string, data []byte) error {
+	if r.droppedPaused() {
+		return nil
+	}
+
+	// Update server-side activity time
+	now := time.Now()
+	session.mu.Lock()
+	if session.recent != nil && session.recent.seen(data) {
+		session.mu.Unlock()
+		r.stats.duplicatesDropped.Add(1)
+		return nil
+	}
+	if r.maxPPSServer > 0 && session.overPPSLocked(now, &session.ppsToClient, r.maxPPSServer) {
+		session.mu.Unlock()
+		return ErrRateLimited
+	}
+	session.lastServer = now
+	session.firstPacket = nil
+	session.mu.Unlock()
+	r.markTargetUp(now)
+
+	// With -client-queue, hand off to the session's writer so a slow client
+	// never stalls reading from the server; overflow is dropped
+	if session.outbound != nil {
+		dataCopy := make([]byte, len(data))
+		copy(dataCopy, data)
+		select {
+		case session.outbound <- dataCopy:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	return r.writeToClient(session, clientKey, data)
+}
+
+// runClientWriter drains the session's outbound queue until the session is
+// removed
+func (r *Relay) runClientWriter(session *ClientSession, clientKey string) {
+	defer r.recoverPanic("client writer", clientKey, session)
+	for {
+		select {
+		case data := <-session.outbound:
+			if err := r.writeToClient(session, clientKey, data); err != nil {
+				r.forwardFailed("client", session, clientKey, len(data), err)
+			}
+		case <-session.writerQuit:
+			return
+		}
+	}
+}
+
+// writeToClient writes one response to the session's client, returning why
+// it wasn't sent for forwardFailed
+func (r *Relay) writeToClient(session *ClientSession, clientKey string, data []byte) error {
+	// Reverse SNAT: Send back to client from our listen port using main listener
+	// Client sees: (relay_ip, listen_port) -> (client_ip, client_port)
+	// Sharing the listener keeps sessions to a single socket each; there is
+	// no per-session client-facing socket to open or close. With -reply-port
+	// the shared socket is the one bound to that port instead.
+	if r.writeTimeout > 0 {
+		r.replyConn.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+	}
+	packet := data
+	if r.link != nil && r.link.side == relayLinkClient {
+		// The shared socket is unconnected, and writev can't carry a
+		// destination address, so the tag is sealed into a copy
+		packet = r.link.seal(linkToClient, data)
+	}
+	var written int
+	var err error
+	if session.replyOOB != nil {
+		written, _, err = r.replyConn.WriteMsgUDP(packet, session.replyOOB, session.clientAddr)
+	} else {
+		written, err = r.replyConn.WriteToUDP(packet, session.clientAddr)
+	}
+	if err != nil {
+		return classify(err)
+	}
+	if session.clientFailures.Load() != 0 {
+		session.clientFailures.Store(0)
+	}
+	if written != len(packet) {
+		return shortWriteError(written, len(packet))
+	}
+	if r.capture.capturing() {
+		r.capture.record(r.replyConn.LocalAddr().(*net.UDPAddr), session.clientAddr, session.clientAddr, data)
+	}
+	r.stats.packetsToClient.Add(1)
+	r.stats.bytesToClient.Add(uint64(len(data)))
+	r.stats.toClientSizes.observe(len(data))
+	session.span.countToClient(len(data))
+	return nil
+}
+
+// age returns how long ago the session was opened
+func (s *ClientSession) age() time.Duration {
+	return time.Since(s.createdAt).Round(time.Second)
+}
+
+// recordError keeps err, without addresses, as the session's most recent
+// forwarding error
+func (s *ClientSession) recordError(op string, err error) {
+	err = redactAddrs(err)
+	s.mu.Lock()
+	s.lastError, s.lastErrorOp = err, op
+	s.lastErrorAt = time.Now()
+	s.mu.Unlock()
+}
+
+// closeSession closes and removes a client session, unless it has already
+// been replaced by a newer session for the same client
+func (r *Relay) closeSession(clientKey string, session *ClientSession) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	if r.sessions[clientKey] == session {
+		r.removeSessionLocked(clientKey, session)
+		r.logSession("Closed session: %s (age %s)", r.clientLabel(clientKey), session.age())
+	}
+}
+
+// expireSession closes a session that timed out, hibernating it first if
+// -session-hibernate is set
+func (r *Relay) expireSession(clientKey string, session *ClientSession) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	if r.sessions[clientKey] == session {
+		r.hibernateLocked(clientKey, session)
+		r.removeSessionLocked(clientKey, session)
+		r.logSession("Closed session: %s (age %s)", r.clientLabel(clientKey), session.age())
+	}
+}
+
+// removeSessionLocked marks session closed, closes its server connection and
+// removes it. The caller must hold sessionsMu and have checked that session
+// is the current one for clientKey.
+func (r *Relay) removeSessionLocked(clientKey string, session *ClientSession) {
+	session.mu.Lock()
+	session.closed = true
+	if session.pollToken != 0 {
+		r.poller.remove(session.pollToken)
+	}
+	session.toServerConn.Close()
+	if session.mirrorConn != nil {
+		session.mirrorConn.Close()
+		r.fds.add(-1)
+	}
+	for _, conn := range session.dupConns {
+		conn.Close()
+		r.fds.add(-1)
+	}
+	if session.writerQuit != nil {
+		close(session.writerQuit)
+	}
+	session.mu.Unlock()
+
+	delete(r.sessions, clientKey)
+	r.stats.sessionsClosed.Add(1)
+	r.recentlyClosed[clientKey] = time.Now()
+	r.registry.remove(r.listenAddr, clientKey, session)
+	r.countSessionFD(-1)
+	r.tracer.end(session.span)
+}
+
+// stopServing closes every session once the listen loop has ended, saving
+// them first for -session-state-file
+func (r *Relay) stopServing() {
+	if r.persistSessions {
+		r.savedSessions = r.snapshotSessions()
+	}
+	r.closeAllSessions()
+	r.running.Store(false)
+	log.Printf("[%s] Relay stopped", r.listenAddr)
+}
+
+// closeAllSessions closes and removes every session, used on shutdown
+func (r *Relay) closeAllSessions() {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	for key, session := range r.sessions {
+		r.removeSessionLocked(key, session)
+	}
+}
+
+// countSessionFD tracks descriptors held by sessions' own server sockets;
+// sessions on a shared server socket hold none
+func (r *Relay) countSessionFD(delta int64) {
+	if !r.sharedServerSocket() {
+		r.fds.add(delta)
+	}
+}
+
+// sharedServerSocket reports whether sessions share one server-facing socket
+// (per-port or raw mode) rather than each owning one
+func (r *Relay) sharedServerSocket() bool {
+	return r.pool != nil || r.raw != nil
+}
+
+// logSession logs a session lifecycle event, unless -log-sessions=false
+// leaves them to summarizeSessions
+func (r *Relay) logSession(format string, args ...any) {
+	if !r.quietSessions {
+		log.Printf(format, args...)
+	}
+}
+
+// summarizeSessions logs how many sessions were active, created and closed
+// every sessionSummaryInterval, standing in for the per-session logs that
+// -log-sessions=false suppresses
+func (r *Relay) summarizeSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSummaryInterval)
+	defer ticker.Stop()
+
+	var lastCreated, lastClosed, lastRecreated uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		created := r.stats.sessionsCreated.Load()
+		closed := r.stats.sessionsClosed.Load()
+		recreated := r.stats.sessionsRecreated.Load()
+		active := r.sessionCount()
+		if active == 0 && created == lastCreated && closed == lastClosed {
+			continue
+		}
+		log.Printf("[%s] Sessions: active=%d created=+%d closed=-%d recreated=%d in last %s",
+			r.listenAddr, active, created-lastCreated, closed-lastClosed, recreated-lastRecreated, sessionSummaryInterval)
+		lastCreated, lastClosed, lastRecreated = created, closed, recreated
+	}
+}
+
+// summarizeThroughput logs the relay's packet and bit rates in each direction
+// since the previous summary, and its session count, every summaryInterval
+func (r *Relay) summarizeThroughput(ctx context.Context) {
+	ticker := time.NewTicker(r.summaryInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	lastPktsUp, lastBytesUp := r.stats.packetsToServer.Load(), r.stats.bytesToServer.Load()
+	lastPktsDown, lastBytesDown := r.stats.packetsToClient.Load(), r.stats.bytesToClient.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		secs := now.Sub(last).Seconds()
+		pktsUp, bytesUp := r.stats.packetsToServer.Load(), r.stats.bytesToServer.Load()
+		pktsDown, bytesDown := r.stats.packetsToClient.Load(), r.stats.bytesToClient.Load()
+		log.Printf("[%s] Throughput: to server %.1f pps %s, to client %.1f pps %s, %d sessions",
+			r.listenAddr,
+			float64(pktsUp-lastPktsUp)/secs, formatBitRate(float64(bytesUp-lastBytesUp)*8/secs),
+			float64(pktsDown-lastPktsDown)/secs, formatBitRate(float64(bytesDown-lastBytesDown)*8/secs),
+			r.sessionCount())
+		last = now
+		lastPktsUp, lastBytesUp, lastPktsDown, lastBytesDown = pktsUp, bytesUp, pktsDown, bytesDown
+	}
+}
+
+// formatBitRate formats bits per second with a decimal unit prefix
+func formatBitRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.1f kbit/s", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f bit/s", bps)
+}
+
+// cleanupSessions periodically removes expired sessions until ctx is cancelled
+func (r *Relay) cleanupSessions(ctx context.Context) {
+	timer := time.NewTimer(r.jittered(r.cleanupInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(r.jittered(r.cleanupInterval))
+		}
+
+		now := time.Now()
+		r.sessionsMu.Lock()
+		for key, session := range r.sessions {
+			if r.sessionExpired(session, now, r.idleGrace) {
+				if r.holdForProbe(session, key, now) {
+					continue
+				}
+				session.span.event("timeout")
+				r.hibernateLocked(key, session)
+				r.removeSessionLocked(key, session)
+				r.logSession("Cleaned up expired session: %s (age %s)", r.clientLabel(key), session.age())
+			} else if r.deadClientLimit > 0 && session.clientFailures.Load() >= int32(r.deadClientLimit) {
+				r.stats.deadClients.Add(1)
+				r.removeSessionLocked(key, session)
+				log.Printf("[%s] Reaped session %s (age %s): its last %d writes to the client failed",
+					r.listenAddr, r.clientLabel(key), session.age(), session.clientFailures.Load())
+			} else if r.idleGrace > 0 {
+				r.markIdle(session, key, r.sessionExpired(session, now, 0))
+			}
+		}
+		for key, closedAt := range r.recentlyClosed {
+			if now.Sub(closedAt) > sessionRecreateWindow {
+				delete(r.recentlyClosed, key)
+			}
+		}
+		r.pruneHibernatedLocked(now)
+		r.sessionsMu.Unlock()
+	}
+}
+
+// defaultCleanupInterval sweeps at half the shortest idle timeout, capped at
+// 30s, so an expired session lingers at most half a timeout past expiry
+func defaultCleanupInterval(clientIdle, serverIdle time.Duration) time.Duration {
+	interval := 30 * time.Second
+	shortest := clientIdle
+	if serverIdle < shortest {
+		shortest = serverIdle
+	}
+	if half := shortest / 2; half > 0 && half < interval {
+		interval = half
+	}
+	return interval
+}
+
+// sessionExpired reports whether both directions of a session have been idle
+// longer than their respective timeouts plus grace. With -wg-aware, a client
+// whose keepalive interval is known expires once it misses wgKeepaliveMisses
+// keepalives (plus grace), however active the server side is.
+func (r *Relay) sessionExpired(session *ClientSession, now time.Time, grace time.Duration) bool {
+	if r.paused.Load() {
+		return false
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if r.wgAware && session.keepaliveInterval > 0 {
+		limit := wgKeepaliveMisses * session.keepaliveInterval
+		if limit < r.clientIdle && now.Sub(session.lastClient) > limit+grace {
+			return true
+		}
+	}
+	return now.Sub(session.lastClient) > r.clientIdle+grace && now.Sub(session.lastServer) > r.serverIdle+grace
+}
+
+// markIdle records whether a session kept by -hard-timeout is past its idle
+// timeout, logging when that changes. A late keepalive revives an idle
+// session without a new handshake, which is what the grace period is for.
+func (r *Relay) markIdle(session *ClientSession, clientKey string, idle bool) {
+	session.mu.Lock()
+	changed := session.idle != idle
+	session.idle = idle
+	session.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if idle {
+		r.logSession("Session idle: %s (closing in %s unless it resumes)", r.clientLabel(clientKey), r.idleGrace)
+	} else {
+		r.logSession("Session active again: %s", r.clientLabel(clientKey))
+	}
+}
+
+// observeKeepalive learns a client's persistent keepalive interval from two
+// consecutive keepalives; WireGuard only sends them after an idle interval,
+// so gaps with other traffic in between don't measure it. The caller must
+// hold session.mu.
+func observeKeepalive(session *ClientSession, data []byte, now time.Time) {
+	if !wgIsKeepalive(data) {
+		session.lastWasKeepalive = false
+		return
+	}
+	if session.lastWasKeepalive {
+		session.keepaliveInterval = now.Sub(session.lastKeepalive)
+	}
+	session.lastKeepalive = now
+	session.lastWasKeepalive = true
+}
+
+// jittered returns d extended by a random fraction of up to r.jitter, so
+// periodic work on many relays doesn't fire in lockstep
+func (r *Relay) jittered(d time.Duration) time.Duration {
+	if r.jitter <= 0 {
+		return d
+	}
+	r.rngMu.Lock()
+	f := r.rng.Float64()
+	r.rngMu.Unlock()
+
+	return d + time.Duration(f*r.jitter*float64(d))
+}
+
+// resolveTarget resolves the target address, applying the port override
+// or failover port when there is one
+func (r *Relay) resolveTarget() (*net.UDPAddr, error) {
+	target := r.targetAddr
+	if port := r.activeTargetPort(); port != 0 {
+		host, _, err := r.splitTarget()
+		if err != nil {
+			return nil, err
+		}
+		target = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return net.ResolveUDPAddr("udp", target)
+}
+
+// splitTarget splits the target into host and port. With a port override
+// the target may be a bare host, in which case port is empty.
+func (r *Relay) splitTarget() (host, port string, err error) {
+	host, port, err = net.SplitHostPort(r.targetAddr)
+	if err != nil && r.activeTargetPort() != 0 {
+		return strings.Trim(r.targetAddr, "[]"), "", nil
+	}
+	return host, port, err
+}
+
+// resolveTargetAddrs resolves every address the target has, applying the port
+// override when one is configured. IPv4 addresses come first, so the first
+// address is the one resolveTarget would pick.
+func (r *Relay) resolveTargetAddrs(ctx context.Context) ([]*net.UDPAddr, error) {
+	if r.dnsVerbose {
+		return r.resolveTargetVerbose(ctx)
+	}
+	return r.lookupTargetAddrs(ctx, net.DefaultResolver)
+}
+
+// lookupTargetAddrs is resolveTargetAddrs using resolver
+func (r *Relay) lookupTargetAddrs(ctx context.Context, resolver *net.Resolver) ([]*net.UDPAddr, error) {
+	host, port, err := r.splitTarget()
+	if err != nil {
+		return nil, err
+	}
+	portNum := r.activeTargetPort()
+	if portNum == 0 {
+		if portNum, err = resolver.LookupPort(ctx, "udp", port); err != nil {
+			return nil, err
+		}
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &net.UDPAddr{IP: ip.IP, Port: portNum, Zone: ip.Zone})
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].IP.To4() != nil && addrs[j].IP.To4() == nil
+	})
+	return addrs, nil
+}
+
+// targetIsIP reports whether the target's host is a literal IP address,
+// which needs no DNS monitoring
+func (r *Relay) targetIsIP() bool {
+	host, _, err := r.splitTarget()
+	return err == nil && net.ParseIP(host) != nil
+}
+
+// containsUDPAddr reports whether addr is one of addrs
+func containsUDPAddr(addrs []*net.UDPAddr, addr *net.UDPAddr) bool {
+	for _, a := range addrs {
+		if a.IP.Equal(addr.IP) && a.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// targetAllowed reports whether a resolved target IP is within
+// -target-allow-cidr, which allows any IP when unset
+func (r *Relay) targetAllowed(ip net.IP) bool {
+	if len(r.targetAllow) == 0 {
+		return true
+	}
+	for _, network := range r.targetAllow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// monitorDNS periodically checks for DNS changes and updates target address
+// until ctx is cancelled
+func (r *Relay) monitorDNS(ctx context.Context) {
+	timer := time.NewTimer(r.jittered(r.dnsCheckInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(r.jittered(r.dnsCheckInterval))
+		}
+
+		// Resolve every target address
+		addrs, err := r.resolveTargetAddrs(ctx)
+		if err != nil {
+			log.Printf("[%s] DNS resolution error for %s: %v", r.listenAddr, r.targetAddr, err)
+			r.dnsFailed()
+			continue
+		}
+
+		r.targetConnMu.RLock()
+		currentAddr := r.targetConn
+		r.targetConnMu.RUnlock()
+
+		// Stick with the current address while the name still resolves to
+		// it, so rotating records don't migrate sessions on every check
+		if containsUDPAddr(addrs, currentAddr) {
+			r.markTargetResolved()
+			continue
+		}
+
+		// A poisoned or misconfigured record must not steer sessions away.
+		// Among the rest, prefer an address this host has a route to, e.g.
+		// the IPv6 one when an IPv4 record appears on an IPv6-only host.
+		var newAddr *net.UDPAddr
+		for _, addr := range addrs {
+			if !r.targetAllowed(addr.IP) {
+				continue
+			}
+			if newAddr == nil {
+				newAddr = addr
+			}
+			if r.routeTo(addr) == nil {
+				newAddr = addr
+				break
+			}
+		}
+		if newAddr == nil {
+			r.stats.targetsRejected.Add(1)
+			log.Printf("[%s] SECURITY WARNING: %s resolved to %s, outside -target-allow-cidr; keeping %s",
+				r.listenAddr, r.targetAddr, addrs[0].IP, currentAddr.IP)
+			continue
+		}
+		r.markTargetResolved()
+
+		log.Printf("[%s] DNS change detected: %s -> %s", r.listenAddr, currentAddr.IP.String(), newAddr.IP.String())
+
+		// Update target address
+		r.targetConnMu.Lock()
+		r.targetConn = newAddr
+		r.targetConnMu.Unlock()
+
+		// Nothing is known about the new address yet
+		r.health.state.Store(targetProbing)
+
+		// Migrate all existing sessions to new target
+		r.migrateSessionsToNewTarget(ctx, newAddr)
+	}
+}
+
+// migrateSessionsToNewTarget recreates all session connections to point to new target
+// Migrations are serialized, and each session's old response handler is
+// stopped and has exited before its replacement starts.
+func (r *Relay) migrateSessionsToNewTarget(ctx context.Context, newTarget *net.UDPAddr) {
+	r.migrateMu.Lock()
+	defer r.migrateMu.Unlock()
+
+	// Sessions sharing the per-port connection move together
+	if r.pool != nil {
+		if err := r.pool.redial(newTarget); err != nil {
+			log.Printf("[%s] Failed to migrate shared server connection: %v", r.listenAddr, err)
+			return
+		}
+		log.Printf("[%s] Migrated shared server connection to %s", r.listenAddr, newTarget)
+		return
+	}
+	if r.raw != nil {
+		if err := r.raw.retarget(newTarget); err != nil {
+			log.Printf("[%s] Failed to migrate raw mode sessions: %v", r.listenAddr, err)
+			return
+		}
+		log.Printf("[%s] Migrated raw mode sessions to %s", r.listenAddr, newTarget)
+		return
+	}
+
+	// Work from a snapshot so waiting on response handlers never blocks
+	// packet handling (or a handler that is itself closing its session)
+	r.sessionsMu.RLock()
+	sessions := make(map[string]*ClientSession, len(r.sessions))
+	for clientKey, session := range r.sessions {
+		sessions[clientKey] = session
+	}
+	r.sessionsMu.RUnlock()
+
+	log.Printf("[%s] Migrating %d sessions to new target %s", r.listenAddr, len(sessions), newTarget.IP.String())
+
+	for clientKey, session := range sessions {
+		r.migrateSession(ctx, clientKey, session, newTarget)
+	}
+}
+
+// migrateSession moves one session to a new server connection
+func (r *Relay) migrateSession(ctx context.Context, clientKey string, session *ClientSession, newTarget *net.UDPAddr) {
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		return
+	}
+	oldConn, stop, done, token := session.toServerConn, session.readerStop, session.readerDone, session.pollToken
+	session.mu.Unlock()
+
+	// Stop the old response handler and wait until it has exited
+	if token != 0 {
+		r.poller.remove(token)
+	} else {
+		close(stop)
+	}
+	oldConn.Close()
+	if done != nil {
+		<-done
+	}
+
+	// Create new connection to new target
+	var newConn net.Conn
+	var err error
+	if r.transparent {
+		newConn, err = r.dialTransparent(clientKey, newTarget)
+	} else {
+		newConn, err = r.dialServer(newTarget, 0)
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to migrate session %s: %v", r.listenAddr, r.clientLabel(clientKey), redactAddrs(err))
+		// Remove failed session
+		r.sessionsMu.Lock()
+		if r.sessions[clientKey] == session {
+			r.removeSessionLocked(clientKey, session)
+		}
+		r.sessionsMu.Unlock()
+		return
+	}
+
+	// Update session with new connection and restart its response handler.
+	// Checking closed under session.mu means a concurrent removal either
+	// happened first, or will see and close newConn.
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		newConn.Close()
+		return
+	}
+	session.toServerConn = newConn
+	r.startReader(ctx, session, clientKey)
+	session.mu.Unlock()
+
+	session.span.event("migrated", stringAttr("server.address", newTarget.String()))
+	r.logSession("[%s] Migrated session: %s", r.listenAddr, r.clientLabel(clientKey))
+}
+
+// parseListenAddr turns a listen list entry into a listen address. Bare ports
+// bind all interfaces; host:port entries bind the given address.
+func parseListenAddr(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if _, err := strconv.Atoi(entry); err == nil {
+		entry = ":" + entry
+	}
+
+	_, portStr, err := net.SplitHostPort(entry)
+	if err != nil {
+		return "", fmt.Errorf("%q: %v", entry, err)
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("%q: invalid port %q", entry, portStr)
+	}
+	return entry, nil
+}
+
+// bufferSetting is a parsed -buffer value
+type bufferSetting struct {
+	size int  // Fixed size, or the starting size when auto
+	auto bool // Grow on truncation (-buffer auto)
+}
+
+// parseBufferSetting parses a buffer size in bytes or "auto"
+func parseBufferSetting(s string) (bufferSetting, error) {
+	s = strings.TrimSpace(s)
+	if s == "auto" {
+		return bufferSetting{size: autoBufferInitial, auto: true}, nil
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size <= 0 {
+		return bufferSetting{}, fmt.Errorf("%q is not a size in bytes or auto", s)
+	}
+	if size > maxBufferSize {
+		return bufferSetting{}, fmt.Errorf("%d exceeds the largest UDP payload (%d bytes)", size, maxBufferSize)
+	}
+	return bufferSetting{size: size}, nil
+}
+
+// parsePortBuffers parses -port-buffer, a comma-separated list of
+// listen=size pairs, into settings keyed by normalized listen address
+func parsePortBuffers(s string) (map[string]bufferSetting, error) {
+	buffers := make(map[string]bufferSetting)
+	if s == "" {
+		return buffers, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		listen, size, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not in listen=size form", entry)
+		}
+		addr, err := parseListenAddr(listen)
+		if err != nil {
+			return nil, err
+		}
+		buffer, err := parseBufferSetting(size)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", addr, err)
+		}
+		buffers[addr] = buffer
+	}
+	return buffers, nil
+}
+
+// parsePortRcvbufs parses -port-rcvbuf, a comma-separated list of
+// listen=bytes pairs, into sizes keyed by normalized listen address
+func parsePortRcvbufs(s string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	if s == "" {
+		return sizes, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		listen, sizeStr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not in listen=bytes form", entry)
+		}
+		addr, err := parseListenAddr(listen)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(sizeStr))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a size in bytes", addr, sizeStr)
+		}
+		sizes[addr] = size
+	}
+	return sizes, nil
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs; a bare IP stands for
+// itself alone
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or IP", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parsePortRange parses a "low-high" port range
+func parsePortRange(s string) (int, int, error) {
+	lowStr, highStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not in low-high form", s)
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid low port %q", lowStr)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid high port %q", highStr)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("range %d-%d must satisfy 1 <= low <= high <= 65535", low, high)
+	}
+	return low, high, nil
+}
+
+// clientLabel returns the form of a client address that is safe to log.
+// With hashing enabled this is the first 8 hex characters of
+// HMAC-SHA256(salt, addr); otherwise the address is returned unchanged.
+func (r *Relay) clientLabel(addr string) string {
+	if !r.hashClients {
+		return addr
+	}
+	mac := hmac.New(sha256.New, r.clientHashSalt)
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil))[:8]
+}
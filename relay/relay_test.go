@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoServer answers every datagram on a loopback address with its payload
+// until the test ends. ip defaults to 127.0.0.1.
+func echoServer(tb testing.TB, ip net.IP) *net.UDPAddr {
+	tb.Helper()
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// freePort returns a UDP port that was free a moment ago
+func freePort(tb testing.TB) int {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// runRelay runs a relay for cfg until the test ends, listening on a free
+// port when cfg.Listen is empty. configure, if given, adjusts the relay
+// before it starts.
+func runRelay(tb testing.TB, cfg RelayConfig, configure ...func(*Relay)) *Relay {
+	tb.Helper()
+	if cfg.Listen == "" {
+		cfg.Listen = strconv.Itoa(freePort(tb))
+	}
+	cfg.QuietSessions = true
+	r, err := NewRelay(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, f := range configure {
+		f(r)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- r.Run(context.Background()) }()
+	<-r.Ready()
+	tb.Cleanup(func() {
+		r.Stop()
+		<-errs
+	})
+	select {
+	case err := <-errs:
+		tb.Fatalf("relay stopped: %v", err)
+	default:
+	}
+	return r
+}
+
+// relayClient returns a socket sending from srcIP (127.0.0.1 if nil) to
+// the relay's port on dstIP
+func relayClient(tb testing.TB, r *Relay, srcIP, dstIP net.IP) *net.UDPConn {
+	tb.Helper()
+	if srcIP == nil {
+		srcIP = net.IPv4(127, 0, 0, 1)
+	}
+	port := r.listenConn.LocalAddr().(*net.UDPAddr).Port
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: srcIP}, &net.UDPAddr{IP: dstIP, Port: port})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// roundTrip sends payload on conn and returns the reply
+func roundTrip(tb testing.TB, conn *net.UDPConn, payload string) string {
+	tb.Helper()
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatalf("no reply to %q: %v", payload, err)
+	}
+	return string(buf[:n])
+}
+
+func TestRelayForwardsBothWays(t *testing.T) {
+	target := echoServer(t, nil)
+	r := runRelay(t, RelayConfig{Target: target.String()})
+	client := relayClient(t, r, nil, net.IPv4(127, 0, 0, 1))
+
+	for _, payload := range []string{"first", "second"} {
+		if got := roundTrip(t, client, payload); got != payload {
+			t.Errorf("reply %q, want %q", got, payload)
+		}
+	}
+	if n := r.Sessions(); n != 1 {
+		t.Errorf("%d sessions, want 1", n)
+	}
+}
+
+// BenchmarkClientPacket compares forwarding a busy session's packets straight
+// from the read buffer (-inline-forward) with copying each one for
+// handleClientPacket, run here without its goroutine
+func BenchmarkClientPacket(b *testing.B) {
+	r := runRelay(b, RelayConfig{Target: echoServer(b, nil).String()})
+	client := relayClient(b, r, nil, net.IPv4(127, 0, 0, 1))
+	roundTrip(b, client, "open")
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	clientKey := clientAddr.String()
+	buffer := make([]byte, 1400)
+
+	b.Run("inline", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			session := r.lookupSession(clientKey)
+			if err := r.forwardToServer(session, clientKey, buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("copy", func(b *testing.B) {
+		ctx := context.Background()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dataCopy := make([]byte, len(buffer))
+			copy(dataCopy, buffer)
+			r.handleClientPacket(ctx, dataCopy, clientAddr, nil, time.Now())
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// openReplyConn opens the socket responses are sent to clients from when
+// -reply-port differs from the listen port, on the listen address's IP
+func (r *Relay) openReplyConn(listenAddr *net.UDPAddr) (*net.UDPConn, error) {
+	return r.listenUDP(&net.UDPAddr{IP: listenAddr.IP, Port: r.replyPort, Zone: listenAddr.Zone})
+}
+
+// serveReplyPort handles packets clients send to the reply port until ctx is
+// cancelled. WireGuard clients adopt the address authenticated packets come
+// from as their endpoint, so without a translating firewall in between they
+// start sending to the reply port; those packets join the same sessions.
+func (r *Relay) serveReplyPort(ctx context.Context) {
+	buffer := make([]byte, r.readBufferSize())
+	backoff := readBackoff{relay: r, what: fmt.Sprintf("clients on reply port %d", r.replyPort)}
+	for {
+		n, clientAddr, err := r.replyConn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			backoff.wait(ctx, err)
+			continue
+		}
+		backoff.reset()
+		packet, ok := r.acceptClientPacket(buffer[:n], clientAddr)
+		if !ok {
+			continue
+		}
+		data := make([]byte, len(packet))
+		copy(data, packet)
+		go r.handleClientPacket(ctx, data, clientAddr, nil, time.Now())
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package relay
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestReplySourceOnWildcardListener checks that replies to a client of a
+// listener bound to all addresses come from exactly the address and port the
+// client sent to, as strict NAT clients require
+func TestReplySourceOnWildcardListener(t *testing.T) {
+	modes := []struct {
+		name      string
+		configure func(*Relay)
+	}{
+		{"direct", func(r *Relay) {}},
+		{"client queue", func(r *Relay) { r.clientQueue = 16 }},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			target := echoServer(t, nil)
+			port := freePort(t)
+			runRelay(t, RelayConfig{Listen: strconv.Itoa(port), Target: target.String()}, mode.configure)
+
+			// One client per address, since a session answers from the
+			// address its first packet was sent to
+			buf := make([]byte, 64)
+			for _, ip := range []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)} {
+				client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				dst := &net.UDPAddr{IP: ip, Port: port}
+				if _, err := client.WriteToUDP([]byte("hello"), dst); err != nil {
+					t.Fatal(err)
+				}
+				client.SetReadDeadline(time.Now().Add(2 * time.Second))
+				_, from, err := client.ReadFromUDP(buf)
+				if err != nil {
+					t.Fatalf("no reply via %s: %v", dst, err)
+				}
+				if !from.IP.Equal(dst.IP) || from.Port != dst.Port {
+					t.Errorf("reply to a packet sent to %s came from %s", dst, from)
+				}
+			}
+		})
+	}
+}
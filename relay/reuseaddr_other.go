@@ -0,0 +1,14 @@
+//go:build !unix
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SO_REUSEADDR lets a socket take over a port bound elsewhere on Windows
+// rather than share it, so ports aren't shared there
+func setReuseAddr(c syscall.RawConn) error {
+	return errors.New("listening on one port with several addresses is only supported on Unix")
+}
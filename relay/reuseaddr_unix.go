@@ -0,0 +1,18 @@
+//go:build unix
+
+package relay
+
+import "syscall"
+
+// setReuseAddr sets SO_REUSEADDR, which lets a socket bound to all
+// interfaces and one bound to a specific address share a port. Every socket
+// on the port needs it; the kernel delivers to the most specific match.
+func setReuseAddr(c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
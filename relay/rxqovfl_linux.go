@@ -0,0 +1,44 @@
+//go:build linux
+
+package relay
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// rxqOverflowOOBSize is the control message space needed for SO_RXQ_OVFL
+var rxqOverflowOOBSize = syscall.CmsgSpace(4)
+
+// enableRxqOverflow asks the kernel to report its receive queue drop counter
+// with every datagram read from conn
+func enableRxqOverflow(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseRxqOverflow extracts the cumulative kernel drop counter from the
+// control messages of a ReadMsgUDP call
+func parseRxqOverflow(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_SOCKET && msg.Header.Type == syscall.SO_RXQ_OVFL && len(msg.Data) >= 4 {
+			// The counter is a native-endian __u32
+			return *(*uint32)(unsafe.Pointer(&msg.Data[0])), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// rxqOverflowOOBSize is zero where SO_RXQ_OVFL is unavailable
+var rxqOverflowOOBSize = 0
+
+// enableRxqOverflow is only supported on Linux
+func enableRxqOverflow(conn *net.UDPConn) error {
+	return errors.New("SO_RXQ_OVFL is only supported on Linux")
+}
+
+// parseRxqOverflow never finds a drop counter off Linux
+func parseRxqOverflow(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	selfTestTimeout = 5 * time.Second
+	selfTestRetry   = 200 * time.Millisecond
+)
+
+// SelfTest runs relays on loopback between a synthetic client and the test
+// responder, pushes a packet through the full SNAT path, and checks that each
+// reply comes back from exactly the address the client sent to: strict and
+// symmetric NAT clients drop anything else. It covers a relay bound to one
+// address and one bound to all interfaces, whose replies pick their source
+// from the IP_PKTINFO the request arrived with. It reports whether every
+// round trip succeeded. The relays use cfg's settings but their own listen
+// address and target.
+func SelfTest(cfg RelayConfig) bool {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// Test responder standing in for the WireGuard server; it echoes the
+	// non-WireGuard payload below
+	server, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		log.Printf("Self-test FAILED: cannot bind test server: %v", err)
+		return false
+	}
+	defer server.Close()
+	go serveTestResponder(server)
+
+	// Reserve free ports for the relays' listeners
+	bound, err := reserveUDPPort(loopback)
+	if err != nil {
+		log.Printf("Self-test FAILED: cannot reserve relay port: %v", err)
+		return false
+	}
+	wildcard, err := reserveUDPPort(&net.UDPAddr{})
+	if err != nil {
+		log.Printf("Self-test FAILED: cannot reserve relay port: %v", err)
+		return false
+	}
+	// Any 127/8 address reaches a wildcard listener on Linux; one other than
+	// the client's own shows whether the reply keeps it
+	dest := &net.UDPAddr{IP: loopback.IP, Port: wildcard.Port}
+	if runtime.GOOS == "linux" {
+		dest.IP = net.IPv4(127, 0, 0, 2)
+	}
+
+	cases := []struct {
+		name   string
+		listen string
+		dest   *net.UDPAddr
+	}{
+		{"bound address", bound.String(), bound},
+		{"all interfaces", net.JoinHostPort("", strconv.Itoa(wildcard.Port)), dest},
+	}
+	for _, c := range cases {
+		if !selfTestRoundTrip(cfg, c.name, c.listen, c.dest, server.LocalAddr().String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserveUDPPort returns addr with a port that was free a moment ago
+func reserveUDPPort(addr *net.UDPAddr) (*net.UDPAddr, error) {
+	probe, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr), nil
+}
+
+// selfTestRoundTrip starts a relay on listen and checks that a packet sent
+// to dest comes back unchanged and from dest itself
+func selfTestRoundTrip(cfg RelayConfig, name, listen string, dest *net.UDPAddr, target string) bool {
+	cfg.Listen, cfg.Target = listen, target
+	cfg.TargetPort = 0 // The test server's port must not be overridden
+	cfg.ReplyPort = 0  // Replies are checked to come from the listen port
+
+	// The test packet isn't a WireGuard handshake
+	cfg.RequireHandshake = false
+	relay, err := NewRelay(cfg)
+	if err != nil {
+		log.Printf("Self-test FAILED (%s): %v", name, err)
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := relay.start(ctx); err != nil {
+			log.Printf("Self-test relay error: %v", err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Printf("Self-test FAILED: cannot bind test client: %v", err)
+		return false
+	}
+	defer client.Close()
+
+	payload := []byte("wg-udp-relay self-test")
+	reply := make([]byte, 65535)
+	deadline := time.Now().Add(selfTestTimeout)
+
+	// Retry until the relay is listening and the round trip completes
+	for time.Now().Before(deadline) {
+		if _, err := client.WriteToUDP(payload, dest); err != nil {
+			log.Printf("Self-test FAILED (%s): cannot send to relay: %v", name, err)
+			return false
+		}
+
+		client.SetReadDeadline(time.Now().Add(selfTestRetry))
+		n, from, err := client.ReadFromUDP(reply)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(reply[:n], payload) {
+			log.Printf("Self-test FAILED (%s): reply payload mismatch (%d bytes)", name, n)
+			return false
+		}
+		if !from.IP.Equal(dest.IP) || from.Port != dest.Port {
+			log.Printf("Self-test FAILED (%s): reply came from %s instead of %s, the address the client sent to", name, from, dest)
+			return false
+		}
+
+		log.Printf("Self-test PASSED (%s): %s -> relay %s -> server %s and back", name, client.LocalAddr(), dest, target)
+		return true
+	}
+
+	log.Printf("Self-test FAILED (%s): no reply through the relay within %s (check binding and firewall rules)", name, selfTestTimeout)
+	return false
+}
@@ -0,0 +1,320 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Config configures Serve: the relays to run and the features they share.
+// Each field matches the command line flag named in its comment.
+type Config struct {
+	Relay             RelayConfig   // Settings of every relay; Listen is ignored and Target is the default for ConfigDir files
+	Listen            []string      // Ports or host:port addresses to run a relay on each, as in -ports
+	ConfigDir         string        // Directory of *.yaml files defining one relay each, as in -config-dir
+	TCPListen         []string      // Addresses accepting length-prefixed packets over TCP for the first relay, as in -tcp-ports
+	PortBuffer        string        // Per-listen-address read buffer overrides as listen=size pairs, as in -port-buffer
+	PortRcvbuf        string        // Per-listen-address SO_RCVBUF as listen=bytes pairs, as in -port-rcvbuf
+	StartStagger      time.Duration // Delay between starting each relay (0 starts all at once)
+	XDPRate           int           // UDP packets per second allowed to each listen port, all clients together (0 = unlimited)
+	XDPIface          string        // Interface the XDPRate program is attached to
+	AdminAddr         string        // Address of the admin HTTP server, host:port or unix:path (empty = none)
+	AdminSocketMode   os.FileMode   // Permissions of a Unix admin socket (default 0600)
+	CaptureClient     string        // Capture this client's packets (ip or ip:port) from the start (empty = none)
+	CaptureFile       string        // pcap file for CaptureClient (default capture.pcap)
+	CaptureDir        string        // Directory for captures started through the admin server (empty refuses them)
+	GeoIPDB           string        // Comma-separated MaxMind .mmdb files for client country/ASN (empty = none)
+	LoopDetectWindow  time.Duration // Warn of packets forwarded repeatedly within this window (0 = never)
+	LoopDetectSample  float64       // Fraction of packets LoopDetectWindow tracks (default 0.1)
+	OTLPEndpoint      string        // OTLP/HTTP collector sessions are exported to as spans (empty = none)
+	LeakCheckInterval time.Duration // How often goroutines are compared with sessions to warn of leaks (0 = never)
+	SessionStateFile  string        // Restore sessions from this file on start and save them to it on stop (empty = none)
+}
+
+// Serve runs a relay for each of cfg's listen addresses, and the features
+// they share, until ctx is cancelled. It returns an error without starting
+// anything if cfg is invalid. It also fits GOMAXPROCS to a container CPU
+// limit, so it is meant to run once per process.
+func Serve(ctx context.Context, cfg Config) error {
+	if cfg.LoopDetectSample == 0 {
+		cfg.LoopDetectSample = 0.1
+	}
+	if cfg.LoopDetectSample < 0 || cfg.LoopDetectSample > 1 {
+		return fmt.Errorf("LoopDetectSample must be in (0, 1], got %g", cfg.LoopDetectSample)
+	}
+	if cfg.StartStagger < 0 {
+		return fmt.Errorf("StartStagger must not be negative, got %s", cfg.StartStagger)
+	}
+	if cfg.XDPRate < 0 {
+		return fmt.Errorf("XDPRate must not be negative, got %d", cfg.XDPRate)
+	}
+	if cfg.XDPRate > 0 && cfg.XDPIface == "" {
+		return errors.New("XDPRate requires XDPIface")
+	}
+	if cfg.AdminSocketMode == 0 {
+		cfg.AdminSocketMode = 0o600
+	}
+	if cfg.CaptureFile == "" {
+		cfg.CaptureFile = "capture.pcap"
+	}
+	if cfg.Relay.Transparent && cfg.SessionStateFile != "" {
+		return errors.New("Transparent sends from client addresses and cannot be combined with SessionStateFile")
+	}
+	if cfg.Relay.RelayLinkKey != nil && cfg.Relay.RelayLinkSide == relayLinkClient && len(cfg.TCPListen) > 0 {
+		return errors.New("RelayLinkSide client cannot be combined with TCPListen, whose clients don't authenticate")
+	}
+	portBuffers, err := parsePortBuffers(cfg.PortBuffer)
+	if err != nil {
+		return fmt.Errorf("invalid PortBuffer: %v", err)
+	}
+	portRcvbufs, err := parsePortRcvbufs(cfg.PortRcvbuf)
+	if err != nil {
+		return fmt.Errorf("invalid PortRcvbuf: %v", err)
+	}
+	var tcpListen []string
+	for _, port := range cfg.TCPListen {
+		addr, err := parseListenAddr(port)
+		if err != nil {
+			return fmt.Errorf("invalid TCPListen address: %v", err)
+		}
+		tcpListen = append(tcpListen, addr)
+	}
+
+	var specs []relaySpec
+	for _, port := range cfg.Listen {
+		listenAddr, err := parseListenAddr(port)
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %v", err)
+		}
+		specs = append(specs, relaySpec{listen: listenAddr, target: cfg.Relay.Target, source: "-ports"})
+	}
+	if cfg.ConfigDir != "" {
+		loaded, err := loadConfigDir(cfg.ConfigDir, cfg.Relay.Target)
+		if err != nil {
+			return fmt.Errorf("failed to read ConfigDir: %v", err)
+		}
+		log.Printf("Loaded %d relay(s) from %s", len(loaded), cfg.ConfigDir)
+		specs = append(specs, loaded...)
+	}
+	// A port may be listed with several bind addresses, e.g. all interfaces
+	// plus a management IP; each gets its own relay and counters
+	listening := make(map[string]bool)
+	portUsers := make(map[string]int)
+	unique := specs[:0]
+	for _, spec := range specs {
+		if listening[spec.listen] {
+			if spec.source == "-ports" {
+				return fmt.Errorf("Listen lists %s more than once", spec.listen)
+			}
+			log.Printf("Error: Skipping relay config %s: %s is already listened on", spec.source, spec.listen)
+			continue
+		}
+		listening[spec.listen] = true
+		_, portStr, _ := net.SplitHostPort(spec.listen)
+		portUsers[portStr]++
+		unique = append(unique, spec)
+	}
+	specs = unique
+	if len(specs) == 0 {
+		return errors.New("at least one listen port must be specified")
+	}
+	for listen := range portBuffers {
+		if !listening[listen] {
+			return fmt.Errorf("PortBuffer entry %s matches no listen address", listen)
+		}
+	}
+	for listen := range portRcvbufs {
+		if !listening[listen] {
+			return fmt.Errorf("PortRcvbuf entry %s matches no listen address", listen)
+		}
+	}
+	if cfg.Relay.ReplyPort != 0 && len(specs) > 1 {
+		return errors.New("ReplyPort can only be used with a single listen address")
+	}
+
+	// Build every relay before starting anything, so a bad setting fails
+	// the whole start
+	if cfg.Relay.JitterSeed == 0 {
+		cfg.Relay.JitterSeed = time.Now().UnixNano()
+	}
+	var relays []*Relay
+	for i, spec := range specs {
+		relayCfg := cfg.Relay
+		relayCfg.Listen = spec.listen
+		relayCfg.Target = spec.target
+		relayCfg.JitterSeed += int64(i)
+		if override, ok := portBuffers[spec.listen]; ok {
+			relayCfg.BufferSize, relayCfg.BufferAuto = override.size, override.auto
+		}
+		relayCfg.ReceiveBuffer = portRcvbufs[spec.listen]
+		relay, err := NewRelay(relayCfg)
+		if err != nil {
+			if spec.source == "-ports" {
+				return err
+			}
+			return fmt.Errorf("relay config %s: %v", spec.source, err)
+		}
+		relays = append(relays, relay)
+	}
+
+	build := readBuildInfo()
+	var tracer *otlpTracer
+	if cfg.OTLPEndpoint != "" {
+		tracer, err = newOTLPTracer(cfg.OTLPEndpoint, build)
+		if err != nil {
+			return fmt.Errorf("invalid OTLPEndpoint: %v", err)
+		}
+	}
+
+	if cfg.Relay.HashClients && cfg.Relay.ClientHashSalt == "" {
+		log.Printf("Warning: -hash-clients is enabled without -client-hash-salt; hashes are comparable across deployments")
+	}
+	if cfg.Relay.Fwmark != 0 {
+		if err := checkFwmark(cfg.Relay.Fwmark); err != nil {
+			log.Printf("Warning: -fwmark %d cannot be applied, server connections will fail: %v", cfg.Relay.Fwmark, err)
+		}
+	}
+	if cfg.Relay.Freebind && runtime.GOOS != "linux" {
+		log.Printf("Warning: -freebind is only supported on Linux; ignoring it")
+	}
+
+	adjustMaxProcs()
+	capture := &packetCapture{dir: cfg.CaptureDir}
+	fds := newFDBudget()
+	registry := newSessionRegistry()
+	var geo *geoIP
+	if cfg.GeoIPDB != "" {
+		geo = loadGeoIP(cfg.GeoIPDB)
+	}
+	var loops *loopDetector
+	if cfg.LoopDetectWindow > 0 {
+		loops = newLoopDetector(cfg.LoopDetectWindow, cfg.LoopDetectSample)
+	}
+
+	var restored []savedSession
+	if cfg.SessionStateFile != "" {
+		restored, err = loadSessionState(cfg.SessionStateFile)
+		if err != nil {
+			log.Printf("Warning: Could not load session state from %s: %v", cfg.SessionStateFile, err)
+		}
+	}
+
+	if cfg.CaptureClient != "" {
+		if err := capture.start(cfg.CaptureClient, cfg.CaptureFile); err != nil {
+			return fmt.Errorf("failed to start packet capture: %v", err)
+		}
+	}
+
+	// -xdp-rate limits every listen port with one XDP program, falling back
+	// to a limiter in each relay's read loop where XDP can't be attached
+	var xdp *xdpLimiter
+	if cfg.XDPRate > 0 {
+		ports := make([]int, 0, len(portUsers))
+		for portStr := range portUsers {
+			port, _ := strconv.Atoi(portStr)
+			ports = append(ports, port)
+		}
+		if xdp, err = attachXDP(cfg.XDPIface, ports, cfg.XDPRate); err != nil {
+			log.Printf("Warning: -xdp-rate falls back to dropping packets after reading them: %v", err)
+		} else {
+			log.Printf("XDP on %s drops packets past %d/s to each listen port", cfg.XDPIface, cfg.XDPRate)
+			defer xdp.close()
+		}
+	}
+
+	// Start a relay for each port
+	var wg sync.WaitGroup
+	for i, relay := range relays {
+		relay.capture = capture
+		relay.fds = fds
+		relay.registry = registry
+		relay.geo = geo
+		relay.tracer = tracer
+		relay.loops = loops
+		_, portStr, _ := net.SplitHostPort(relay.listenAddr)
+		relay.sharedPort = portUsers[portStr] > 1
+		if xdp != nil {
+			relay.xdp = xdp
+		} else if cfg.XDPRate > 0 {
+			relay.listenLimiter = newTokenBucket(float64(cfg.XDPRate), cfg.XDPRate)
+		}
+		if cfg.SessionStateFile != "" {
+			relay.persistSessions = true
+			for _, saved := range restored {
+				if saved.Listen == relay.listenAddr {
+					relay.restoreSessions = append(relay.restoreSessions, saved)
+				}
+			}
+		}
+
+		// -start-stagger spreads the relays' first DNS lookups and binds out
+		delay := time.Duration(i) * cfg.StartStagger
+		wg.Add(1)
+		go func(r *Relay) {
+			defer wg.Done()
+			defer r.markReady()
+			if delay > 0 {
+				log.Printf("[%s] Starting in %s (-start-stagger)", r.listenAddr, delay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+			}
+			if err := r.start(ctx); err != nil {
+				log.Printf("Relay on %s failed: %v", r.listenAddr, err)
+			}
+		}(relay)
+	}
+
+	// TCP clients share the first relay's target and counters
+	for _, addr := range tcpListen {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := runTCPBridge(ctx, addr, relays[0]); err != nil {
+				log.Printf("Failed to start TCP bridge on %s: %v", addr, err)
+			}
+		}(addr)
+	}
+	go logEffectiveConfig(ctx, relays)
+	go tracer.run(ctx)
+
+	var leaks *leakCheck
+	if cfg.LeakCheckInterval > 0 {
+		leaks = newLeakCheck(relays)
+		go leaks.run(ctx, cfg.LeakCheckInterval)
+	}
+
+	if cfg.AdminAddr != "" {
+		go runAdminServer(ctx, cfg.AdminAddr, relays, registry, capture, fds, leaks, build, cfg.AdminSocketMode)
+	}
+
+	// Wait for all relays
+	wg.Wait()
+	tracer.flush()
+	if capture.capturing() {
+		capture.stop()
+	}
+
+	if cfg.SessionStateFile != "" {
+		var saved []savedSession
+		for _, r := range relays {
+			saved = append(saved, r.savedSessions...)
+		}
+		if err := writeSessionState(cfg.SessionStateFile, saved); err != nil {
+			log.Printf("Error writing session state to %s: %v", cfg.SessionStateFile, err)
+		} else {
+			log.Printf("Saved %d sessions to %s", len(saved), cfg.SessionStateFile)
+		}
+	}
+	log.Printf("All relays stopped")
+	return nil
+}
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server connection modes
+const (
+	serverConnPerSession = "session" // One ephemeral server connection per client (default)
+	serverConnPerPort    = "port"    // All clients of a listen port share one server connection
+)
+
+// maxIndexesPerClient bounds the receiver indexes remembered per client.
+// WireGuard keeps at most current, previous and next keypairs.
+const maxIndexesPerClient = 4
+
+// serverPool multiplexes every session of a relay over a single server-facing
+// connection. Responses are routed back to clients by the WireGuard receiver
+// index, learned from the sender index of each client's handshake messages.
+// This saves one socket per session at the cost of depending on WireGuard
+// framing; packets that can't be routed are dropped.
+type serverPool struct {
+	relay   *Relay
+	mu      sync.RWMutex
+	conn    net.Conn
+	indexes map[uint32]string   // Sender index -> client key
+	byKey   map[string][]uint32 // Client key -> its indexes, oldest first
+}
+
+// newServerPool dials the shared connection to target and starts its reader
+func newServerPool(ctx context.Context, r *Relay, target *net.UDPAddr) (*serverPool, error) {
+	conn, err := r.dialServer(target, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &serverPool{
+		relay:   r,
+		conn:    conn,
+		indexes: make(map[uint32]string),
+		byKey:   make(map[string][]uint32),
+	}
+	go p.run(ctx)
+	return p, nil
+}
+
+// attach returns the connection a session should use for server traffic
+func (p *serverPool) attach(clientKey string) net.Conn {
+	return &pooledConn{pool: p, clientKey: clientKey}
+}
+
+// redial replaces the shared connection, e.g. after the target's IP changed
+func (p *serverPool) redial(target *net.UDPAddr) error {
+	conn, err := p.relay.dialServer(target, 0)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	old := p.conn
+	p.conn = conn
+	p.mu.Unlock()
+
+	old.Close()
+	return nil
+}
+
+// current returns the shared connection in use
+func (p *serverPool) current() net.Conn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.conn
+}
+
+// learn records that replies under index belong to clientKey
+func (p *serverPool) learn(index uint32, clientKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.indexes[index] == clientKey {
+		return
+	}
+	p.indexes[index] = clientKey
+	known := append(p.byKey[clientKey], index)
+	if len(known) > maxIndexesPerClient {
+		delete(p.indexes, known[0])
+		known = known[1:]
+	}
+	p.byKey[clientKey] = known
+}
+
+// forget drops all indexes of a closed session
+func (p *serverPool) forget(clientKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, index := range p.byKey[clientKey] {
+		if p.indexes[index] == clientKey {
+			delete(p.indexes, index)
+		}
+	}
+	delete(p.byKey, clientKey)
+}
+
+// route returns the client key a server packet should be delivered to
+func (p *serverPool) route(packet []byte) (string, bool) {
+	index, ok := wgReceiverIndex(packet)
+	if !ok {
+		return "", false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	clientKey, ok := p.indexes[index]
+	return clientKey, ok
+}
+
+// run reads from the shared connection and demultiplexes responses to
+// clients until ctx is cancelled
+func (p *serverPool) run(ctx context.Context) {
+	r := p.relay
+	buffer := make([]byte, r.responseBufferSize())
+
+	for {
+		conn := p.current()
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if conn != p.current() {
+				// Replaced by redial; continue on the new connection
+				continue
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// Connected UDP sockets report ICMP errors once; keep reading
+				r.stats.connRefused.Add(1)
+				r.markTargetDown()
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[%s] Error reading from shared server connection: %v", r.listenAddr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		// A grown buffer is used from the next read on; packet stays valid
+		packet := buffer[:n]
+		if n == len(buffer) {
+			if size := r.bufferFilled("server", n); size > n {
+				buffer = make([]byte, size)
+			}
+		}
+		clientKey, ok := p.route(packet)
+		if !ok {
+			r.stats.unroutable.Add(1)
+			continue
+		}
+		session := r.lookupSession(clientKey)
+		if session == nil {
+			r.stats.unroutable.Add(1)
+			continue
+		}
+		if err := r.forwardToClient(session, clientKey, packet); err != nil {
+			r.forwardFailed("client", session, clientKey, len(packet), err)
+		}
+	}
+}
+
+// close shuts down the shared connection
+func (p *serverPool) close() {
+	p.current().Close()
+}
+
+// pooledConn is a session's view of the shared server connection. Writes
+// learn the client's WireGuard indexes; closing only forgets them.
+type pooledConn struct {
+	pool      *serverPool
+	clientKey string
+}
+
+func (c *pooledConn) Write(b []byte) (int, error) {
+	if index, ok := wgSenderIndex(b); ok {
+		c.pool.learn(index, c.clientKey)
+	}
+	return c.pool.current().Write(b)
+}
+
+// Read is never used: the pool's reader delivers responses
+func (c *pooledConn) Read(b []byte) (int, error) {
+	return 0, errors.New("read on pooled server connection")
+}
+
+func (c *pooledConn) Close() error {
+	c.pool.forget(c.clientKey)
+	return nil
+}
+
+func (c *pooledConn) LocalAddr() net.Addr                { return c.pool.current().LocalAddr() }
+func (c *pooledConn) RemoteAddr() net.Addr               { return c.pool.current().RemoteAddr() }
+func (c *pooledConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pooledConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pooledConn) SetWriteDeadline(t time.Time) error { return c.pool.current().SetWriteDeadline(t) }
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sockoptDef is a socket option known to -listen-sockopt and -server-sockopt
+type sockoptDef struct {
+	level int
+	opt   int
+	// On IPv6 sockets an IPv4-level option is also set at this level and
+	// option, e.g. IPV6_TCLASS along with IP_TOS; 0 if there's no equivalent
+	level6 int
+	opt6   int
+}
+
+// sockopt is one name=value setting from -listen-sockopt or -server-sockopt
+type sockopt struct {
+	name  string
+	def   sockoptDef
+	value int
+}
+
+// parseSockopts parses comma-separated NAME=VALUE socket options, e.g.
+// SO_RCVBUF=8388608,IP_TOS=0x10. Names are matched case-insensitively
+// against sockoptNames and values are integers in any base Go accepts.
+func parseSockopts(s string) ([]sockopt, error) {
+	var opts []sockopt
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not NAME=VALUE", entry)
+		}
+		name = strings.ToUpper(strings.TrimSpace(name))
+		def, known := sockoptNames[name]
+		if !known {
+			if len(sockoptNames) == 0 {
+				return nil, fmt.Errorf("socket options are only supported on Linux")
+			}
+			return nil, fmt.Errorf("unknown socket option %s (known: %s)", name, strings.Join(knownSockopts(), ", "))
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: want an integer", value, name)
+		}
+		opts = append(opts, sockopt{name: name, def: def, value: int(n)})
+	}
+	return opts, nil
+}
+
+// knownSockopts returns the option names parseSockopts accepts, sorted
+func knownSockopts() []string {
+	names := make([]string, 0, len(sockoptNames))
+	for name := range sockoptNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatSockopts returns opts in the form parseSockopts reads
+func formatSockopts(opts []sockopt) string {
+	parts := make([]string, len(opts))
+	for i, opt := range opts {
+		parts[i] = opt.name + "=" + strconv.Itoa(opt.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// withServerSockopts returns a net.Dialer Control hook for server sockets
+// that runs base, if not nil, and then applies -server-sockopt
+func (r *Relay) withServerSockopts(base func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if len(r.serverSockopts) == 0 {
+		return base
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if base != nil {
+			if err := base(network, address, c); err != nil {
+				return err
+			}
+		}
+		if err := setSockopts(c, network, r.serverSockopts); err != nil {
+			return fmt.Errorf("-server-sockopt: %v", err)
+		}
+		return nil
+	}
+}
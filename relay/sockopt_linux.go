@@ -0,0 +1,54 @@
+//go:build linux
+
+package relay
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, missing from package syscall
+const soReusePort = 0xf
+
+// sockoptNames are the integer socket options -listen-sockopt and
+// -server-sockopt can set
+var sockoptNames = map[string]sockoptDef{
+	"SO_RCVBUF":         {level: syscall.SOL_SOCKET, opt: syscall.SO_RCVBUF},
+	"SO_SNDBUF":         {level: syscall.SOL_SOCKET, opt: syscall.SO_SNDBUF},
+	"SO_RCVBUFFORCE":    {level: syscall.SOL_SOCKET, opt: syscall.SO_RCVBUFFORCE},
+	"SO_SNDBUFFORCE":    {level: syscall.SOL_SOCKET, opt: syscall.SO_SNDBUFFORCE},
+	"SO_MARK":           {level: syscall.SOL_SOCKET, opt: syscall.SO_MARK},
+	"SO_PRIORITY":       {level: syscall.SOL_SOCKET, opt: syscall.SO_PRIORITY},
+	"SO_REUSEADDR":      {level: syscall.SOL_SOCKET, opt: syscall.SO_REUSEADDR},
+	"SO_REUSEPORT":      {level: syscall.SOL_SOCKET, opt: soReusePort},
+	"IP_TOS":            {level: syscall.IPPROTO_IP, opt: syscall.IP_TOS, level6: syscall.IPPROTO_IPV6, opt6: syscall.IPV6_TCLASS},
+	"IP_TTL":            {level: syscall.IPPROTO_IP, opt: syscall.IP_TTL, level6: syscall.IPPROTO_IPV6, opt6: syscall.IPV6_UNICAST_HOPS},
+	"IP_FREEBIND":       {level: syscall.IPPROTO_IP, opt: syscall.IP_FREEBIND},
+	"IP_TRANSPARENT":    {level: syscall.IPPROTO_IP, opt: syscall.IP_TRANSPARENT},
+	"IP_MTU_DISCOVER":   {level: syscall.IPPROTO_IP, opt: syscall.IP_MTU_DISCOVER, level6: syscall.IPPROTO_IPV6, opt6: syscall.IPV6_MTU_DISCOVER},
+	"IPV6_TCLASS":       {level: syscall.IPPROTO_IPV6, opt: syscall.IPV6_TCLASS},
+	"IPV6_UNICAST_HOPS": {level: syscall.IPPROTO_IPV6, opt: syscall.IPV6_UNICAST_HOPS},
+}
+
+// setSockopts applies opts to a socket of network ("udp4" or "udp6")
+func setSockopts(c syscall.RawConn, network string, opts []sockopt) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, opt := range opts {
+			if err := syscall.SetsockoptInt(int(fd), opt.def.level, opt.def.opt, opt.value); err != nil {
+				sockErr = fmt.Errorf("%s=%d: %v", opt.name, opt.value, err)
+				return
+			}
+			if network == "udp6" && opt.def.level6 != 0 {
+				if err := syscall.SetsockoptInt(int(fd), opt.def.level6, opt.def.opt6, opt.value); err != nil {
+					sockErr = fmt.Errorf("%s=%d on an IPv6 socket: %v", opt.name, opt.value, err)
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
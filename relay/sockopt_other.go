@@ -0,0 +1,16 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Generic socket options are only implemented on Linux; parseSockopts
+// rejects any option elsewhere
+var sockoptNames = map[string]sockoptDef{}
+
+func setSockopts(c syscall.RawConn, network string, opts []sockopt) error {
+	return errors.New("socket options are only supported on Linux")
+}
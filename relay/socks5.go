@@ -0,0 +1,280 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccept   = 0xff
+	socks5CmdUDPAssoc    = 0x03
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5ReplySucceeded = 0x00
+
+	socks5DialTimeout = 10 * time.Second
+	socks5MaxHeader   = 4 + 1 + 255 + 2 // RSV+FRAG+ATYP, longest address, port
+)
+
+// socks5UDPConn is a net.Conn that sends datagrams to a fixed target through
+// a SOCKS5 proxy's UDP ASSOCIATE relay. Each datagram is encapsulated with the
+// SOCKS5 UDP request header on write and unwrapped on read.
+type socks5UDPConn struct {
+	*net.UDPConn          // Connected to the proxy's UDP relay address
+	ctrl         net.Conn // TCP control connection; the association lives as long as it does
+	header       []byte   // Precomputed SOCKS5 UDP header for the target
+	readBuf      []byte
+}
+
+// dialSocks5UDP establishes a UDP association through the SOCKS5 proxy at
+// proxyAddr ("[user:pass@]host:port") for datagrams addressed to target
+func dialSocks5UDP(proxyAddr string, target *net.UDPAddr) (*socks5UDPConn, error) {
+	var user, pass string
+	if at := strings.LastIndex(proxyAddr, "@"); at >= 0 {
+		creds := proxyAddr[:at]
+		proxyAddr = proxyAddr[at+1:]
+		user, pass, _ = strings.Cut(creds, ":")
+	}
+
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, socks5DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: connect to proxy: %w", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(socks5DialTimeout))
+
+	if err := socks5Authenticate(ctrl, user, pass); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// Request a UDP association; we don't know our public source address, so send 0.0.0.0:0
+	req := []byte{socks5Version, socks5CmdUDPAssoc, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: send UDP ASSOCIATE: %w", err)
+	}
+
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, head); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: read UDP ASSOCIATE reply: %w", err)
+	}
+	if head[0] != socks5Version || head[1] != socks5ReplySucceeded {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: UDP ASSOCIATE rejected (reply code %d)", head[1])
+	}
+	bindHost, bindPort, err := socks5ReadAddr(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: read bind address: %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// An unspecified bind address means "same host as the proxy"
+	if ip := net.ParseIP(bindHost); ip == nil || ip.IsUnspecified() {
+		proxyHost, _, _ := net.SplitHostPort(proxyAddr)
+		bindHost = proxyHost
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bindHost, strconv.Itoa(bindPort)))
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: resolve relay address: %w", err)
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: dial relay address: %w", err)
+	}
+
+	c := &socks5UDPConn{
+		UDPConn: udpConn,
+		ctrl:    ctrl,
+		header:  socks5UDPHeader(target),
+	}
+
+	// The association ends when the control connection closes; tear down the
+	// UDP side too so the session's reader notices
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		udpConn.Close()
+	}()
+
+	return c, nil
+}
+
+// socks5DisplayAddr returns the proxy address with any credentials removed
+func socks5DisplayAddr(proxyAddr string) string {
+	if at := strings.LastIndex(proxyAddr, "@"); at >= 0 {
+		return proxyAddr[at+1:]
+	}
+	return proxyAddr
+}
+
+// socks5Authenticate performs method negotiation and, if requested by the
+// proxy, username/password authentication
+func socks5Authenticate(ctrl net.Conn, user, pass string) error {
+	methods := []byte{socks5AuthNone}
+	if user != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := ctrl.Write(greeting); err != nil {
+		return fmt.Errorf("socks5: send greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return fmt.Errorf("socks5: read greeting reply: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if user == "" {
+			return errors.New("socks5: proxy requires username/password authentication")
+		}
+		msg := []byte{0x01, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		if _, err := ctrl.Write(msg); err != nil {
+			return fmt.Errorf("socks5: send credentials: %w", err)
+		}
+		if _, err := io.ReadFull(ctrl, reply); err != nil {
+			return fmt.Errorf("socks5: read auth reply: %w", err)
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+		return nil
+	case socks5AuthNoAccept:
+		return errors.New("socks5: no acceptable authentication method")
+	default:
+		return fmt.Errorf("socks5: unsupported authentication method %d", reply[1])
+	}
+}
+
+// socks5ReadAddr reads an ATYP-prefixed address and port from r
+func socks5ReadAddr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// socks5UDPHeader builds the SOCKS5 UDP request header for target
+func socks5UDPHeader(target *net.UDPAddr) []byte {
+	header := []byte{0x00, 0x00, 0x00} // RSV, FRAG
+	if ip4 := target.IP.To4(); ip4 != nil {
+		header = append(header, socks5AddrIPv4)
+		header = append(header, ip4...)
+	} else {
+		header = append(header, socks5AddrIPv6)
+		header = append(header, target.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(header, uint16(target.Port))
+}
+
+// Write encapsulates b and sends it to the target through the proxy
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	return writePrefixed(c.UDPConn, [][]byte{c.header}, b)
+}
+
+// Read receives the next datagram from the proxy and strips its SOCKS5 header.
+// Fragmented datagrams are not supported and are dropped.
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	if len(c.readBuf) < len(b)+socks5MaxHeader {
+		c.readBuf = make([]byte, len(b)+socks5MaxHeader)
+	}
+	for {
+		n, err := c.UDPConn.Read(c.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := socks5StripHeader(c.readBuf[:n])
+		if !ok {
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+// Close tears down both the UDP socket and the association
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// socks5StripHeader returns the payload of a SOCKS5 UDP datagram
+func socks5StripHeader(packet []byte) ([]byte, bool) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		return nil, false
+	}
+	offset := 4
+	switch packet[3] {
+	case socks5AddrIPv4:
+		offset += net.IPv4len
+	case socks5AddrIPv6:
+		offset += net.IPv6len
+	case socks5AddrDomain:
+		if len(packet) < 5 {
+			return nil, false
+		}
+		offset += 1 + int(packet[4])
+	default:
+		return nil, false
+	}
+	offset += 2
+	if len(packet) < offset {
+		return nil, false
+	}
+	return packet[offset:], true
+}
@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSlowProxyDoesNotBlockSessions dials a -upstream-socks proxy that never
+// answers and checks that the relay's sessions stay usable meanwhile
+func TestSlowProxyDoesNotBlockSessions(t *testing.T) {
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := proxy.Accept(); err == nil {
+			stalled <- conn
+		}
+	}()
+
+	r := runRelay(t, RelayConfig{Target: echoServer(t, nil).String(), UpstreamSocks: proxy.Addr().String()})
+	client := relayClient(t, r, nil, net.IPv4(127, 0, 0, 1))
+	if _, err := client.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-stalled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not dial the proxy")
+	}
+
+	// The dial holds no lock, and a second packet doesn't dial again
+	done := make(chan struct{})
+	go func() {
+		r.closeAllSessions()
+		r.Sessions()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sessionsMu held while dialing the proxy")
+	}
+	dropped := r.stats.dropped.Load()
+	client.Write([]byte("second"))
+	deadline := time.Now().Add(2 * time.Second)
+	for r.stats.dropped.Load() == dropped {
+		if time.Now().After(deadline) {
+			t.Fatal("packet of a client being dialed not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A failed dial releases the client's reservation
+	conn.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		r.sessionsMu.RLock()
+		opening := len(r.opening)
+		r.sessionsMu.RUnlock()
+		if opening == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client still reserved after the dial failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// savedSession is one session mapping persisted across restarts, so the
+// server keeps seeing the same relay source port for each client
+type savedSession struct {
+	Listen    string `json:"listen"`
+	Client    string `json:"client"`
+	LocalPort int    `json:"local_port"`
+	Target    string `json:"target"`
+}
+
+// loadSessionState reads saved sessions from path. A missing file is not an
+// error: it just means there is nothing to restore.
+func loadSessionState(path string) ([]savedSession, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []savedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// writeSessionState atomically replaces path with the given sessions
+func writeSessionState(path string, sessions []savedSession) error {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".session-state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotSessions captures the current session table for persistence
+func (r *Relay) snapshotSessions() []savedSession {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+
+	r.targetConnMu.RLock()
+	target := r.targetConn.String()
+	r.targetConnMu.RUnlock()
+
+	sessions := make([]savedSession, 0, len(r.sessions))
+	for clientKey, session := range r.sessions {
+		session.mu.Lock()
+		localAddr, ok := session.toServerConn.LocalAddr().(*net.UDPAddr)
+		session.mu.Unlock()
+		if !ok {
+			continue
+		}
+		sessions = append(sessions, savedSession{
+			Listen:    r.listenAddr,
+			Client:    clientKey,
+			LocalPort: localAddr.Port,
+			Target:    target,
+		})
+	}
+	return sessions
+}
+
+// restore re-creates saved sessions bound to their previous source ports.
+// This is best effort: sessions whose port is taken are skipped and will be
+// re-created normally when the client sends its next packet.
+func (r *Relay) restore(ctx context.Context, target *net.UDPAddr) {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	restored := 0
+	for _, saved := range r.restoreSessions {
+		clientAddr, err := net.ResolveUDPAddr("udp", saved.Client)
+		if err != nil {
+			continue
+		}
+		if saved.Target != target.String() {
+			log.Printf("[%s] Restoring session %s to current target %s (was %s)",
+				r.listenAddr, r.clientLabel(saved.Client), target, saved.Target)
+		}
+
+		conn, err := r.openServerConn(clientAddr.String(), target, saved.LocalPort)
+		if err != nil {
+			log.Printf("[%s] Could not restore session %s on port %d: %v",
+				r.listenAddr, r.clientLabel(saved.Client), saved.LocalPort, err)
+			continue
+		}
+		if _, err := r.addSession(ctx, clientAddr.String(), clientAddr, nil, r.geo.lookup(clientAddr.IP), conn, target); err != nil {
+			log.Printf("[%s] Could not restore session %s: %v", r.listenAddr, r.clientLabel(saved.Client), err)
+			conn.Close()
+			continue
+		}
+		restored++
+	}
+	log.Printf("[%s] Restored %d of %d saved sessions", r.listenAddr, restored, len(r.restoreSessions))
+	r.restoreSessions = nil
+}
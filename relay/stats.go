@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// relayStats holds the per-relay traffic counters. All fields are updated
+// atomically from the packet paths and read by the admin/metrics endpoints.
+type relayStats struct {
+	packetsToServer   atomic.Uint64
+	bytesToServer     atomic.Uint64
+	packetsToClient   atomic.Uint64
+	bytesToClient     atomic.Uint64
+	dropped           atomic.Uint64 // Packets that could not be forwarded in either direction
+	connRefused       atomic.Uint64 // Sessions closed because the server port was unreachable
+	kernelDropped     atomic.Uint64 // Datagrams dropped by the kernel before the relay read them
+	sessionsLimited   atomic.Uint64 // New sessions refused by the new-session rate limit
+	unroutable        atomic.Uint64 // Shared-connection responses with no matching session
+	sessionsFDLimited atomic.Uint64 // New sessions refused near the file descriptor limit
+	portsExhausted    atomic.Uint64 // New sessions that failed for lack of a free source port
+	sessionsNoPort    atomic.Uint64 // New sessions refused while backing off after running out of source ports
+	emptyDropped      atomic.Uint64 // Zero-length client datagrams dropped by -drop-empty
+	listenRateDropped atomic.Uint64 // Client datagrams dropped after reading by the -xdp-rate fallback
+	writeTimeouts     atomic.Uint64 // Forwarding writes that exceeded -write-timeout
+	bufferTruncations atomic.Uint64 // Packets that filled the read buffer and were likely truncated
+	queueDropped      atomic.Uint64 // Responses dropped because a session's -client-queue was full
+	firstResends      atomic.Uint64 // First packets resent by -first-packet-retries
+	sessionsRecreated atomic.Uint64 // Sessions opened for a client within a minute of its last one closing
+	sessionsCreated   atomic.Uint64
+	sessionsClosed    atomic.Uint64
+	stickyCollisions  atomic.Uint64 // Sessions whose -sticky-ports port was taken, given another port
+	loopsDetected     atomic.Uint64 // Packets -loop-detect-window saw forwarded repeatedly
+	targetsRejected   atomic.Uint64 // DNS answers outside -target-allow-cidr
+	sessionsDrained   atomic.Uint64 // New sessions refused while the target is drained
+	sessionsIPLimited atomic.Uint64 // New sessions refused by -max-sessions-per-ip
+	sessionsEvicted   atomic.Uint64 // Sessions closed to admit a client of a higher -priority-cidr class
+	notHandshake      atomic.Uint64 // Packets from unknown clients dropped by -require-handshake-first
+	shortWrites       atomic.Uint64 // Writes that sent only part of a packet
+	panics            atomic.Uint64 // Panics in packet and session goroutines caught by -recover-panics
+	idleProbes        atomic.Uint64 // Probes -probe-before-close sent to the server for idle sessions
+	deadClients       atomic.Uint64 // Sessions closed by -reap-dead-clients
+	linkRejected      atomic.Uint64 // Packets that failed -relay-link-key authentication
+	ppsLimited        atomic.Uint64 // Packets dropped by -max-pps-per-session
+	mirrored          atomic.Uint64 // Client packets copied to -mirror-target
+	familyMismatch    atomic.Uint64 // -transparent clients whose address family the target doesn't have
+	pausedDrops       atomic.Uint64 // Packets dropped while forwarding was paused by POST /pause
+	duplicated        atomic.Uint64 // Client packet copies sent to -duplicate-targets
+	duplicatesDropped atomic.Uint64 // Responses dropped as copies of one already forwarded
+	portFailovers     atomic.Uint64 // Moves to the next port of a multi-port target
+	sessionSetup      latencyHistogram
+	toServerSizes     *sizeHistogram // Sizes of packets forwarded to the server, nil unless -packet-histogram
+	toClientSizes     *sizeHistogram // Sizes of packets forwarded to the client, nil unless -packet-histogram
+}
+
+// snapshot returns the current counter values keyed by metric name
+func (s *relayStats) snapshot() map[string]any {
+	out := map[string]any{
+		"packets_to_server":   s.packetsToServer.Load(),
+		"bytes_to_server":     s.bytesToServer.Load(),
+		"packets_to_client":   s.packetsToClient.Load(),
+		"bytes_to_client":     s.bytesToClient.Load(),
+		"dropped":             s.dropped.Load(),
+		"conn_refused":        s.connRefused.Load(),
+		"kernel_dropped":      s.kernelDropped.Load(),
+		"sessions_limited":    s.sessionsLimited.Load(),
+		"unroutable":          s.unroutable.Load(),
+		"sessions_fd_limited": s.sessionsFDLimited.Load(),
+		"ports_exhausted":     s.portsExhausted.Load(),
+		"sessions_no_port":    s.sessionsNoPort.Load(),
+		"empty_dropped":       s.emptyDropped.Load(),
+		"listen_rate_dropped": s.listenRateDropped.Load(),
+		"write_timeouts":      s.writeTimeouts.Load(),
+		"buffer_truncations":  s.bufferTruncations.Load(),
+		"queue_dropped":       s.queueDropped.Load(),
+		"first_resends":       s.firstResends.Load(),
+		"sessions_recreated":  s.sessionsRecreated.Load(),
+		"sessions_created":    s.sessionsCreated.Load(),
+		"sessions_closed":     s.sessionsClosed.Load(),
+		"sticky_collisions":   s.stickyCollisions.Load(),
+		"loops_detected":      s.loopsDetected.Load(),
+		"targets_rejected":    s.targetsRejected.Load(),
+		"sessions_drained":    s.sessionsDrained.Load(),
+		"sessions_ip_limited": s.sessionsIPLimited.Load(),
+		"sessions_evicted":    s.sessionsEvicted.Load(),
+		"not_handshake":       s.notHandshake.Load(),
+		"short_writes":        s.shortWrites.Load(),
+		"panics_recovered":    s.panics.Load(),
+		"idle_probes":         s.idleProbes.Load(),
+		"dead_clients_reaped": s.deadClients.Load(),
+		"link_auth_failed":    s.linkRejected.Load(),
+		"pps_limited":         s.ppsLimited.Load(),
+		"packets_mirrored":    s.mirrored.Load(),
+		"family_mismatch":     s.familyMismatch.Load(),
+		"paused_drops":        s.pausedDrops.Load(),
+		"packets_duplicated":  s.duplicated.Load(),
+		"duplicates_dropped":  s.duplicatesDropped.Load(),
+		"port_failovers":      s.portFailovers.Load(),
+		"session_setup_ms":    s.sessionSetup.snapshot(),
+	}
+	if s.toServerSizes != nil {
+		out["sizes_to_server"] = s.toServerSizes.snapshot()
+		out["sizes_to_client"] = s.toClientSizes.snapshot()
+	}
+	return out
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// latencyHistogram is a lock-free, non-cumulative histogram over latencyBuckets,
+// with one extra bucket for observations above the largest bound
+type latencyHistogram struct {
+	counts [8]atomic.Uint64
+	sumNs  atomic.Uint64
+}
+
+// observe records a single latency
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sumNs.Add(uint64(d))
+}
+
+// snapshot returns per-bucket counts keyed by upper bound in milliseconds
+// ("+Inf" for the overflow bucket), plus the total count and sum
+func (h *latencyHistogram) snapshot() map[string]uint64 {
+	out := make(map[string]uint64, len(h.counts)+2)
+	var total uint64
+	for i := range h.counts {
+		label := "+Inf"
+		if i < len(latencyBuckets) {
+			label = strconv.FormatInt(latencyBuckets[i].Milliseconds(), 10)
+		}
+		n := h.counts[i].Load()
+		out[label] = n
+		total += n
+	}
+	out["count"] = total
+	out["sum_ms"] = h.sumNs.Load() / uint64(time.Millisecond)
+	return out
+}
+
+// packetSizeBuckets are the upper bounds in bytes of the packet size
+// histogram buckets; 1280 is the minimum IPv6 MTU and 1420 WireGuard's
+// default MTU
+var packetSizeBuckets = [...]int{64, 128, 256, 512, 1024, 1280, 1420}
+
+// sizeHistogram is a lock-free histogram of packet sizes over
+// packetSizeBuckets, with one extra bucket for larger packets. Methods are
+// no-ops on a nil *sizeHistogram.
+type sizeHistogram struct {
+	counts [len(packetSizeBuckets) + 1]atomic.Uint64
+}
+
+// observe records one packet of n bytes
+func (h *sizeHistogram) observe(n int) {
+	if h == nil {
+		return
+	}
+	i := 0
+	for i < len(packetSizeBuckets) && n > packetSizeBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+}
+
+// snapshot returns the count of each bucket keyed by its size range, e.g.
+// "1281-1420" or ">1420"
+func (h *sizeHistogram) snapshot() map[string]uint64 {
+	out := make(map[string]uint64, len(h.counts))
+	low := 0
+	for i, bound := range packetSizeBuckets {
+		out[strconv.Itoa(low)+"-"+strconv.Itoa(bound)] = h.counts[i].Load()
+		low = bound + 1
+	}
+	out[">"+strconv.Itoa(packetSizeBuckets[len(packetSizeBuckets)-1])] = h.counts[len(packetSizeBuckets)].Load()
+	return out
+}
+
+// sessionCount returns the number of active sessions on the relay
+func (r *Relay) sessionCount() int {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+
+	return len(r.sessions)
+}
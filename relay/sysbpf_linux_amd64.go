@@ -0,0 +1,4 @@
+package relay
+
+// sysBPF is the bpf(2) system call number, missing from package syscall on amd64
+const sysBPF = 321
@@ -0,0 +1,5 @@
+package relay
+
+import "syscall"
+
+const sysBPF = syscall.SYS_BPF
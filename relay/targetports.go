@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseTargetPorts returns the ports of a target given as host:port1,port2,...
+// for port failover, or nil for a target with a single port
+func parseTargetPorts(target string) ([]int, error) {
+	_, portList, err := net.SplitHostPort(target)
+	if err != nil || !strings.Contains(portList, ",") {
+		return nil, nil
+	}
+	var ports []int
+	for _, p := range strings.Split(portList, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q in target %s", p, target)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// activeTargetPort returns the port to use in place of the one in the target
+// string: the current failover port of a multi-port target, or -target-port
+// (0 keeps the target's own port)
+func (r *Relay) activeTargetPort() int {
+	if r.targetPorts != nil {
+		return r.targetPorts[r.targetPortIdx.Load()]
+	}
+	return r.targetPort
+}
+
+// targetRefused fails new sessions over to the next port of a multi-port
+// target once the port in use refuses packets (ICMP port unreachable).
+// Sessions on the refused port are closed as usual, and their clients
+// reconnect on the new port. A refusal from a port already failed over from
+// changes nothing.
+func (r *Relay) targetRefused(from net.Addr) {
+	udpAddr, ok := from.(*net.UDPAddr)
+	if r.targetPorts == nil || !ok {
+		return
+	}
+	idx := r.targetPortIdx.Load()
+	if r.targetPorts[idx] != udpAddr.Port {
+		return
+	}
+	next := (idx + 1) % int32(len(r.targetPorts))
+	if !r.targetPortIdx.CompareAndSwap(idx, next) {
+		return
+	}
+
+	r.targetConnMu.Lock()
+	target := *r.targetConn
+	target.Port = r.targetPorts[next]
+	r.targetConn = &target
+	r.targetConnMu.Unlock()
+	r.stats.portFailovers.Add(1)
+	log.Printf("[%s] Target port %d refused packets; new sessions fail over to %s", r.listenAddr, udpAddr.Port, &target)
+}
@@ -0,0 +1,342 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tcpFrameHeader is the size of the big-endian length prefix before every
+// packet on a -tcp-ports connection
+const tcpFrameHeader = 2
+
+// tcpBridge accepts TCP connections from clients on UDP-blocked networks
+// (-tcp-ports) and relays the WireGuard packets they carry to the UDP target.
+// Each packet travels as a 2-byte big-endian length followed by that many
+// bytes, in both directions. Every connection is a session of its own with
+// a server socket of its own, like a UDP client's: it passes the same
+// admission checks, is listed in /sessions, follows the target to a new
+// address after a DNS change and is closed after -timeout without a packet
+// from the client. The bridge borrows its target, server socket options,
+// limits and counters from relay.
+type tcpBridge struct {
+	listenAddr string
+	relay      *Relay
+}
+
+// runTCPBridge accepts connections on addr until ctx is cancelled
+func runTCPBridge(ctx context.Context, addr string, relay *Relay) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	b := &tcpBridge{listenAddr: addr, relay: relay}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Printf("TCP bridge started: %s -> %s", addr, relay.targetAddr)
+	var conns sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Printf("[tcp %s] Error accepting connection: %v", addr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			b.serve(ctx, conn.(*net.TCPConn))
+		}()
+	}
+	conns.Wait()
+	log.Printf("[tcp %s] TCP bridge stopped", addr)
+	return nil
+}
+
+// serve relays one client connection until either side closes it, the
+// client goes idle or ctx is cancelled
+func (b *tcpBridge) serve(ctx context.Context, client *net.TCPConn) {
+	r := b.relay
+	defer client.Close()
+	clientKey := client.RemoteAddr().String()
+	defer r.recoverPanic("TCP bridge", clientKey, nil)
+
+	// The first packet decides whether the client may have a session
+	reader := bufio.NewReader(client)
+	packet := make([]byte, 65535)
+	size, err := b.readFrame(client, reader, packet)
+	if err != nil {
+		return
+	}
+	remote := client.RemoteAddr().(*net.TCPAddr)
+	session, target, err := b.open(clientKey, &net.UDPAddr{IP: remote.IP, Port: remote.Port, Zone: remote.Zone}, packet[:size])
+	if err != nil {
+		if !errors.Is(err, ErrSessionLimit) && !errors.Is(err, ErrNotHandshake) {
+			log.Printf("[tcp %s] Failed to open server connection for %s: %v", b.listenAddr, r.clientLabel(clientKey), redactAddrs(err))
+		}
+		return
+	}
+	defer b.close(clientKey, session)
+	client.SetNoDelay(true)
+	log.Printf("[tcp %s] New TCP session: %s -> %s -> %s",
+		b.listenAddr, r.clientLabel(clientKey), session.toServerConn.LocalAddr(), target)
+
+	// Closing both sockets unblocks whichever direction is still running
+	closeBoth := func() {
+		session.mu.Lock()
+		session.closed = true
+		server := session.toServerConn
+		session.mu.Unlock()
+		client.Close()
+		server.Close()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeBoth()
+		case <-done:
+		}
+	}()
+	b.startReader(session, client, clientKey, closeBoth)
+	err = b.clientToServer(session, target, client, reader, packet, size, clientKey, closeBoth)
+	closeBoth()
+	session.mu.Lock()
+	readerDone := session.readerDone
+	session.mu.Unlock()
+	<-readerDone
+
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+		log.Printf("[tcp %s] Closed TCP session %s: %v", b.listenAddr, r.clientLabel(clientKey), redactAddrs(err))
+	} else {
+		log.Printf("[tcp %s] Closed TCP session %s", b.listenAddr, r.clientLabel(clientKey))
+	}
+}
+
+// sessionListen is the listen address the bridge's sessions are registered
+// under, told apart from the relay's UDP port
+func (b *tcpBridge) sessionListen() string {
+	return "tcp " + b.listenAddr
+}
+
+// open admits a client whose first packet is first, as handleClientPacket
+// does for UDP clients, and opens its session to the current target,
+// returning the session and that target
+func (b *tcpBridge) open(clientKey string, clientAddr *net.UDPAddr, first []byte) (*ClientSession, *net.UDPAddr, error) {
+	r := b.relay
+	class := r.clientPriority(clientAddr.IP)
+	admit := func() error {
+		r.sessionsMu.Lock()
+		defer r.sessionsMu.Unlock()
+		return r.admitSession(first, clientAddr, class, time.Now())
+	}
+	if err := admit(); err != nil {
+		return nil, nil, err
+	}
+
+	r.targetConnMu.RLock()
+	target := r.targetConn
+	r.targetConnMu.RUnlock()
+	if target == nil {
+		return nil, nil, ErrTargetUnreachable
+	}
+	if !r.fds.admit() {
+		r.stats.sessionsFDLimited.Add(1)
+		return nil, nil, fmt.Errorf("%w: file descriptors", ErrSessionLimit)
+	}
+	server, err := r.dialServer(target, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	session := &ClientSession{
+		clientAddr:   clientAddr,
+		createdAt:    now,
+		priority:     class,
+		toServerConn: server,
+		lastClient:   now,
+		lastServer:   now,
+	}
+	if !r.registry.tryRegister(r, b.sessionListen(), clientKey, session, r.maxPerIP) {
+		server.Close()
+		r.stats.sessionsIPLimited.Add(1)
+		return nil, nil, fmt.Errorf("%w: %d sessions per IP", ErrSessionLimit, r.maxPerIP)
+	}
+	r.fds.add(2)
+	return session, target, nil
+}
+
+// close forgets a session opened by open
+func (b *tcpBridge) close(clientKey string, session *ClientSession) {
+	b.relay.registry.remove(b.sessionListen(), clientKey, session)
+	b.relay.fds.add(-2)
+}
+
+// startReader relays responses from the session's current server connection
+// to the client. The session ends when that connection fails, unless a
+// migration has replaced it.
+func (b *tcpBridge) startReader(session *ClientSession, client *net.TCPConn, clientKey string, closeBoth func()) {
+	session.mu.Lock()
+	server := session.toServerConn
+	done := make(chan struct{})
+	session.readerDone = done
+	session.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer func() {
+			session.mu.Lock()
+			current := session.toServerConn == server
+			session.mu.Unlock()
+			if current {
+				closeBoth()
+			}
+		}()
+		defer b.relay.recoverPanic("TCP bridge", clientKey, nil)
+		b.serverToClient(session, server, client, clientKey)
+	}()
+}
+
+// migrate moves the session to a new server connection to target once the
+// old connection's reader has exited, so responses never interleave
+func (b *tcpBridge) migrate(session *ClientSession, target *net.UDPAddr, client *net.TCPConn, clientKey string, closeBoth func()) error {
+	r := b.relay
+	server, err := r.dialServer(target, 0)
+	if err != nil {
+		return fmt.Errorf("migrating to %s: %w", target, err)
+	}
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		server.Close()
+		return net.ErrClosed
+	}
+	old, done := session.toServerConn, session.readerDone
+	session.toServerConn = server
+	session.mu.Unlock()
+
+	old.Close()
+	<-done
+	b.startReader(session, client, clientKey, closeBoth)
+	r.logSession("[tcp %s] Migrated TCP session: %s", b.listenAddr, r.clientLabel(clientKey))
+	return nil
+}
+
+// readFrame reads the next packet from the client into packet, returning
+// its size, and fails once the client has been idle for the relay's timeout
+func (b *tcpBridge) readFrame(client *net.TCPConn, reader *bufio.Reader, packet []byte) (int, error) {
+	timeout := b.relay.timeout
+	var header [tcpFrameHeader]byte
+	client.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("idle for %s", timeout)
+		}
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(reader, packet[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// clientToServer sends the first size bytes of packet, then every following
+// packet from the client, to the server until the connection fails or stays
+// idle for the relay's timeout. target is the address the session's server
+// connection was opened to; the session follows the relay to a new one.
+func (b *tcpBridge) clientToServer(session *ClientSession, target *net.UDPAddr, client *net.TCPConn,
+	reader *bufio.Reader, packet []byte, size int, clientKey string, closeBoth func()) error {
+	r := b.relay
+	for {
+		r.targetConnMu.RLock()
+		current := r.targetConn
+		r.targetConnMu.RUnlock()
+		if current != target {
+			if err := b.migrate(session, current, client, clientKey, closeBoth); err != nil {
+				return err
+			}
+			target = current
+		}
+
+		session.mu.Lock()
+		session.lastClient = time.Now()
+		server := session.toServerConn
+		session.mu.Unlock()
+		n, err := server.Write(packet[:size])
+		switch {
+		case err != nil:
+			r.stats.dropped.Add(1)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			session.recordError("forwarding to server", classify(err))
+			log.Printf("[tcp %s] Error forwarding to target for %s: %v", b.listenAddr, r.clientLabel(clientKey), redactAddrs(err))
+		case n != size:
+			r.shortWrite("server", session, clientKey, shortWriteError(n, size))
+		default:
+			r.stats.packetsToServer.Add(1)
+			r.stats.bytesToServer.Add(uint64(n))
+			r.stats.toServerSizes.observe(n)
+		}
+
+		if size, err = b.readFrame(client, reader, packet); err != nil {
+			return err
+		}
+	}
+}
+
+// serverToClient frames the server's responses onto the client connection
+// until either socket is closed
+func (b *tcpBridge) serverToClient(session *ClientSession, server net.Conn, client *net.TCPConn, clientKey string) {
+	r := b.relay
+	frame := make([]byte, tcpFrameHeader+65535)
+	for {
+		n, err := server.Read(frame[tcpFrameHeader:])
+		if err != nil {
+			// An ICMP port unreachable from the target doesn't end the
+			// session, as UDP keeps working once the server is back
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				r.markTargetDown()
+				continue
+			}
+			return
+		}
+		now := time.Now()
+		r.markTargetUp(now)
+		session.mu.Lock()
+		session.lastServer = now
+		session.mu.Unlock()
+		binary.BigEndian.PutUint16(frame, uint16(n))
+		if r.writeTimeout > 0 {
+			client.SetWriteDeadline(now.Add(r.writeTimeout))
+		}
+		if _, err := client.Write(frame[:tcpFrameHeader+n]); err != nil {
+			r.stats.dropped.Add(1)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[tcp %s] Error sending to client %s: %v", b.listenAddr, r.clientLabel(clientKey), redactAddrs(err))
+			}
+			return
+		}
+		r.stats.packetsToClient.Add(1)
+		r.stats.bytesToClient.Add(uint64(n))
+		r.stats.toClientSizes.observe(n)
+	}
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// runBridge runs a TCP bridge for r on a free loopback port until the test
+// ends and returns its address
+func runBridge(t *testing.T, r *Relay) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- runTCPBridge(ctx, addr, r) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errs
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("TCP bridge on %s did not start", addr)
+	return ""
+}
+
+// tcpRoundTrip sends payload as a frame on conn and returns the frame that
+// comes back, or an error if the connection is closed instead
+func tcpRoundTrip(conn net.Conn, payload string) (string, error) {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+	if _, err := conn.Write(append(frame, payload...)); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var header [tcpFrameHeader]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(header[:]))
+	_, err := io.ReadFull(conn, reply)
+	return string(reply), err
+}
+
+// bridgeSessionPort returns the server-side port of the TCP session
+// registered for client, or 0 if there is none
+func bridgeSessionPort(r *Relay, bridge string, client net.Conn) int {
+	for _, info := range r.registry.snapshot() {
+		if info.Listen == "tcp "+bridge && info.Client == client.LocalAddr().String() {
+			return info.LocalPort
+		}
+	}
+	return 0
+}
+
+func TestTCPBridgeSessions(t *testing.T) {
+	targets := []*net.UDPAddr{echoServer(t, nil), echoServer(t, net.IPv4(127, 0, 0, 2))}
+	r := runRelay(t, RelayConfig{Target: targets[0].String(), MaxSessionsPerIP: 2})
+	bridge := runBridge(t, r)
+
+	first, err := net.Dial("tcp", bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if got, err := tcpRoundTrip(first, "hello"); err != nil || got != "hello" {
+		t.Fatalf("reply %q, %v; want %q", got, err, "hello")
+	}
+	port := bridgeSessionPort(r, bridge, first)
+	if port == 0 {
+		t.Fatal("TCP session missing from the session registry")
+	}
+
+	// A UDP session takes the client IP's last slot, refusing more clients
+	roundTrip(t, relayClient(t, r, nil, net.IPv4(127, 0, 0, 1)), "udp")
+	second, err := net.Dial("tcp", bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if got, err := tcpRoundTrip(second, "refused"); err == nil {
+		t.Errorf("client over -max-sessions-per-ip got reply %q", got)
+	}
+
+	// After a DNS change the session moves to a new server connection
+	r.targetConnMu.Lock()
+	r.targetConn = targets[1]
+	r.targetConnMu.Unlock()
+	if got, err := tcpRoundTrip(first, "moved"); err != nil || got != "moved" {
+		t.Fatalf("reply %q, %v after migrating; want %q", got, err, "moved")
+	}
+	if moved := bridgeSessionPort(r, bridge, first); moved == 0 || moved == port {
+		t.Errorf("server port %d after migrating, was %d", moved, port)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for bridgeSessionPort(r, bridge, first) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed TCP session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPBridgeRequiresHandshake(t *testing.T) {
+	r := runRelay(t, RelayConfig{Target: echoServer(t, nil).String(), RequireHandshake: true})
+	bridge := runBridge(t, r)
+
+	conn, err := net.Dial("tcp", bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := tcpRoundTrip(conn, "not a handshake"); err == nil {
+		t.Errorf("non-handshake first packet got reply %q", got)
+	}
+	if n := r.stats.notHandshake.Load(); n != 1 {
+		t.Errorf("%d packets counted as not a handshake, want 1", n)
+	}
+
+	conn, err = net.Dial("tcp", bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	initiation := make([]byte, wgInitiationSize)
+	initiation[0] = wgMessageInitiation
+	if got, err := tcpRoundTrip(conn, string(initiation)); err != nil || got != string(initiation) {
+		t.Errorf("handshake initiation not relayed: %v", err)
+	}
+}
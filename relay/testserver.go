@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+)
+
+// testResponderMaxPeers bounds the responder's handshake table; it is
+// cleared when full, which only costs the affected clients a re-handshake
+const testResponderMaxPeers = 4096
+
+// testResponder emulates just enough of a WireGuard server to check a relay
+// deployment end to end (-test-server, -selftest). It is NOT a WireGuard
+// implementation and does no cryptography:
+//   - a handshake initiation gets a canned handshake response addressed to
+//     the initiator's sender index
+//   - a transport message for a known index is echoed back, re-addressed to
+//     the peer, so keepalives and data round-trip
+//   - anything that isn't WireGuard is echoed unchanged
+//
+// Real WireGuard clients will not complete a handshake against it; use it
+// with a test client that checks message types and indexes.
+type testResponder struct {
+	peers map[uint32]uint32 // Our receiver index -> the peer's sender index
+	next  uint32
+}
+
+// serveTestResponder answers packets on conn until it is closed
+func serveTestResponder(conn *net.UDPConn) {
+	t := &testResponder{peers: make(map[uint32]uint32)}
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if reply := t.respond(buffer[:n], addr); reply != nil {
+			conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+// respond returns the reply to packet, or nil to stay silent
+func (t *testResponder) respond(packet []byte, from *net.UDPAddr) []byte {
+	msgType, ok := wgMessageType(packet)
+	if !ok {
+		return packet
+	}
+
+	switch msgType {
+	case wgMessageInitiation:
+		sender, _ := wgSenderIndex(packet)
+		if len(t.peers) >= testResponderMaxPeers {
+			t.peers = make(map[uint32]uint32)
+		}
+		t.next++
+		t.peers[t.next] = sender
+		log.Printf("Test server: handshake initiation from %s (sender index %d), answering as index %d", from, sender, t.next)
+
+		reply := make([]byte, wgResponseSize)
+		reply[0] = wgMessageResponse
+		binary.LittleEndian.PutUint32(reply[4:8], t.next)
+		binary.LittleEndian.PutUint32(reply[8:12], sender)
+		return reply
+
+	case wgMessageTransport:
+		receiver, _ := wgReceiverIndex(packet)
+		peer, known := t.peers[receiver]
+		if !known {
+			// A real server drops transport messages for unknown sessions
+			return nil
+		}
+		reply := append([]byte(nil), packet...)
+		binary.LittleEndian.PutUint32(reply[4:8], peer)
+		return reply
+	}
+	return nil
+}
+
+// RunTestServer runs the test responder on addr until ctx is cancelled
+func RunTestServer(ctx context.Context, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Test server listening on %s: a WireGuard-like responder for testing relays, not a WireGuard server", conn.LocalAddr())
+	serveTestResponder(conn)
+	log.Printf("Test server stopped")
+	return nil
+}
@@ -0,0 +1,22 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// warnLogInterval limits how often each kind of repeated warning is logged
+const warnLogInterval = 10 * time.Second
+
+// logThrottle lets a repeated warning through at most once per
+// warnLogInterval, whichever goroutine raises it. The zero value lets the
+// first warning through.
+type logThrottle struct {
+	last atomic.Int64 // Unix nanoseconds of the last warning let through
+}
+
+// allow reports whether a warning raised at now may be logged
+func (t *logThrottle) allow(now time.Time) bool {
+	last := t.last.Load()
+	return now.UnixNano()-last >= int64(warnLogInterval) && t.last.CompareAndSwap(last, now.UnixNano())
+}
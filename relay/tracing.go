@@ -0,0 +1,276 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	traceExportInterval = 5 * time.Second  // How often finished spans are sent to -otlp-endpoint
+	traceExportTimeout  = 10 * time.Second // Deadline for one export request
+	traceMaxPending     = 4096             // Finished spans buffered between exports; more are dropped
+	otlpSpanKindServer  = 2                // SPAN_KIND_SERVER
+)
+
+// otlpTracer exports each session as an OpenTelemetry span, from creation to
+// close, over OTLP/HTTP with JSON encoding (-otlp-endpoint). Spans are
+// buffered when they end and sent in batches every traceExportInterval; a
+// batch the collector doesn't accept is dropped rather than slowing the
+// relay. Every method is a no-op on a nil *otlpTracer, which is what relays
+// get when tracing is disabled.
+type otlpTracer struct {
+	url      string
+	resource []otlpAttribute
+	client   *http.Client
+	mu       sync.Mutex
+	pending  []otlpSpan
+	dropped  int        // Spans dropped since the last export
+	exportMu sync.Mutex // Serializes flushes, guards failing
+	failing  bool       // Whether the last export failed, to log only changes
+}
+
+// sessionSpan is the open span of one session. Events may be added from any
+// goroutine; the byte counts become attributes when it ends.
+type sessionSpan struct {
+	traceID       string
+	spanID        string
+	start         time.Time
+	attributes    []otlpAttribute
+	bytesToServer atomic.Uint64
+	bytesToClient atomic.Uint64
+	mu            sync.Mutex
+	events        []otlpEvent
+}
+
+// OTLP/JSON encoding of the spans the relay emits. IDs are hex and 64-bit
+// integers are decimal strings, as the OTLP/JSON mapping requires.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+}
+
+func stringAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: strconv.FormatInt(value, 10)}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// newOTLPTracer creates a tracer exporting to endpoint, a collector's
+// OTLP/HTTP address. A bare host:port is taken as plain HTTP, and an endpoint
+// without a path gets the standard /v1/traces.
+func newOTLPTracer(endpoint string, build buildInfo) (*otlpTracer, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q: scheme must be http or https", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q: missing host", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &otlpTracer{
+		url: u.String(),
+		resource: []otlpAttribute{
+			stringAttr("service.name", "wg-udp-relay"),
+			stringAttr("service.version", build.Version),
+		},
+		client: &http.Client{Timeout: traceExportTimeout},
+	}, nil
+}
+
+// startSpan opens a session span with the given attributes, or returns nil
+// when tracing is disabled
+func (t *otlpTracer) startSpan(attributes ...otlpAttribute) *sessionSpan {
+	if t == nil {
+		return nil
+	}
+	var ids [24]byte
+	rand.Read(ids[:])
+	return &sessionSpan{
+		traceID:    hex.EncodeToString(ids[:16]),
+		spanID:     hex.EncodeToString(ids[16:]),
+		start:      time.Now(),
+		attributes: attributes,
+	}
+}
+
+// event records a named event on the span
+func (s *sessionSpan) event(name string, attributes ...otlpAttribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, otlpEvent{TimeUnixNano: unixNano(time.Now()), Name: name, Attributes: attributes})
+	s.mu.Unlock()
+}
+
+// countToServer and countToClient add forwarded bytes to the span
+func (s *sessionSpan) countToServer(n int) {
+	if s != nil {
+		s.bytesToServer.Add(uint64(n))
+	}
+}
+
+func (s *sessionSpan) countToClient(n int) {
+	if s != nil {
+		s.bytesToClient.Add(uint64(n))
+	}
+}
+
+// end closes the span and queues it for export
+func (t *otlpTracer) end(s *sessionSpan) {
+	if t == nil || s == nil {
+		return
+	}
+	s.mu.Lock()
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		Name:              "session",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+		Attributes: append(s.attributes[:len(s.attributes):len(s.attributes)],
+			intAttr("relay.bytes_to_server", int64(s.bytesToServer.Load())),
+			intAttr("relay.bytes_to_client", int64(s.bytesToClient.Load()))),
+		Events: s.events,
+	}
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	if len(t.pending) < traceMaxPending {
+		t.pending = append(t.pending, span)
+	} else {
+		t.dropped++
+	}
+	t.mu.Unlock()
+}
+
+// run exports finished spans every traceExportInterval until ctx is
+// cancelled; flush sends what is left on shutdown
+func (t *otlpTracer) run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+// flush exports every span that has ended since the last export
+func (t *otlpTracer) flush() {
+	if t == nil {
+		return
+	}
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("Warning: Dropped %d session spans, more than %d ended between exports", dropped, traceMaxPending)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	err := t.export(spans)
+	if err != nil && !t.failing {
+		log.Printf("Warning: Exporting session spans to %s failed, dropping them until it recovers: %v", t.url, err)
+	} else if err == nil && t.failing {
+		log.Printf("Exporting session spans to %s recovered", t.url)
+	}
+	t.failing = err != nil
+}
+
+// export sends spans in one OTLP/HTTP request
+func (t *otlpTracer) export(spans []otlpSpan) error {
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	var rs resourceSpans
+	rs.Resource.Attributes = t.resource
+	rs.ScopeSpans = []scopeSpans{{Spans: spans}}
+	rs.ScopeSpans[0].Scope.Name = "wg-udp-relay"
+	body, err := json.Marshal(map[string][]resourceSpans{"resourceSpans": {rs}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
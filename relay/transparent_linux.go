@@ -0,0 +1,50 @@
+//go:build linux
+
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT, missing from package syscall
+const ipv6Transparent = 75
+
+// transparentControl returns a net.Dialer Control hook that lets a socket
+// bind to a non-local address (IP_TRANSPARENT), and marks it with mark
+// unless that is 0
+func transparentControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "udp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			}
+		})
+		if err == nil {
+			err = sockErr
+		}
+		if err == nil && mark != 0 {
+			err = setFwmark(c, mark)
+		}
+		return err
+	}
+}
+
+// checkTransparent verifies that sockets can be made transparent by trying
+// a throwaway one, which fails without CAP_NET_ADMIN
+func checkTransparent() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("setting IP_TRANSPARENT needs CAP_NET_ADMIN: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Transparent forwarding is only implemented on Linux
+var errTransparentUnsupported = errors.New("-transparent is only supported on Linux")
+
+func transparentControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errTransparentUnsupported
+	}
+}
+
+func checkTransparent() error { return errTransparentUnsupported }
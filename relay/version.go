@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set by SetVersion from the version the command was built with
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// SetVersion records the version and commit the binary was built from, as
+// shown in logs, /stats and traces. An empty commit is filled in from the
+// VCS information the Go toolchain embeds.
+func SetVersion(buildVersion, buildCommit string) {
+	version, commit = buildVersion, buildCommit
+}
+
+// Version describes the running binary: its version, commit and Go version
+func Version() string {
+	return readBuildInfo().String()
+}
+
+// buildInfo describes the running binary
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+}
+
+// readBuildInfo combines the ldflags version with what the Go toolchain
+// embedded in the binary. The VCS revision fills in a missing commit when
+// building from a git checkout without ldflags.
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, GoVersion: "unknown"}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+				if len(info.Commit) > 12 {
+					info.Commit = info.Commit[:12]
+				}
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	s := "wg-udp-relay " + b.Version
+	if b.Commit != "" {
+		s += " (commit " + b.Commit
+		if b.Modified {
+			s += ", modified"
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s, %s", s, b.GoVersion)
+}
@@ -0,0 +1,72 @@
+package relay
+
+import "encoding/binary"
+
+// WireGuard message types and fixed sizes (see the WireGuard whitepaper, §5.4)
+const (
+	wgMessageInitiation  = 1
+	wgMessageResponse    = 2
+	wgMessageCookieReply = 3
+	wgMessageTransport   = 4
+
+	wgInitiationSize     = 148
+	wgResponseSize       = 92
+	wgCookieReplySize    = 64
+	wgTransportMinLength = 32
+)
+
+// wgKeepaliveMisses is how many consecutive keepalives a -wg-aware session
+// may miss before it is reaped
+const wgKeepaliveMisses = 2
+
+// wgMessageType returns the WireGuard message type of packet, checking the
+// reserved bytes and minimum length for that type
+func wgMessageType(packet []byte) (byte, bool) {
+	if len(packet) < 4 || packet[1] != 0 || packet[2] != 0 || packet[3] != 0 {
+		return 0, false
+	}
+	switch packet[0] {
+	case wgMessageInitiation:
+		return packet[0], len(packet) == wgInitiationSize
+	case wgMessageResponse:
+		return packet[0], len(packet) == wgResponseSize
+	case wgMessageCookieReply:
+		return packet[0], len(packet) == wgCookieReplySize
+	case wgMessageTransport:
+		return packet[0], len(packet) >= wgTransportMinLength
+	}
+	return 0, false
+}
+
+// wgSenderIndex returns the sender index of a handshake initiation or
+// response, i.e. the index the peer will receive replies under
+func wgSenderIndex(packet []byte) (uint32, bool) {
+	t, ok := wgMessageType(packet)
+	if !ok || (t != wgMessageInitiation && t != wgMessageResponse) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(packet[4:8]), true
+}
+
+// wgReceiverIndex returns the receiver index of a handshake response, cookie
+// reply or transport message
+func wgReceiverIndex(packet []byte) (uint32, bool) {
+	t, ok := wgMessageType(packet)
+	if !ok {
+		return 0, false
+	}
+	switch t {
+	case wgMessageResponse:
+		return binary.LittleEndian.Uint32(packet[8:12]), true
+	case wgMessageCookieReply, wgMessageTransport:
+		return binary.LittleEndian.Uint32(packet[4:8]), true
+	}
+	return 0, false
+}
+
+// wgIsKeepalive reports whether packet is a WireGuard keepalive: a transport
+// message with an empty payload
+func wgIsKeepalive(packet []byte) bool {
+	t, ok := wgMessageType(packet)
+	return ok && t == wgMessageTransport && len(packet) == wgTransportMinLength
+}
@@ -0,0 +1,42 @@
+package relay
+
+import "net"
+
+// writeDatagram sends parts as one datagram, so framing such as the
+// -relay-link-key tag can go out alongside a packet without copying it. An
+// unwrapped UDP socket sends the parts with a single writev(2) (WSASend on
+// Windows). Anything else would send each part as a datagram of its own, so
+// the parts are joined first. It returns the bytes written.
+func writeDatagram(conn net.Conn, parts ...[]byte) (int, error) {
+	if udp, ok := conn.(*net.UDPConn); ok && datagramWritev {
+		bufs := net.Buffers(parts)
+		n, err := bufs.WriteTo(udp)
+		return int(n), err
+	}
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	packet := make([]byte, 0, size)
+	for _, part := range parts {
+		packet = append(packet, part...)
+	}
+	return conn.Write(packet)
+}
+
+// writePrefixed sends prefix followed by data as one datagram, returning the
+// bytes of data written. Without a prefix it is a plain Write.
+func writePrefixed(conn net.Conn, prefix [][]byte, data []byte) (int, error) {
+	if len(prefix) == 0 {
+		return conn.Write(data)
+	}
+	size := 0
+	for _, part := range prefix {
+		size += len(part)
+	}
+	n, err := writeDatagram(conn, append(prefix[:len(prefix):len(prefix)], data)...)
+	if n -= size; n < 0 {
+		n = 0
+	}
+	return n, err
+}
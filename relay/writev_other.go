@@ -0,0 +1,6 @@
+//go:build !unix && !windows
+
+package relay
+
+// Elsewhere net.Buffers writes each part separately
+const datagramWritev = false
@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpPair returns a client socket connected to a listening one on loopback
+func udpPair(tb testing.TB) (client, server *net.UDPConn) {
+	tb.Helper()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { server.Close() })
+	client, err = net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client, server
+}
+
+func TestWritePrefixedSendsOneDatagram(t *testing.T) {
+	client, server := udpPair(t)
+	header := []byte("header:")
+	payload := []byte("payload")
+
+	n, err := writePrefixed(client, [][]byte{header}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(payload) {
+		t.Errorf("wrote %d bytes of payload, want %d", n, len(payload))
+	}
+
+	buf := make([]byte, 64)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(header, payload...); !bytes.Equal(buf[:n], want) {
+		t.Errorf("received %q, want %q", buf[:n], want)
+	}
+}
+
+// BenchmarkWriteDatagram compares sending a framing header and a packet with
+// writev against joining them into a new buffer first
+func BenchmarkWriteDatagram(b *testing.B) {
+	header := make([]byte, 16)
+	payload := make([]byte, 1400)
+
+	b.Run("writev", func(b *testing.B) {
+		client, _ := udpPair(b)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(header) + len(payload)))
+		for i := 0; i < b.N; i++ {
+			if _, err := writePrefixed(client, [][]byte{header}, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("concat", func(b *testing.B) {
+		client, _ := udpPair(b)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(header) + len(payload)))
+		for i := 0; i < b.N; i++ {
+			packet := make([]byte, 0, len(header)+len(payload))
+			packet = append(packet, header...)
+			packet = append(packet, payload...)
+			if _, err := client.Write(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
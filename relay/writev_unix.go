@@ -0,0 +1,7 @@
+//go:build unix || windows
+
+package relay
+
+// datagramWritev reports whether net.Buffers writes to a UDP socket with a
+// single system call, keeping the parts in one datagram
+const datagramWritev = true
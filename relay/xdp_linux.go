@@ -0,0 +1,410 @@
+//go:build linux && (amd64 || arm64)
+
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// bpf(2) commands, map and program types and constants used by the XDP
+// limiter, from linux/bpf.h
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfLinkCreate    = 28
+
+	bpfMapTypeHash   = 1
+	bpfProgTypeXDP   = 6
+	bpfAttachXDP     = 37
+	bpfPseudoMapFD   = 1
+	bpfFuncMapLookup = 1
+	bpfFuncKtimeNs   = 5
+
+	xdpDrop = 1
+	xdpPass = 2
+)
+
+// xdpPortValue is the limiter's map value for one listen port, in the layout
+// the program reads: the current one-second window's start and packet count,
+// packets dropped so far and the packets allowed per window
+type xdpPortValue struct {
+	window  uint64
+	count   uint64
+	dropped uint64
+	limit   uint64
+}
+
+// xdpLimiter is an XDP program attached to one interface that drops UDP
+// packets to the relay's listen ports beyond a per-port rate, before they
+// reach the network stack. It is attached through a BPF link, so the kernel
+// detaches it when the process exits, even if it crashes.
+type xdpLimiter struct {
+	iface  string
+	rate   int
+	mapFD  int
+	progFD int
+	linkFD int
+}
+
+// attachXDP loads the limiter, allowing rate packets per second to each of
+// ports, and attaches it to iface
+func attachXDP(iface string, ports []int, rate int) (*xdpLimiter, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", iface, err)
+	}
+	x := &xdpLimiter{iface: iface, rate: rate, mapFD: -1, progFD: -1, linkFD: -1}
+	if x.mapFD, err = bpfCreateMap(bpfMapTypeHash, 4, int(unsafe.Sizeof(xdpPortValue{})), len(ports)); err != nil {
+		return nil, fmt.Errorf("creating BPF map (needs CAP_BPF or CAP_SYS_ADMIN): %v", err)
+	}
+	for _, port := range ports {
+		key := uint32(port)
+		value := xdpPortValue{limit: uint64(rate)}
+		if err := bpfMapElem(bpfMapUpdateElem, x.mapFD, unsafe.Pointer(&key), unsafe.Pointer(&value)); err != nil {
+			x.close()
+			return nil, fmt.Errorf("setting the limit of port %d: %v", port, err)
+		}
+	}
+	if x.progFD, err = bpfLoadXDP(xdpLimiterProgram(x.mapFD)); err != nil {
+		x.close()
+		return nil, fmt.Errorf("loading XDP program: %v", err)
+	}
+	if x.linkFD, err = bpfLinkXDP(x.progFD, ifi.Index); err != nil {
+		x.close()
+		return nil, fmt.Errorf("attaching XDP program to %s (needs Linux 5.9 or later): %v", iface, err)
+	}
+	return x, nil
+}
+
+// dropped returns how many packets to port the program has dropped
+func (x *xdpLimiter) dropped(port int) uint64 {
+	key := uint32(port)
+	var value xdpPortValue
+	if bpfMapElem(bpfMapLookupElem, x.mapFD, unsafe.Pointer(&key), unsafe.Pointer(&value)) != nil {
+		return 0
+	}
+	return value.dropped
+}
+
+// close detaches the program and releases its map
+func (x *xdpLimiter) close() {
+	for _, fd := range []int{x.linkFD, x.progFD, x.mapFD} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	x.linkFD, x.progFD, x.mapFD = -1, -1, -1
+}
+
+// xdpLimiterProgram assembles the limiter. For an IPv4 or IPv6 packet
+// carrying UDP (directly, without extension headers or VLAN tags), it looks
+// the destination port up in the map at mapFD and drops the packet once the
+// port's count in the current one-second window passes its limit. Everything
+// else passes. Windows restart racily across CPUs, which only makes the
+// limit approximate.
+func xdpLimiterProgram(mapFD int) []bpfInsn {
+	var a bpfAsm
+	a.ldx(bpfW, 2, 1, 0) // r2 = data
+	a.ldx(bpfW, 3, 1, 4) // r3 = data_end
+	a.movReg(4, 2)
+	a.addImm(4, 14)
+	a.jmpReg(bpfJGT, 4, 3, "pass") // Ethernet header
+	a.ldx(bpfH, 5, 2, 12)
+	a.be16(5)
+	a.jmpImm(bpfJEQ, 5, 0x0800, "ipv4")
+	a.jmpImm(bpfJNE, 5, 0x86dd, "pass")
+
+	// IPv6: fixed 40-byte header, then UDP
+	a.movReg(4, 2)
+	a.addImm(4, 14+40+8)
+	a.jmpReg(bpfJGT, 4, 3, "pass")
+	a.ldx(bpfB, 5, 2, 14+6)
+	a.jmpImm(bpfJNE, 5, syscall.IPPROTO_UDP, "pass")
+	a.ldx(bpfH, 5, 2, 14+40+2)
+	a.ja("port")
+
+	// IPv4: variable header length, and only first fragments carry UDP
+	a.label("ipv4")
+	a.movReg(4, 2)
+	a.addImm(4, 14+20)
+	a.jmpReg(bpfJGT, 4, 3, "pass")
+	a.ldx(bpfB, 5, 2, 14+9)
+	a.jmpImm(bpfJNE, 5, syscall.IPPROTO_UDP, "pass")
+	a.ldx(bpfH, 5, 2, 14+6)
+	a.be16(5)
+	a.andImm(5, 0x1fff)
+	a.jmpImm(bpfJNE, 5, 0, "pass")
+	a.ldx(bpfB, 5, 2, 14)
+	a.andImm(5, 0x0f)
+	a.lshImm(5, 2)
+	a.addImm(2, 14)
+	a.addReg(2, 5) // r2 = UDP header
+	a.movReg(4, 2)
+	a.addImm(4, 8)
+	a.jmpReg(bpfJGT, 4, 3, "pass")
+	a.ldx(bpfH, 5, 2, 2)
+
+	// r5 = destination port as read; look up its limit
+	a.label("port")
+	a.be16(5)
+	a.stx(bpfW, 10, 5, -4)
+	a.ldMapFD(1, mapFD)
+	a.movReg(2, 10)
+	a.addImm(2, -4)
+	a.call(bpfFuncMapLookup)
+	a.jmpImm(bpfJEQ, 0, 0, "pass")
+	a.movReg(6, 0) // r6 = xdpPortValue
+	a.call(bpfFuncKtimeNs)
+	a.ldx(bpfDW, 1, 6, 0)
+	a.movReg(2, 0)
+	a.subReg(2, 1)
+	a.jmpImm(bpfJLT, 2, 1e9, "count")
+	a.stx(bpfDW, 6, 0, 0) // New window
+	a.movImm(1, 0)
+	a.stx(bpfDW, 6, 1, 8)
+	a.label("count")
+	a.movImm(1, 1)
+	a.xadd(6, 1, 8)
+	a.ldx(bpfDW, 1, 6, 8)
+	a.ldx(bpfDW, 2, 6, 24)
+	a.jmpReg(bpfJGT, 1, 2, "drop")
+
+	a.label("pass")
+	a.movImm(0, xdpPass)
+	a.exit()
+
+	a.label("drop")
+	a.movImm(1, 1)
+	a.xadd(6, 1, 16)
+	a.movImm(0, xdpDrop)
+	a.exit()
+	return a.assemble()
+}
+
+// bpfInsn is one eBPF instruction, laid out as struct bpf_insn on a
+// little-endian machine
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high one
+	off  int16
+	imm  int32
+}
+
+// eBPF opcode parts
+const (
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfMEM  = 0x60
+	bpfXADD = 0xc0
+	bpfIMM  = 0x00
+	bpfLD   = 0x00
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD  = 0x00
+	bpfSUB  = 0x10
+	bpfAND  = 0x50
+	bpfLSH  = 0x60
+	bpfMOV  = 0xb0
+	bpfEND  = 0xd0
+	bpfToBE = 0x08
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJNE  = 0x50
+	bpfJLT  = 0xa0
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+)
+
+// bpfAsm assembles a program, resolving jumps to named labels
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string // Instruction index to target label
+}
+
+func (a *bpfAsm) emit(code uint8, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm})
+}
+
+func (a *bpfAsm) jump(code uint8, dst, src uint8, imm int32, label string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = label
+	a.emit(code, dst, src, 0, imm)
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) ldx(size, dst, src uint8, off int16) { a.emit(bpfLDX|bpfMEM|size, dst, src, off, 0) }
+func (a *bpfAsm) stx(size, dst, src uint8, off int16) { a.emit(bpfSTX|bpfMEM|size, dst, src, off, 0) }
+func (a *bpfAsm) xadd(dst, src uint8, off int16)      { a.emit(bpfSTX|bpfXADD|bpfDW, dst, src, off, 0) }
+func (a *bpfAsm) movReg(dst, src uint8)               { a.emit(bpfALU64|bpfMOV|bpfX, dst, src, 0, 0) }
+func (a *bpfAsm) movImm(dst uint8, imm int32)         { a.emit(bpfALU64|bpfMOV|bpfK, dst, 0, 0, imm) }
+func (a *bpfAsm) addReg(dst, src uint8)               { a.emit(bpfALU64|bpfADD|bpfX, dst, src, 0, 0) }
+func (a *bpfAsm) addImm(dst uint8, imm int32)         { a.emit(bpfALU64|bpfADD|bpfK, dst, 0, 0, imm) }
+func (a *bpfAsm) subReg(dst, src uint8)               { a.emit(bpfALU64|bpfSUB|bpfX, dst, src, 0, 0) }
+func (a *bpfAsm) andImm(dst uint8, imm int32)         { a.emit(bpfALU64|bpfAND|bpfK, dst, 0, 0, imm) }
+func (a *bpfAsm) lshImm(dst uint8, imm int32)         { a.emit(bpfALU64|bpfLSH|bpfK, dst, 0, 0, imm) }
+func (a *bpfAsm) be16(dst uint8)                      { a.emit(bpfALU|bpfEND|bpfToBE, dst, 0, 0, 16) }
+func (a *bpfAsm) call(helper int32)                   { a.emit(bpfJMP|bpfCALL, 0, 0, 0, helper) }
+func (a *bpfAsm) exit()                               { a.emit(bpfJMP|bpfEXIT, 0, 0, 0, 0) }
+func (a *bpfAsm) ja(label string)                     { a.jump(bpfJMP|bpfJA, 0, 0, 0, label) }
+
+func (a *bpfAsm) jmpImm(op uint8, dst uint8, imm int32, label string) {
+	a.jump(bpfJMP|op|bpfK, dst, 0, imm, label)
+}
+
+func (a *bpfAsm) jmpReg(op uint8, dst, src uint8, label string) {
+	a.jump(bpfJMP|op|bpfX, dst, src, 0, label)
+}
+
+// ldMapFD loads a map reference into dst; it takes two instruction slots
+func (a *bpfAsm) ldMapFD(dst uint8, fd int) {
+	a.emit(bpfLD|bpfIMM|bpfDW, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+// assemble resolves the jumps and returns the program
+func (a *bpfAsm) assemble() []bpfInsn {
+	for i, label := range a.jumps {
+		target, ok := a.labels[label]
+		if !ok {
+			panic("bpf: undefined label " + label)
+		}
+		a.insns[i].off = int16(target - i - 1)
+	}
+	return a.insns
+}
+
+// bpf calls bpf(2) with attr
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func bpfCreateMap(mapType, keySize, valueSize, maxEntries int) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{uint32(mapType), uint32(keySize), uint32(valueSize), uint32(maxEntries), 0}
+	return bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfMapElem looks up or updates (with BPF_ANY) the element at key
+func bpfMapElem(cmd, mapFD int, key, value unsafe.Pointer) error {
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFD: uint32(mapFD), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// bpfLoadXDP loads an XDP program. If the verifier rejects it, the load is
+// repeated with its log, whose end is returned in the error.
+func bpfLoadXDP(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	load := func(logBuf []byte) (int, error) {
+		attr := struct {
+			progType    uint32
+			insnCnt     uint32
+			insns       uint64
+			license     uint64
+			logLevel    uint32
+			logSize     uint32
+			logBuf      uint64
+			kernVersion uint32
+			progFlags   uint32
+			progName    [16]byte
+		}{
+			progType: bpfProgTypeXDP,
+			insnCnt:  uint32(len(insns)),
+			insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+			license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		}
+		copy(attr.progName[:], "wg_relay_limit")
+		if logBuf != nil {
+			attr.logLevel = 1
+			attr.logSize = uint32(len(logBuf))
+			attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+		}
+		fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(insns)
+		runtime.KeepAlive(license)
+		runtime.KeepAlive(logBuf)
+		return fd, err
+	}
+
+	fd, err := load(nil)
+	if err == nil || !errors.Is(err, syscall.EACCES) && !errors.Is(err, syscall.EINVAL) {
+		return fd, err
+	}
+	logBuf := make([]byte, 1<<16)
+	if _, verr := load(logBuf); verr != nil {
+		lines := strings.Split(strings.TrimRight(string(logBuf[:clen(logBuf)]), "\n"), "\n")
+		if len(lines) > 3 {
+			lines = lines[len(lines)-3:]
+		}
+		return -1, fmt.Errorf("%v: %s", err, strings.Join(lines, "; "))
+	}
+	return -1, err
+}
+
+// clen returns the length of the NUL-terminated string in b
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+func bpfLinkXDP(progFD, ifindex int) (int, error) {
+	attr := struct {
+		progFD     uint32
+		ifindex    uint32
+		attachType uint32
+		flags      uint32
+	}{uint32(progFD), uint32(ifindex), bpfAttachXDP, 0}
+	return bpf(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
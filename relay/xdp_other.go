@@ -0,0 +1,19 @@
+//go:build !linux || !(amd64 || arm64)
+
+package relay
+
+import "errors"
+
+// xdpLimiter is only implemented on Linux on amd64 and arm64
+type xdpLimiter struct {
+	iface string
+	rate  int
+}
+
+func attachXDP(iface string, ports []int, rate int) (*xdpLimiter, error) {
+	return nil, errors.New("XDP is only supported on Linux (amd64 and arm64)")
+}
+
+func (x *xdpLimiter) dropped(port int) uint64 { return 0 }
+
+func (x *xdpLimiter) close() {}